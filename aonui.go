@@ -2,30 +2,212 @@
 // Forecast System runs in GRIB format.
 package aonui
 
-import "time"
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
 
 // Default fetch strategy
 var DefaultFetchStrategy = FetchStrategy{
-	MaximumRetries: 5,
-	RetrySleep:     30 * time.Second,
-	FetchTimeout:   5 * time.Minute,
+	MaximumRetries:   5,
+	RetrySleep:       30 * time.Second,
+	FetchTimeout:     5 * time.Minute,
+	MaxFetchDuration: time.Hour,
+	IndexTimeout:     time.Minute,
+	MaxIndexSize:     4 << 20,
+	CheckGribMagic:   true,
+
+	MaxConsecutiveFailures: 10,
+}
+
+// The isobaric levels, in mb, provided by the GFS. The levels are in Tawhiri
+// order, i.e. decreasing pressure.
+var gfsPressureLevels = []int{
+	1000, 975, 950, 925, 900, 875, 850, 825, 800, 775, 750, 725, 700, 675,
+	650, 625, 600, 575, 550, 525, 500, 475, 450, 425, 400, 375, 350, 325,
+	300, 275, 250, 225, 200, 175, 150, 125, 100, 70, 50, 30, 20, 10, 7, 5,
+	3, 2, 1,
+}
+
+// Settings for the sources returned by GFSDataSource which vary by resolution
+type gfsResolution struct {
+	Dir             string // Directory on the NCEP server holding runs, e.g. "prod/"
+	LegacyNames     bool   // If true, datasets are named "gfs.tHHz.pgrb2fNNN" without the resolution
+	MinDatasets     int
+	MaxForecastHour int
+	Schedule        ForecastSchedule
+}
+
+// The resolutions of the GFS known to GFSDataSource. The 0.25 degree data is
+// still in the "para" directory for proposed products and the 0.5 degree data
+// uses the original naming of datasets.
+var gfsResolutions = map[string]gfsResolution{
+	"0p25": {
+		Dir:         "para/",
+		MinDatasets: 186,
+		Schedule:    ForecastSchedule{{UntilHour: 240, Step: 3}, {UntilHour: 384, Step: 12}},
+	},
+	"0p50": {
+		Dir:             "prod/",
+		LegacyNames:     true,
+		MinDatasets:     146,
+		MaxForecastHour: 200,
+		Schedule:        ForecastSchedule{{UntilHour: 192, Step: 3}, {UntilHour: 384, Step: 12}},
+	},
+	"1p00": {
+		Dir:         "prod/",
+		MinDatasets: 258,
+		Schedule:    ForecastSchedule{{UntilHour: 384, Step: 3}},
+	},
+}
+
+// GFSDataSource returns a DataSource for the GRIBs from the Global Forecast
+// System (GFS) at the given resolution, "0p25", "0p50" or "1p00" for 0.25, 0.5
+// and 1 degree respectively. Returns nil if the resolution is unknown.
+func GFSDataSource(resolution string) *DataSource {
+	res, ok := gfsResolutions[resolution]
+	if !ok {
+		return nil
+	}
+
+	datasetPattern := `^gfs\.t(?P<runHour>\d{2})z\.(?P<typeId>pgrb2b?)\.` +
+		regexp.QuoteMeta(resolution) + `\.f(?P<fcstHour>\d+)$`
+	if res.LegacyNames {
+		datasetPattern = `^gfs\.t(?P<runHour>\d{2})z.(?P<typeId>pgrb2b?f)(?P<fcstHour>\d+)$`
+	}
+
+	return &DataSource{
+		Root:            "http://www.ftp.ncep.noaa.gov/data/nccf/com/gfs/" + res.Dir,
+		RunPattern:      `^gfs\.(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})(?P<hour>\d{2})$`,
+		DatasetPattern:  datasetPattern,
+		FetchStrategy:   DefaultFetchStrategy,
+		MaxForecastHour: res.MaxForecastHour,
+		MinDatasets:     res.MinDatasets,
+		Schedule:        res.Schedule,
+		PressureLevels:  gfsPressureLevels,
+	}
 }
 
 // The proposed 0.25 degree resolution GRIBs from the Global Forecast System (GFS).
-var GFSQuarterDegreeDataset = DataSource{
-	Root:           "http://www.ftp.ncep.noaa.gov/data/nccf/com/gfs/para/",
-	RunPattern:     `^gfs\.(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})(?P<hour>\d{2})$`,
-	DatasetPattern: `^gfs\.t(?P<runHour>\d{2})z\.(?P<typeId>pgrb2b?)\.0p25\.f(?P<fcstHour>\d+)$`,
+var GFSQuarterDegreeDataset = *GFSDataSource("0p25")
+
+// The original 0.5 degree resolution GRIBs from the Global Forecast System (GFS).
+var GFSHalfDegreeDataset = *GFSDataSource("0p50")
+
+// The 1 degree resolution GRIBs from the Global Forecast System (GFS).
+var GFSOneDegreeDataset = *GFSDataSource("1p00")
+
+// The 0.5 degree resolution GRIBs from the Global Forecast System (GFS) as
+// mirrored in the NOAA Open Data Dissemination program's S3 bucket. Anonymous
+// access is supported.
+var GFSHalfDegreeS3Dataset = DataSource{
+	Root:             "https://noaa-gfs-bdp-pds.s3.amazonaws.com/",
+	S3:               true,
+	RunPattern:       `^gfs\.(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})$`,
+	RunSubdirPattern: `^(?P<hour>\d{2})$`,
+	DatasetDir:       "atmos/",
+	DatasetPattern:   `^gfs\.t(?P<runHour>\d{2})z\.(?P<typeId>pgrb2b?)\.0p50\.f(?P<fcstHour>\d+)$`,
+	FetchStrategy:    DefaultFetchStrategy,
+	MaxForecastHour:  200,
+	MinDatasets:      258,
+	Schedule:         ForecastSchedule{{UntilHour: 384, Step: 3}},
+	PressureLevels:   gfsPressureLevels,
+}
+
+// Hourly runs of the High-Resolution Rapid Refresh (HRRR) over the
+// contiguous United States. Data is on a 3km Lambert Conformal grid rather
+// than a latitude-longitude grid. All of a day's runs share one directory on
+// the server. Runs forecast 18 hours ahead except for those at the synoptic
+// hours which forecast 48 hours ahead.
+var HRRRDataset = DataSource{
+	Root:           "http://www.ftp.ncep.noaa.gov/data/nccf/com/hrrr/prod/",
+	RunPattern:     `^hrrr\.(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})$`,
+	RunHours:       hrrrRunHours,
+	DatasetDir:     "conus/",
+	DatasetPattern: `^hrrr\.t(?P<runHour>\d{2})z\.(?P<typeId>wrfprs)f(?P<fcstHour>\d+)\.grib2$`,
 	FetchStrategy:  DefaultFetchStrategy,
-	MinDatasets:    186,
+	MinDatasets:    19,
+	Schedule:       ForecastSchedule{{UntilHour: 18, Step: 1}},
+	RunSchedules: map[int]ForecastSchedule{
+		0:  hrrrSynopticSchedule,
+		6:  hrrrSynopticSchedule,
+		12: hrrrSynopticSchedule,
+		18: hrrrSynopticSchedule,
+	},
 }
 
-// The original 0.5 degree resolution GRIBs from the Global Forecast System (GFS).
-var GFSHalfDegreeDataset = DataSource{
-	Root:            "http://www.ftp.ncep.noaa.gov/data/nccf/com/gfs/prod/",
-	RunPattern:      `^gfs\.(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})(?P<hour>\d{2})$`,
-	DatasetPattern:  `^gfs\.t(?P<runHour>\d{2})z.(?P<typeId>pgrb2b?f)(?P<fcstHour>\d+)$`,
-	FetchStrategy:   DefaultFetchStrategy,
-	MaxForecastHour: 200,
-	MinDatasets:     146,
+// The forecast hours of HRRR runs at the synoptic hours
+var hrrrSynopticSchedule = ForecastSchedule{{UntilHour: 48, Step: 1}}
+
+// The hours of each day at which the HRRR is run
+var hrrrRunHours = []int{
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19,
+	20, 21, 22, 23,
+}
+
+// The isobaric levels, in mb, provided by the GEFS "pgrb2a" datasets.
+var gefsPressureLevels = []int{1000, 925, 850, 700, 500, 300, 250, 200, 100, 50, 10}
+
+// GEFSDataset returns a DataSource for the Global Ensemble Forecast System
+// (GEFS) for a single ensemble member. Member 0 is the control run and members
+// 1 onwards are the perturbed runs. The member is recorded as "gec00", "gep01",
+// etc. in the Member field of each Dataset.
+func GEFSDataset(member int) DataSource {
+	memberID := fmt.Sprintf("gep%02d", member)
+	if member == 0 {
+		memberID = "gec00"
+	}
+
+	return DataSource{
+		Root:             "http://www.ftp.ncep.noaa.gov/data/nccf/com/gens/prod/",
+		RunPattern:       `^gefs\.(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})$`,
+		RunSubdirPattern: `^(?P<hour>\d{2})$`,
+		DatasetDir:       "pgrb2a/",
+		DatasetPattern: `^(?P<member>` + memberID +
+			`)\.t(?P<runHour>\d{2})z\.(?P<typeId>pgrb2a)f(?P<fcstHour>\d+)$`,
+		FetchStrategy:  DefaultFetchStrategy,
+		MinDatasets:    65,
+		Schedule:       ForecastSchedule{{UntilHour: 384, Step: 6}},
+		PressureLevels: gefsPressureLevels,
+	}
+}
+
+// DataSources maps names to the known data sources. GFS sources are named
+// after their resolution, e.g. "gfs-0p50", "gfs-0p25" and "gfs-1p00". GEFS sources are
+// named after their ensemble member, e.g. "gefs-c00" for the control run and
+// "gefs-p01" onwards for the perturbed runs. The HRRR is named "hrrr". Sources
+// mirrored in S3 have "-s3" appended to their name.
+var DataSources = map[string]*DataSource{
+	"gfs-0p50":    &GFSHalfDegreeDataset,
+	"gfs-0p25":    &GFSQuarterDegreeDataset,
+	"gfs-1p00":    &GFSOneDegreeDataset,
+	"gfs-0p50-s3": &GFSHalfDegreeS3Dataset,
+	"hrrr":        &HRRRDataset,
+}
+
+// The number of perturbed GEFS ensemble members
+const gefsPerturbedMembers = 20
+
+func init() {
+	for member := 0; member <= gefsPerturbedMembers; member++ {
+		name := fmt.Sprintf("gefs-p%02d", member)
+		if member == 0 {
+			name = "gefs-c00"
+		}
+		src := GEFSDataset(member)
+		DataSources[name] = &src
+	}
+}
+
+// DataSourceNames returns the names of all sources in DataSources in sorted
+// order.
+func DataSourceNames() []string {
+	names := []string{}
+	for name := range DataSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
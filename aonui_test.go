@@ -0,0 +1,66 @@
+package aonui
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The existing GFS sources must be unchanged by being built with
+// GFSDataSource.
+func TestGFSDataSourceUnchanged(t *testing.T) {
+	quarter := DataSource{
+		Root:           "http://www.ftp.ncep.noaa.gov/data/nccf/com/gfs/para/",
+		RunPattern:     `^gfs\.(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})(?P<hour>\d{2})$`,
+		DatasetPattern: `^gfs\.t(?P<runHour>\d{2})z\.(?P<typeId>pgrb2b?)\.0p25\.f(?P<fcstHour>\d+)$`,
+		FetchStrategy:  DefaultFetchStrategy,
+		MinDatasets:    186,
+		Schedule:       ForecastSchedule{{UntilHour: 240, Step: 3}, {UntilHour: 384, Step: 12}},
+		PressureLevels: gfsPressureLevels,
+	}
+	half := DataSource{
+		Root:            "http://www.ftp.ncep.noaa.gov/data/nccf/com/gfs/prod/",
+		RunPattern:      `^gfs\.(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})(?P<hour>\d{2})$`,
+		DatasetPattern:  `^gfs\.t(?P<runHour>\d{2})z.(?P<typeId>pgrb2b?f)(?P<fcstHour>\d+)$`,
+		FetchStrategy:   DefaultFetchStrategy,
+		MaxForecastHour: 200,
+		MinDatasets:     146,
+		Schedule:        ForecastSchedule{{UntilHour: 192, Step: 3}, {UntilHour: 384, Step: 12}},
+		PressureLevels:  gfsPressureLevels,
+	}
+
+	if got := *GFSDataSource("0p25"); !reflect.DeepEqual(got, quarter) {
+		t.Errorf("0p25 source is\n%+v\nwant\n%+v", got, quarter)
+	}
+	if got := *GFSDataSource("0p50"); !reflect.DeepEqual(got, half) {
+		t.Errorf("0p50 source is\n%+v\nwant\n%+v", got, half)
+	}
+	if GFSDataSource("2p00") != nil {
+		t.Error("expected nil for an unknown resolution")
+	}
+}
+
+func TestHRRRSchedule(t *testing.T) {
+	for _, test := range []struct {
+		RunHour, LastHour int
+	}{
+		{0, 48}, {3, 18}, {6, 48}, {13, 18}, {18, 48},
+	} {
+		hours := HRRRDataset.expectedForecastHours(HRRRDataset.ScheduleFor(test.RunHour))
+		if got := hours[len(hours)-1]; got != test.LastHour {
+			t.Errorf("run at %02dZ ends at f%02d, want f%02d", test.RunHour, got, test.LastHour)
+		}
+	}
+}
+
+func TestMissingPressureLevels(t *testing.T) {
+	ds := DataSource{PressureLevels: []int{1000, 850, 500, 250}}
+
+	missing := ds.MissingPressureLevels([]int{500, 1000, 500, 10})
+	if want := []int{850, 250}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("missing levels %v, want %v", missing, want)
+	}
+
+	if missing := ds.MissingPressureLevels(ds.PressureLevels); len(missing) != 0 {
+		t.Errorf("missing levels %v, want none", missing)
+	}
+}
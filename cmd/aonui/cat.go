@@ -0,0 +1,90 @@
+package main
+
+// Merge GRIB2 files into a single file in Tawhiri order
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rjw57/aonui"
+)
+
+var cmdCat = &Command{
+	UsageLine: "cat [-keepunused] [-dedup] [-verify] ingribfile... outgribfile",
+	Short:     "merge GRIB2 files into one file in Tawhiri order",
+	Long: `
+Cat will take one or more existing GRIB2 files on disk and write out a single
+new GRIB2 file containing the records of all of them re-ordered into the order
+Tawhiri expects. (See "aonui help tawhiri" for details on this ordering.) It
+is useful for combining separately downloaded forecast hours into one file.
+
+Input is read from each ingribfile and written to outgribfile. Records not
+used by Tawhiri will not be written to the output unless the -keepunused flag
+is present. In that case they are written after the Tawhiri records in the
+order they appear in the input files.
+
+If the -dedup flag is present, only the first of several records with the same
+forecast hour, pressure and parameter is written. Records from earlier input
+files take precedence.
+
+If the -verify flag is present, outgribfile is checked once written to make sure
+it is made up of complete GRIB2 messages, one for each record written.
+
+See also: aonui help reorder, aonui help tawhiri
+`,
+}
+
+// Command-line flags
+var (
+	catKeepUnused bool
+	catVerify     bool
+	catDedup      bool
+)
+
+func init() {
+	cmdCat.Run = runCat // break init cycle
+	cmdCat.Flag.BoolVar(&catKeepUnused, "keepunused", false,
+		"keep records not used by Tawhiri")
+	cmdCat.Flag.BoolVar(&catVerify, "verify", false,
+		"check output after writing")
+	cmdCat.Flag.BoolVar(&catDedup, "dedup", false,
+		"drop duplicate records")
+}
+
+func runCat(cmd *Command, args []string) {
+	// Get files from command line
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "at least one input and an output grib file must be specified\n")
+		setExitStatus(1)
+		return
+	}
+
+	gribFns := args[:len(args)-1]
+	outFn := args[len(args)-1]
+
+	// Do not clobber an input
+	for _, fn := range gribFns {
+		if fn == outFn {
+			fmt.Fprintf(os.Stderr, "output file %v is also an input\n", outFn)
+			setExitStatus(1)
+			return
+		}
+	}
+
+	// Make sure we can process GRIBs before doing any work
+	if err := aonui.GribBackend.Check(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		setExitStatus(1)
+		return
+	}
+
+	opts := aonui.TawhiriReorderOptions
+	opts.KeepUnused = catKeepUnused
+	opts.Verify = catVerify
+	opts.Dedup = catDedup
+	if err := aonui.MergeGrib2With(gribFns, outFn, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		setExitStatus(1)
+		return
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+// Catalog of the runs downloaded to a directory
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rjw57/aonui"
+)
+
+var cmdCatalog = &Command{
+	UsageLine: "catalog [dir]",
+	Short:     "rebuild the catalog of GRIB2 files in a directory",
+	Long: `
+Catalog scans dir, or the current directory if dir is omitted, and its
+sub-directories for GRIB2 files with a .grib2 extension and writes a catalog
+describing them to catalog.json in dir. If a catalog already exists it is
+replaced. Files with a .partial manifest alongside them are partial downloads
+by "aonui sync" which have yet to be resumed and are skipped.
+
+The catalog is a JSON object whose "runs" field is a list with one entry for
+each file, newest run first. For example:
+
+	{
+	  "runs": [
+	    {
+	      "identifier": "gfs.2014111012",
+	      "when": "2014-11-10T12:00:00Z",
+	      "source": "gfs-0p50",
+	      "filename": "gfs.2014111012.grib2",
+	      "size": 1234567890,
+	      "parameters": [ "HGT", "UGRD", "VGRD" ],
+	      "forecastHours": [ 0, 3, <etc> ]
+	    }
+	  ]
+	}
+
+Filenames are relative to dir. The parameters and forecast hours are collated
+in the same way as "aonui info" and so a GRIB tool must be installed. The
+identifier and source of a file are taken from any existing catalog entry for
+it. Otherwise the identifier is the filename without its extension and the
+source is omitted.
+
+Sync can keep a catalog up to date as runs are downloaded. See the -catalog
+flag of "aonui help sync".
+`,
+}
+
+func init() {
+	cmdCatalog.Run = runCatalog // break init cycle
+}
+
+// A catalog lists the runs downloaded to a directory.
+type catalog struct {
+	Runs []catalogEntry `json:"runs"`
+}
+
+// A catalogEntry describes one downloaded run.
+type catalogEntry struct {
+	Identifier    string    `json:"identifier"`
+	When          time.Time `json:"when"`
+	Source        string    `json:"source,omitempty"`
+	Filename      string    `json:"filename"` // Relative to the catalog
+	Size          int64     `json:"size"`
+	Parameters    []string  `json:"parameters"`
+	ForecastHours []int     `json:"forecastHours"`
+}
+
+// catalogFilename returns the name of the catalog for dir.
+func catalogFilename(dir string) string {
+	return filepath.Join(dir, "catalog.json")
+}
+
+// loadCatalog reads the catalog in fn. If fn does not exist, an empty catalog
+// is returned.
+func loadCatalog(fn string) (*catalog, error) {
+	c := &catalog{Runs: []catalogEntry{}}
+	contents, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Add adds entry to the catalog replacing any entry with the same filename.
+// Entries are kept sorted newest first.
+func (c *catalog) Add(entry catalogEntry) {
+	runs := []catalogEntry{entry}
+	for _, e := range c.Runs {
+		if e.Filename != entry.Filename {
+			runs = append(runs, e)
+		}
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].When.After(runs[j].When) })
+	c.Runs = runs
+}
+
+// Save writes the catalog to fn. The catalog is written to a temporary file
+// which is renamed over fn so that readers never see a partial catalog.
+func (c *catalog) Save(fn string) error {
+	contents, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(fn), "catalog-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmpFile.Write(contents); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), fn)
+}
+
+// addToCatalog adds entry to the catalog in dir creating it if necessary.
+// The entry's Filename should be the absolute or working directory relative
+// name of the file and is made relative to dir. Its Size is set from the
+// file.
+func addToCatalog(dir string, entry catalogEntry) error {
+	fi, err := os.Stat(entry.Filename)
+	if err != nil {
+		return err
+	}
+	entry.Size = fi.Size()
+	if rel, err := filepath.Rel(dir, entry.Filename); err == nil {
+		entry.Filename = rel
+	}
+
+	fn := catalogFilename(dir)
+	c, err := loadCatalog(fn)
+	if err != nil {
+		return err
+	}
+	c.Add(entry)
+	return c.Save(fn)
+}
+
+// sourceName returns the name of src in aonui.DataSources or the empty string
+// if it is not there.
+func sourceName(src *aonui.DataSource) string {
+	for name, s := range aonui.DataSources {
+		if s == src {
+			return name
+		}
+	}
+	return ""
+}
+
+func runCatalog(cmd *Command, args []string) {
+	dir := "."
+	switch len(args) {
+	case 0:
+	case 1:
+		dir = args[0]
+	default:
+		log.Print("error: at most one directory may be specified")
+		setExitStatus(2)
+		return
+	}
+
+	// Existing entries give identifiers and sources
+	fn := catalogFilename(dir)
+	oldCatalog, err := loadCatalog(fn)
+	if err != nil {
+		log.Print("warning: ignoring existing catalog: ", err)
+		oldCatalog = &catalog{}
+	}
+	oldEntries := make(map[string]catalogEntry)
+	for _, e := range oldCatalog.Runs {
+		oldEntries[e.Filename] = e
+	}
+
+	// Find GRIB2 files
+	var gribFns []string
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || filepath.Ext(path) != ".grib2" {
+			return nil
+		}
+
+		// Skip interrupted downloads which are yet to be resumed
+		if _, err := os.Stat(manifestFilename(path)); err == nil {
+			log.Print("skipping partial download ", path)
+			return nil
+		}
+		gribFns = append(gribFns, path)
+		return nil
+	})
+	if err != nil {
+		log.Print("error: ", err)
+		setExitStatus(1)
+		return
+	}
+
+	// Describe each one
+	c := &catalog{Runs: []catalogEntry{}}
+	for _, gribFn := range gribFns {
+		rel, err := filepath.Rel(dir, gribFn)
+		if err != nil {
+			rel = gribFn
+		}
+
+		fi, err := os.Stat(gribFn)
+		if err != nil {
+			log.Print("error: ", err)
+			setExitStatus(1)
+			continue
+		}
+
+		gi, ok := loadInfoCache(gribFn)
+		if !ok {
+			log.Print("Scanning ", gribFn)
+			if gi, err = computeGribInfo(gribFn); err != nil {
+				log.Print("error scanning ", gribFn, ": ", err)
+				setExitStatus(1)
+				continue
+			}
+			if err := saveInfoCache(gribFn, gi); err != nil {
+				log.Print("warning: could not cache information: ", err)
+			}
+		}
+
+		entry := catalogEntry{
+			Identifier:    strings.TrimSuffix(filepath.Base(rel), filepath.Ext(rel)),
+			When:          gi.RunTime,
+			Filename:      rel,
+			Size:          fi.Size(),
+			Parameters:    gi.Parameters,
+			ForecastHours: gi.ForecastHours,
+		}
+		if old, ok := oldEntries[rel]; ok {
+			entry.Identifier, entry.Source = old.Identifier, old.Source
+		}
+		c.Add(entry)
+	}
+
+	if err := c.Save(fn); err != nil {
+		log.Print("error writing catalog: ", err)
+		setExitStatus(1)
+		return
+	}
+	log.Print("Catalogued ", len(c.Runs), " run(s) in ", fn)
+}
@@ -0,0 +1,72 @@
+package main
+
+// Checksums of downloaded runs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// checksumFilename returns the name of the SHA256 sidecar for fn.
+func checksumFilename(fn string) string {
+	return fn + ".sha256"
+}
+
+// writeChecksumFile computes the SHA256 digest of fn and writes it to the
+// sidecar file in the format used by sha256sum.
+func writeChecksumFile(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	line := fmt.Sprintf("%x  %v\n", h.Sum(nil), filepath.Base(fn))
+	return ioutil.WriteFile(checksumFilename(fn), []byte(line), 0666)
+}
+
+// verifyManifestChecksums re-reads each dataset recorded in manifest from fn
+// and checks it has the SHA256 digest recorded when it was written and, if
+// known, the length given by its inventory. Datasets without a recorded digest
+// are only checked for length.
+func verifyManifestChecksums(fn string, manifest *syncManifest) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for identifier, r := range manifest.Datasets {
+		if r.Expected > 0 && r.Length != r.Expected {
+			return fmt.Errorf("dataset %v in %v is %d bytes, its inventory gives %d",
+				identifier, fn, r.Length, r.Expected)
+		}
+		if r.SHA256 == "" {
+			continue
+		}
+
+		h := sha256.New()
+		n, err := io.Copy(h, io.NewSectionReader(f, r.Offset, r.Length))
+		if err != nil {
+			return err
+		}
+		if n != r.Length {
+			return fmt.Errorf("%v is truncated within dataset %v", fn, identifier)
+		}
+		if hex.EncodeToString(h.Sum(nil)) != r.SHA256 {
+			return fmt.Errorf("checksum mismatch for dataset %v in %v", identifier, fn)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+// Compare the inventories of two GRIB2 files
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/rjw57/aonui"
+)
+
+var diffDumpJson bool
+
+var cmdDiff = &Command{
+	UsageLine: "diff [-json] gribfileA gribfileB",
+	Short:     "compare the records in two GRIB2 files",
+	Long: `
+Diff compares the inventories of the GRIB2 files gribfileA and gribfileB and
+reports records present in one file but not the other along with records whose
+extent in bytes differs. This is useful for checking that "aonui reorder" or
+"aonui extract" did not drop any data. Each difference is printed to standard
+output in one of the following forms:
+
+	ONLYA FCSTHOUR=3 PARAM=UGRD LAYER="500 mb"
+	ONLYB FCSTHOUR=6 PARAM=HGT LAYER="2 m above ground"
+	EXTENT FCSTHOUR=0 PARAM=VGRD LAYER="850 mb" A=123456 B=123789
+
+Records are matched by forecast hour, parameter and layer. A record with more
+than one parameter is compared once for each of them. Only records on pressure,
+height above ground and surface layers whose forecast hour can be parsed are
+compared. (See "aonui help tawhiri".) If a file has several records for the
+same forecast hour, parameter and layer, only the first is compared. Records
+in gribfileA are reported first, in the order they appear in the file,
+followed by those only in gribfileB.
+
+If the -json flag is specified, a JSON array with one object per difference is
+written instead. Each object has the keys status ("onlyA", "onlyB" or
+"extent"), forecastHour, parameter and layer along with pressure for records
+on pressure layers and extentA and extentB for the records which are present.
+
+If any differences are found, diff exits with a non-zero status. Only the
+inventories are compared. Use "aonui valuediff" to compare the data values of
+a record.
+
+See also: aonui help inv, aonui help valuediff
+`,
+}
+
+func init() {
+	cmdDiff.Run = runDiff // break init cycle
+	cmdDiff.Flag.BoolVar(&diffDumpJson, "json", false,
+		"dump differences in JSON format")
+}
+
+// A diffKey identifies a record by forecast hour, parameter and layer.
+type diffKey struct {
+	ForecastHour int
+	Parameter    string
+	LayerName    string
+}
+
+// A diffRecord is a record in a GRIB2 file being compared.
+type diffRecord struct {
+	Key      diffKey
+	Pressure int   // Pressure in mb if the record is on a pressure layer (or 0)
+	Extent   int64 // Length of the record in bytes
+}
+
+// A recordDiff is a difference between the records in two GRIB2 files.
+type recordDiff struct {
+	Status       string `json:"status"` // "onlyA", "onlyB" or "extent"
+	ForecastHour int    `json:"forecastHour"`
+	Parameter    string `json:"parameter"`
+	LayerName    string `json:"layer"`
+	Pressure     int    `json:"pressure,omitempty"`
+	ExtentA      int64  `json:"extentA,omitempty"`
+	ExtentB      int64  `json:"extentB,omitempty"`
+}
+
+func runDiff(cmd *Command, args []string) {
+	if len(args) != 2 {
+		log.Print("error: exactly two GRIB files must be specified")
+		setExitStatus(2)
+		return
+	}
+
+	// Make sure we can process GRIBs before doing any work
+	if err := aonui.GribBackend.Check(); err != nil {
+		log.Print("error: ", err)
+		setExitStatus(1)
+		return
+	}
+
+	var records [2][]diffRecord
+	for idx, gribFn := range args {
+		inv, err := aonui.GribBackend.Inventory(gribFn)
+		if err != nil {
+			log.Print("error: ", err)
+			setExitStatus(1)
+			return
+		}
+		records[idx] = diffRecords(inv)
+	}
+	diffs := diffInventories(records[0], records[1])
+
+	if diffDumpJson {
+		je := json.NewEncoder(os.Stdout)
+		if err := je.Encode(diffs); err != nil {
+			log.Print("error writing json: ", err)
+			setExitStatus(1)
+			return
+		}
+	} else {
+		for _, d := range diffs {
+			fmt.Printf("%v FCSTHOUR=%d PARAM=%v LAYER=%q",
+				strings.ToUpper(d.Status), d.ForecastHour, d.Parameter, d.LayerName)
+			if d.Status == "extent" {
+				fmt.Printf(" A=%d B=%d", d.ExtentA, d.ExtentB)
+			}
+			fmt.Println()
+		}
+	}
+
+	if len(diffs) > 0 {
+		log.Print(args[0], " and ", args[1], " differ in ", len(diffs), " record(s)")
+		setExitStatus(1)
+		return
+	}
+	log.Print(args[0], " and ", args[1], " have the same records")
+}
+
+// diffRecords returns the records of inv which can be compared in the order
+// they appear in inv. Only the first record with each key is returned.
+func diffRecords(inv aonui.Inventory) []diffRecord {
+	opts := aonui.ReorderOptions{NonPressureLayers: true}
+	seen := make(map[diffKey]bool)
+
+	records := []diffRecord{}
+	for _, tw := range aonui.ToTawhirisWith(inv, opts) {
+		if !tw.IsValid {
+			continue
+		}
+		for _, param := range tw.Item.Parameters {
+			key := diffKey{tw.ForecastHour, param, tw.Item.LayerName}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			r := diffRecord{Key: key, Extent: tw.Item.Extent}
+			if tw.LayerType == aonui.PressureLayer {
+				r.Pressure = tw.Pressure
+			}
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// diffInventories returns the differences between the records of two files,
+// a and b.
+func diffInventories(a, b []diffRecord) []recordDiff {
+	newDiff := func(status string, r diffRecord) recordDiff {
+		return recordDiff{
+			Status: status, ForecastHour: r.Key.ForecastHour,
+			Parameter: r.Key.Parameter, LayerName: r.Key.LayerName,
+			Pressure: r.Pressure,
+		}
+	}
+
+	inB := make(map[diffKey]diffRecord)
+	for _, r := range b {
+		inB[r.Key] = r
+	}
+
+	diffs := []recordDiff{}
+	inA := make(map[diffKey]bool)
+	for _, r := range a {
+		inA[r.Key] = true
+
+		rB, ok := inB[r.Key]
+		if !ok {
+			d := newDiff("onlyA", r)
+			d.ExtentA = r.Extent
+			diffs = append(diffs, d)
+		} else if rB.Extent != r.Extent {
+			d := newDiff("extent", r)
+			d.ExtentA, d.ExtentB = r.Extent, rB.Extent
+			diffs = append(diffs, d)
+		}
+	}
+
+	for _, r := range b {
+		if !inA[r.Key] {
+			d := newDiff("onlyB", r)
+			d.ExtentB = r.Extent
+			diffs = append(diffs, d)
+		}
+	}
+
+	return diffs
+}
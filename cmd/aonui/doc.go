@@ -12,16 +12,25 @@ Usage:
 The commands are:
 
     sync        fetch wind data from the GFS
+    heights     fetch geopotential height data from the GFS
     extract     extract binary data from a GRIB2 message into Tawhiri order
     info        print information on GRIB2 files
+    grid        print the grid geometry of a GRIB2 file
     inv         filter and sort GRIB2 inventories into Tawhiri order
+    vars        list the parameters and layers in a GRIB2 file
+    verify      check a GRIB2 file has every expected record
     reorder     re-order a GRIB2 file into Tawhiri order
+    cat         merge GRIB2 files into one file in Tawhiri order
+    valuediff   compare data values of a record in two GRIB2 files
+    diff        compare the records in two GRIB2 files
+    catalog     rebuild the catalog of GRIB2 files in a directory
 
 Use "aonui help [command]" for more information about a command.
 
 Additional help topics:
 
     tawhiri     the Tawhiri data ordering
+    gribtools   external tools used to process GRIB2 files
 
 Use "aonui help [topic]" for more information about that topic.
 
@@ -42,26 +51,86 @@ Setting base directory
 The -basedir flag specifies the directory data should be downloaded to. If
 omitted, the current working directory is used.
 
+Selecting the data source
+
+The -source flag selects which data source to download from by name. The
+default, "gfs-0p50", is the 0.5 degree GFS data. Other sources include
+"gfs-0p25" and "gfs-1p00" for the 0.25 and 1 degree GFS data and "gefs-c00",
+"gefs-p01", etc. for the control and perturbed members of the Global Ensemble
+Forecast System (GEFS). The "hrrr" source is the hourly High-Resolution Rapid
+Refresh over the contiguous United States. The "gfs-0p50-s3" source is the 0.5
+degree GFS data as mirrored in the NOAA Open Data S3 bucket which can be more
+reliable than the NOAA servers. Specifying an unknown source will print a list
+of all known sources.
+
 Downloading high reolsution data
 
-If the -highres flag is present, 0.25 degree data will be downloaded. If
-omitted, the 0.5 degree data is downloaded.
+The -highres flag is an alias for "-source gfs-0p25".
 
 Specifying the oldest run to sync
 
 The -maxruns flag controls how far into the past sync will look for data before
 stopping. The default value of 3 means examine the 3 newest runs on the server
-starting with the newest. If any run is a) incomplete on the server or b)
-already downloaded proceed to the next until the list of runs is exhausted.
+starting with the newest. Runs newer than the newest complete run are passed
+over. If any run is a) incomplete on the server or b) already downloaded
+proceed to the next until the list of runs is exhausted. If none of the runs
+are complete, sync exits with a non-zero status.
 
 The utility attempts to be robust in the face of flaky network connections or a
 flaky server by re-trying failed downloads.
 
+Catching up on missed runs
+
+Usually sync stops once it has downloaded a single run. If the -since flag is
+given an RFC3339 time, such as "2015-01-02T00:00:00Z", sync instead tries to
+download every run on the server which is newer than that time, oldest last.
+The -maxruns flag is ignored. The runs are first checked for completeness with
+up to -concurrency runs checked at once and incomplete runs are skipped. Runs
+which have already been downloaded are skipped. Once all runs have been tried,
+sync logs how many were downloaded, failed or already present and exits with a
+non-zero status if any failed.
+
+Setting the number of simultaneous downloads
+
+Datasets within a run are downloaded concurrently. The -concurrency flag sets
+the maximum number of datasets downloaded at once. The default is 5. The
+-concurrency-per-host flag additionally limits the number of datasets
+downloaded at once from any one host so that, when datasets are spread over
+several servers, no single server is overloaded. By default, there is no
+per-host limit.
+
+Giving up when the server is down
+
+Each dataset is retried several times before sync gives up on it. So that an
+outage of the server does not mean waiting for every dataset to exhaust its
+retries, the rest of a run is abandoned once -max-failures datasets in a row
+have failed every try. The default is 10. A value of 0 never abandons a run
+early.
+
+Limiting bandwidth
+
+The -ratelimit flag caps the total rate at which records are downloaded, in
+bytes per second, across all simultaneous downloads. Note that limiting the
+rate makes each download take longer and so may cause the data source's fetch
+timeout to be reached.
+
 Specifing which parameters to download
 
 By default, aonui sync will download the HGT, UGRD and VGRD parameters from the
 dataset. Use the -params flag to specify an alternate set. The set of
-parameters to download should be a comma-separated lists.
+parameters to download should be a comma-separated lists. At least one
+parameter must be given.
+
+The GFS splits its parameters between primary ("pgrb2") and secondary
+("pgrb2b") files for each forecast hour. By default, only the primary files are
+downloaded. If the -secondary flag is present, records are also downloaded from
+the secondary files. Records in a secondary file with the same parameter,
+layer and forecast type as a record in the corresponding primary file are
+skipped so that the output does not contain duplicates.
+
+By default, only records on isobaric layers (i.e. those whose layer is of the
+form "XXX mb") are downloaded. If the -alllayers flag is present, records on
+all layers, such as the surface or a height above ground, are downloaded.
 
 Specifying filename for download
 
@@ -71,15 +140,240 @@ zeros.
 
 The -prefix flag sets an additional prefix to add to the front of this name.
 
+The -output flag overrides this name with a Go text/template expanded for each
+run. The template is executed with the run as its data so, for example,
+{{.Identifier}} is the run's identifier and {{.When.Year}} and {{.When.Hour}}
+are the year and hour of the run. Use the printf function for leading zeros:
+
+	-output '{{.When.Year}}/{{printf "%02d" .When.Month}}/{{.Identifier}}.grib2'
+
+Relative names are taken relative to the base directory. Any parent directories
+are created as needed. The -prefix flag is ignored if -output is given.
+
+Resuming partial downloads
+
+While a run is being downloaded, a manifest recording which datasets have been
+written is kept alongside the output in a file with a .partial extension. If
+sync is interrupted or some datasets fail to download, the output and manifest
+are left in place. The next invocation of sync will resume the download,
+fetching only those datasets not yet written. The manifest is removed once
+every dataset has been downloaded.
+
+Checksums
+
+Once a run has been downloaded, the SHA256 digest of the output is written to
+a file alongside it with a .sha256 extension in the format used by sha256sum.
+
+The servers do not publish checksums, and certainly not for the subset of
+records downloaded, and so the data cannot be checked against the server's
+copy. Instead, the number of bytes fetched from each dataset is checked against
+the sizes of its records given by the inventory and a fetch which falls short
+is retried. The length and digest of each dataset are recorded as it is written
+to the output. If the -verify-checksum flag is present, the output is re-read
+once complete and each dataset checked against its recorded digest and against
+the length expected from its inventory. If any do not match, the output is
+removed and the run treated as failed.
+
+Checking for missing forecast hours
+
+Sync logs any forecast hours which are missing from the middle of a run's
+sequence of forecast hours. If the -checkhours flag is present, such a run is
+treated as incomplete and is not downloaded.
+
+Limiting the size of output
+
+The -maxbytes flag caps the size in bytes of the output for each run. A run
+whose records would total more than the cap is not downloaded. If, while
+downloading, writing a dataset would take the output over the cap, writing
+stops, the output is removed and the run treated as failed. The number of
+bytes written and expected are logged. When compressing, the cap applies to
+the uncompressed size.
+
+Compressing output
+
+If the -compress flag is given, output files are compressed as they are
+written with the given method, either "gzip" or "zstd", and have the suffix
+.gz or .zst respectively appended to their names. The -gzip flag is an alias
+for "-compress gzip". Gzip compression is built in while zstd compression
+requires the zstd command to be installed. Partial downloads of compressed
+output cannot be resumed and -compress cannot be used with -pipe or
+-verify-checksum.
+
+Records in GRIB2 files are already packed so compression gains little. Expect
+the output to shrink by roughly 5-15% depending on the parameters downloaded.
+Zstd is generally considerably faster than gzip for a similar ratio.
+
+Streaming data to another command
+
+If the -pipe flag is given, the downloaded run is written to the standard input
+of the specified command instead of to a file. The command is run via "sh -c".
+If the command exits with a non-zero status, sync exits with the same status.
+Runs for which the output file already exists in the base directory are still
+skipped.
+
+Caching inventories
+
+Before downloading records from a dataset, sync fetches the dataset's inventory.
+If the -inventorycache flag specifies a directory, inventories are stored there
+and re-used by later invocations of sync as long as the dataset on the server
+has not changed length. This saves re-fetching inventories when, for example,
+sync is re-run with a different set of parameters.
+
+Remembering the newest run
+
+When sync is run frequently, for example from cron, most invocations find that
+the newest run has already been downloaded. If the -state flag names a file,
+relative to the base directory, the identifier of the newest run successfully
+downloaded is recorded in it. If the newest run on the server matches the
+recorded run, sync exits successfully straight away without fetching any
+datasets. Similarly, if the newest complete run matches the recorded run, sync
+exits successfully without downloading anything. The file is created if it
+does not exist.
+
+Cataloguing downloaded runs
+
+If the -catalog flag is present, each run successfully downloaded to a file is
+recorded in a catalog named catalog.json in the base directory. The catalog
+lists the identifier, time, source, filename, size, parameters and forecast
+hours of each run. It is replaced atomically after each run. Use "aonui
+catalog" to rebuild the catalog from the files in a directory.
+
+Stopping gracefully
+
+If sync receives a SIGTERM signal, for example from a service manager, it
+stops starting new downloads but lets those in progress finish and be written
+to the output before exiting. The output is left in place to be resumed by a
+later invocation. A second signal, or an interrupt from the keyboard, exits
+immediately.
+
+Download progress
+
+Before downloading any data, sync fetches the inventory of each dataset in the
+run and logs the total size of the records to be fetched. As each dataset is
+written to the output, the overall progress is logged as a percentage of this
+total.
+
+Recording download timings
+
+Once a run has been fetched, the time taken to download each dataset is
+logged. If the -timings flag is given, these timings are also written in CSV
+format to the specified file. The CSV has the columns identifier,
+forecastHour, start, durationSeconds, bytes, tries and succeeded.
+
+Machine-readable events
+
+If the -events flag is present, sync writes one JSON object per line to
+standard error for each of the following events in addition to its usual log
+output:
+
+	run_selected     a run is about to be downloaded
+	dataset_started  download of a dataset has started
+	dataset_done     a dataset was downloaded
+	dataset_failed   a dataset could not be downloaded
+	run_done         download of a run has finished
+
+Each object has an "event" field naming the event and a "time" field. Run
+events have a "run" field giving the run's identifier and dataset events
+"dataset" and "forecastHour" fields. The dataset_done event also has "bytes"
+and "durationSeconds" fields. The dataset_failed event and unsuccessful
+run_done events have an "error" field. The run_selected event has an "output"
+field giving the output filename and the run_done event a "succeeded" field.
+
+
+Fetch geopotential height data from the GFS
+
+Usage:
+
+        aonui heights [flags]
+
+Heights will fetch only the geopotential height (HGT) records at each pressure
+and forecast hour of a GFS run and write them in Tawhiri order to a GRIB2 file.
+This is a fraction of the size of the full wind download and is sufficient for
+looking up the altitude of a given pressure level.
+
+The resulting file is named gfs.YYYYMMDDHH.hgt.grib2 where YYYY, MM, DD and HH
+are the year, month, day and hour of the run.
+
+The -basedir, -source, -highres and -maxruns flags behave as for "aonui sync".
+The -run flag may be used to specify the identifier of a particular run to
+download, for example "gfs.2014102106". If omitted, the newest complete run is
+downloaded.
+
+See also: aonui help sync
+
 
 Extract binary data from a GRIB2 message into Tawhiri order
 
 Usage:
 
-        aonui extract <ingrib> <outbin>
+        aonui extract [-splithours] [-batch [-jobs n]] [-keep] [-format fmt] [-byteorder order] [-bbox box] [-meta] <ingrib> <outbin>
 
 Extract will parse a GRIB2 message in the file ingrib and write a raw binary
-dump of native-endian floating point values to outbin in Tawhiri order.
+dump of 32-bit floating point values to outbin in Tawhiri order.
+
+Byte order
+
+By default, values are written in the native byte order of the host. The
+-byteorder flag may be "little" or "big" to force a particular byte order so
+that the output can be read on hosts with a different native byte order. The
+byte order used is recorded in the description written by -meta or
+-splithours.
+
+Describing the output
+
+If the -meta flag is present, a JSON file named outbin.json is written
+alongside outbin describing the grid, pressures, parameters, forecast hours and
+run time of the records extracted. It has the same form as the output of
+"aonui info -json". The description is computed from the same records which
+are extracted and so is guaranteed to match outbin. The -meta flag has no
+effect with NetCDF output, which is self-describing, or with -splithours,
+which always writes a description.
+
+Extracting a region
+
+The -bbox flag restricts the output to the grid points within a bounding box
+given as "latmin,latmax,lonmin,lonmax" in degrees with longitudes in degrees
+East, for example "35,60,0,40". Records are first cropped into a temporary
+GRIB2 file using the -small_grid option of wgrib2 which is then extracted in
+place of ingrib. The width, height and South-West grid point in the
+description written by -meta or -splithours are those of the cropped grid.
+The -bbox flag requires wgrib2 and only works with latitude-longitude grids.
+
+Output formats
+
+The -format flag selects the format of outbin. The default, "binary", is the
+raw dump of values described above. The "netcdf" format is a NetCDF file
+written by wgrib2 which includes the coordinates of each grid point and so can
+be used without further metadata. The netcdf format requires wgrib2 and cannot
+be used with -splithours. With -batch, NetCDF output files have a .nc
+extension.
+
+Splitting output by forecast hour
+
+If the -splithours flag is present, each forecast hour is written to a separate
+file named outbin.fNNN.bin where NNN is the zero-padded forecast hour. Each
+file contains the records for that forecast hour in Tawhiri order. A JSON file
+named outbin.json is also written describing the grid, pressures and
+parameters shared by each file along with the list of forecast hours. It has
+the same form as the output of "aonui info -json".
+
+Extracting many files
+
+If the -batch flag is present, ingrib and outbin are interpreted as
+directories. Each file in ingrib with a .grib2 or .grb2 extension is extracted
+to a file in outbin with the same name but a .bin extension. Files are
+extracted concurrently. The -jobs flag sets the maximum number of files
+extracted at once and defaults to the number of CPUs. A summary of which files
+succeeded and which failed is logged once all files have been processed.
+
+Keeping the re-ordered GRIB
+
+Usually records are passed to the GRIB tool in Tawhiri order directly and no
+re-ordered GRIB2 file is written. If the -keep flag is present, a re-ordered
+GRIB2 file is written to the system temporary directory and extracted from
+instead. The file is not removed afterwards and its path is logged so that
+exactly what was extracted can be inspected. The flag has no effect with
+-splithours or with NetCDF output.
 
 See also: aonui help tawhiri
 
@@ -102,17 +396,31 @@ form:
 	PRESSURES=1000,975,950,925,900,875,850,... # etc
 	FCSTHOURS=0,3,6,9,12,15,18,21,24,27,30,... # etc
 	RUNTIME=2014102106
+	LAT0=-90
+	LON0=0
+	DLAT=0.5
+	DLON=0.5
 
 NX, NY, NPARAM, NPRESSURE and NFCSTHOUR give the sizes of each dimension of the
 data. PRESSURES and FCSTHOURS are comma-separated integers giving the
 particular pressures and forecast hours which correspondt to each point along
 the respective axes. The RUNTIME is the date and time the forecast was run on
-formatted as YYYYMMDDHH.
+formatted as YYYYMMDDHH. LAT0 and LON0 give the latitude and longitude in
+degrees of the South-West grid point and DLAT and DLON the spacing in degrees
+between rows and columns of the grid. They are omitted if the data is not on a
+regular latitude-longitude grid, e.g. the Lambert Conformal grid of the HRRR.
 
 Note that this command may take some time to complete the first time it is run
 on a file since collating the pressures and forecast hours requires scanning
 through the entire GRIB2 message.
 
+Caching information
+
+The collated information is cached in a file next to gribfile with the suffix
+.aonui-info.json appended. Subsequent invocations use the cached information if
+the size and modification time of gribfile have not changed. The -nocache flag
+forces the information to be recomputed and the cache to be rewritten.
+
 JSON formatted output
 
 If the -json flag is specified, information is written to standard output in
@@ -124,15 +432,73 @@ JSON format. The output looks similar to:
 	  "parameters": [ "HGT", "UGRD", "VGRD" ],
 	  "pressures": [ 875, 825, <etc> ],
 	  "forecastHours": [ 0, 3, <etc> ],
-	  "runTime": "2014-11-10T12:00:00Z"
+	  "runTime": "2014-11-10T12:00:00Z",
+	  "lat0": -90,
+	  "lon0": 0,
+	  "dLat": 0.5,
+	  "dLon": 0.5
 	}
 
 
+Print the grid geometry of a GRIB2 file
+
+Usage:
+
+        aonui grid [-json] gribfile
+
+Grid prints a complete description of the grid of the first record in the GRIB2
+file gribfile to standard output. Unlike "aonui info", which gives only the
+shape of the data, the projection, extent, spacing and scanning order of the
+grid are included. Output for a latitude-longitude grid has the following
+form:
+
+	TEMPLATE=0
+	PROJECTION=latlon
+	NX=720
+	NY=361
+	INPUTSCAN=WE:NS
+	OUTPUTSCAN=WE:SN
+	GLOBAL=true
+	LAT1=90
+	LAT2=-90
+	LON1=0
+	LON2=359.5
+	DLAT=0.5
+	DLON=0.5
+
+TEMPLATE is the GRIB2 grid definition template number and PROJECTION one of
+latlon, gaussian or lambert. Grids of other projections are given wgrib2's
+description of the projection and only the fields up to GLOBAL are printed.
+INPUTSCAN and OUTPUTSCAN give the order in which points are stored in the
+record and the order in which they are extracted. GLOBAL is true if the grid
+wraps around the globe in longitude.
+
+For latitude-longitude and Gaussian grids, LAT1 and LAT2 are the latitudes of
+the first and last rows and LON1 and LON2 the longitudes of the first and last
+columns. DLAT and DLON are the spacing between rows and columns. Rows of a
+Gaussian grid are not evenly spaced so DLAT is omitted and NGAUSSIAN gives the
+number of rows between a pole and the equator instead.
+
+For Lambert Conformal grids, LAT1 and LON1 are the position of the first grid
+point, LOV the longitude parallel to the y-axis, LATD the latitude at which the
+spacing DX and DY in metres is specified, LATIN1 and LATIN2 the latitudes at
+which the cone cuts the sphere, LATSP and LONSP the southern pole of projection
+and POLE either north or south.
+
+All angles are in degrees. This command always uses wgrib2 whatever the value
+of AONUI_GRIB_BACKEND. (See "aonui help gribtools".)
+
+If the -json flag is specified, the information is written in JSON format
+instead.
+
+See also: aonui help info
+
+
 Filter and sort GRIB2 inventories into Tawhiri order
 
 Usage:
 
-        aonui inv [-nosort] [-nofilter] gribfile
+        aonui inv [-nosort] [-nofilter] [-minfh hour] [-maxfh hour] [-format fmt] gribfile
 
 Inv dumps and optionally filters and sorts a GRIB2's inventory into the order
 Tawhiri expects. (See "aonui help tawhiri" for details on this ordering.)
@@ -152,28 +518,247 @@ Inv will remove inventory items not used by Tawhiri. This behaviour can be
 disabled via the -nofilter flag. In this case non-Tawhiri inventory
 items will be sorted after Tawhiri ones.
 
+The -minfh and -maxfh flags restrict output to Tawhiri items whose forecast
+hour lies within the given range, inclusive. By default, there is no
+restriction.
+
 With -nosort and -nofilter both enabled, inv should generate an inventory
 identical to that produced by "wgrib2 -s".
 
+The -format flag selects the output format. The default, "wgrib2", outputs an
+inventory in wgrib2 "short" format. If the format is "csv", one CSV row is
+output per record with a header row naming the columns record, offset, extent,
+when, parameters, layer, type, forecastHour and pressure. Multiple parameters
+are separated by semicolons. The forecastHour and pressure columns are empty
+for records not used by Tawhiri.
+
 See also: aonui help tawhiri
 
 
+List the parameters and layers in a GRIB2 file
+
+Usage:
+
+        aonui vars [-json] gribfile
+
+Vars lists each distinct combination of parameter, layer and type found in the
+inventory of the GRIB2 file gribfile along with the number of records it
+appears in. Unlike "aonui inv" and "aonui info", no records are filtered out
+and no assumptions are made about Tawhiri's conventions so vars can be used to
+discover what a file contains. Output has the following form:
+
+	PARAM  LAYER              TYPE         COUNT
+	HGT    1000 mb            anl          1
+	HGT    1000 mb            3 hour fcst  1
+	UGRD   10 m above ground  anl          1
+
+The output is sorted by parameter, layer and type. A record with more than one
+parameter counts towards each of them.
+
+If the -json flag is specified, a JSON array with one object per combination
+is written instead. Each object has the keys parameter, layer, type and count.
+
+See also: aonui help inv
+
+
+Check a GRIB2 file has every expected record
+
+Usage:
+
+        aonui verify [flags] gribfile
+
+Verify checks that the GRIB2 file gribfile contains a record for every
+combination of forecast hour, pressure and parameter expected. Each missing
+combination is printed to standard output in the following form:
+
+	MISSING FCSTHOUR=27 PRESSURE=500 PARAM=UGRD
+
+If any records are missing, verify exits with a non-zero status.
+
+The expected forecast hours are those from -minhour to -maxhour inclusive in
+steps of -step. The defaults of 0, 192 and 3 match the hours downloaded by
+"aonui sync" from the 0.5 degree GFS. If the -source flag names a data source,
+such as "gfs-0p25", the forecast hours published by that source are expected
+instead and -minhour, -maxhour and -step are ignored. This allows for sources
+whose forecast hours are not evenly spaced. (See "aonui help sync" for the
+names of data sources.) The -pressures flag gives a
+comma-separated list of expected pressures in mb. It defaults to the isobaric
+levels published by the -source or, if no source is given or the source's
+levels are unknown, those of the 0.5 degree GFS. Pressures with no records at
+all are also logged. The -params flag gives a comma-separated list of expected
+parameters and defaults to HGT, UGRD and VGRD.
+
+Only records used by Tawhiri are considered. (See "aonui help tawhiri".)
+
+See also: aonui help info
+
+
 Re-order a GRIB2 file into Tawhiri order
 
 Usage:
 
-        aonui reorder ingribfile outgribfile
+        aonui reorder [-keepunused] [-dedup] [-verify] [-scan] [-jobs n] ingribfile outgribfile
 
 Reorder will take an existing GRIB2 file on disk and write out a new GRIB2 file
 with the records re-ordered into the order Tawhiri expects. (See "aonui help
 tawhiri" for details on this ordering.)
 
 Input is read from ingribfile and written to outgribfile. Records not used by
-Tawhiri will not be written to the output.
+Tawhiri will not be written to the output unless the -keepunused flag is
+present. In that case they are written after the Tawhiri records in the order
+they appear in ingribfile.
+
+If the -dedup flag is present, only the first of several records with the same
+forecast hour, pressure and parameter is written. Such duplicates appear, for
+example, when the primary and secondary GFS files overlap and would otherwise
+give Tawhiri two copies of the same data.
+
+Records are usually copied one at a time. The -jobs flag sets the number of
+records copied at once, each read via a separate handle on ingribfile. Values
+greater than one can make re-ordering faster on solid state disks.
+
+If the -verify flag is present, outgribfile is checked once written to make sure
+it is made up of complete GRIB2 messages, one for each record written.
+
+The inventory of ingribfile is usually found with wgrib2. If the -scan flag is
+present, the messages of ingribfile are decoded directly instead and wgrib2 is
+not needed. Only the common parameters, such as HGT, UGRD and VGRD, on
+isobaric, height above ground and surface layers are recognised in this way.
 
 See also: aonui help tawhiri
 
 
+Merge GRIB2 files into one file in Tawhiri order
+
+Usage:
+
+        aonui cat [-keepunused] [-dedup] [-verify] ingribfile... outgribfile
+
+Cat will take one or more existing GRIB2 files on disk and write out a single
+new GRIB2 file containing the records of all of them re-ordered into the order
+Tawhiri expects. (See "aonui help tawhiri" for details on this ordering.) It
+is useful for combining separately downloaded forecast hours into one file.
+
+Input is read from each ingribfile and written to outgribfile. Records not
+used by Tawhiri will not be written to the output unless the -keepunused flag
+is present. In that case they are written after the Tawhiri records in the
+order they appear in the input files.
+
+If the -dedup flag is present, only the first of several records with the same
+forecast hour, pressure and parameter is written. Records from earlier input
+files take precedence.
+
+If the -verify flag is present, outgribfile is checked once written to make sure
+it is made up of complete GRIB2 messages, one for each record written.
+
+See also: aonui help reorder, aonui help tawhiri
+
+
+Compare data values of a record in two GRIB2 files
+
+Usage:
+
+        aonui valuediff [flags] gribfileA gribfileB
+
+Valuediff extracts a single record from each of gribfileA and gribfileB and
+prints statistics on the difference between them. The difference is computed
+as B - A at each grid point. This is useful for quantifying how much one run
+of the GFS changed relative to another.
+
+The record is selected by parameter, pressure and forecast hour via the -param,
+-pressure and -fcsthour flags. The defaults select UGRD at 500 mb for forecast
+hour 0. Output has the following form:
+
+	MEAN=0.1234
+	RMS=2.3456
+	MIN=-12.5
+	MAX=14.25
+	MAXABSDIFF=14.25
+	MAXABSDIFFX=312
+	MAXABSDIFFY=201
+
+MAXABSDIFFX and MAXABSDIFFY give the column and row of the grid point with the
+largest absolute difference. Columns are numbered West-to-East and rows
+South-to-North starting from zero.
+
+Both files must have the same grid shape.
+
+
+Compare the records in two GRIB2 files
+
+Usage:
+
+        aonui diff [-json] gribfileA gribfileB
+
+Diff compares the inventories of the GRIB2 files gribfileA and gribfileB and
+reports records present in one file but not the other along with records whose
+extent in bytes differs. This is useful for checking that "aonui reorder" or
+"aonui extract" did not drop any data. Each difference is printed to standard
+output in one of the following forms:
+
+	ONLYA FCSTHOUR=3 PARAM=UGRD LAYER="500 mb"
+	ONLYB FCSTHOUR=6 PARAM=HGT LAYER="2 m above ground"
+	EXTENT FCSTHOUR=0 PARAM=VGRD LAYER="850 mb" A=123456 B=123789
+
+Records are matched by forecast hour, parameter and layer. A record with more
+than one parameter is compared once for each of them. Only records on pressure,
+height above ground and surface layers whose forecast hour can be parsed are
+compared. (See "aonui help tawhiri".) If a file has several records for the
+same forecast hour, parameter and layer, only the first is compared. Records
+in gribfileA are reported first, in the order they appear in the file,
+followed by those only in gribfileB.
+
+If the -json flag is specified, a JSON array with one object per difference is
+written instead. Each object has the keys status ("onlyA", "onlyB" or
+"extent"), forecastHour, parameter and layer along with pressure for records
+on pressure layers and extentA and extentB for the records which are present.
+
+If any differences are found, diff exits with a non-zero status. Only the
+inventories are compared. Use "aonui valuediff" to compare the data values of
+a record.
+
+See also: aonui help inv, aonui help valuediff
+
+
+Rebuild the catalog of GRIB2 files in a directory
+
+Usage:
+
+        aonui catalog [dir]
+
+Catalog scans dir, or the current directory if dir is omitted, and its
+sub-directories for GRIB2 files with a .grib2 extension and writes a catalog
+describing them to catalog.json in dir. If a catalog already exists it is
+replaced. Files with a .partial manifest alongside them are partial downloads
+by "aonui sync" which have yet to be resumed and are skipped.
+
+The catalog is a JSON object whose "runs" field is a list with one entry for
+each file, newest run first. For example:
+
+	{
+	  "runs": [
+	    {
+	      "identifier": "gfs.2014111012",
+	      "when": "2014-11-10T12:00:00Z",
+	      "source": "gfs-0p50",
+	      "filename": "gfs.2014111012.grib2",
+	      "size": 1234567890,
+	      "parameters": [ "HGT", "UGRD", "VGRD" ],
+	      "forecastHours": [ 0, 3, <etc> ]
+	    }
+	  ]
+	}
+
+Filenames are relative to dir. The parameters and forecast hours are collated
+in the same way as "aonui info" and so a GRIB tool must be installed. The
+identifier and source of a file are taken from any existing catalog entry for
+it. Otherwise the identifier is the filename without its extension and the
+source is omitted.
+
+Sync can keep a catalog up to date as runs are downloaded. See the -catalog
+flag of "aonui help sync".
+
+
 The Tawhiri data ordering
 
 The Tawhiri predictor treats the wind data as a large five-dimensional array of
@@ -189,5 +774,19 @@ numerical order. (This is so that the first pressure corresponds to the lowest
 geo-potential height.) Forecast hours are in increasing numerical order.
 
 
+External tools used to process GRIB2 files
+
+Aonui does not decode GRIB2 files itself. Instead it uses an external tool to
+parse inventories, determine grid shapes and extract data. Two tools are
+supported: wgrib2 and the grib_get and grib_get_data tools from ecCodes.
+
+By default wgrib2 is used. If the AONUI_GRIB_BACKEND environment variable is
+set to "eccodes", the ecCodes tools are used instead. In either case, the tools
+must be on the system path.
+
+The ecCodes backend converts parameter and layer names into the form used by
+wgrib2 so that inventories look the same irrespective of the tool used.
+
+
 */
 package main
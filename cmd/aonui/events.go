@@ -0,0 +1,40 @@
+package main
+
+// Machine-readable lifecycle events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// An eventLog writes lifecycle events as JSON objects, one per line. A nil
+// *eventLog discards all events.
+type eventLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// newEventLog returns an eventLog writing to w.
+func newEventLog(w io.Writer) *eventLog {
+	return &eventLog{enc: json.NewEncoder(w)}
+}
+
+// Emit writes an event named name with the given additional fields. The
+// "event" and "time" fields are set automatically. It is safe to call from
+// multiple goroutines.
+func (el *eventLog) Emit(name string, fields map[string]interface{}) {
+	if el == nil {
+		return
+	}
+
+	ev := map[string]interface{}{"event": name, "time": time.Now().UTC()}
+	for k, v := range fields {
+		ev[k] = v
+	}
+
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	el.enc.Encode(ev)
+}
@@ -1,24 +1,132 @@
 package main
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/rjw57/aonui"
 )
 
 var cmdExtract = &Command{
 	Run:       runExtract,
-	UsageLine: "extract <ingrib> <outbin>",
+	UsageLine: "extract [-splithours] [-batch [-jobs n]] [-keep] [-format fmt] [-byteorder order] [-bbox box] [-meta] <ingrib> <outbin>",
 	Short:     "extract binary data from a GRIB2 message into Tawhiri order",
 	Long: `
 Extract will parse a GRIB2 message in the file ingrib and write a raw binary
-dump of native-endian floating point values to outbin in Tawhiri order.
+dump of 32-bit floating point values to outbin in Tawhiri order.
+
+Byte order
+
+By default, values are written in the native byte order of the host. The
+-byteorder flag may be "little" or "big" to force a particular byte order so
+that the output can be read on hosts with a different native byte order. The
+byte order used is recorded in the description written by -meta or
+-splithours.
+
+Describing the output
+
+If the -meta flag is present, a JSON file named outbin.json is written
+alongside outbin describing the grid, pressures, parameters, forecast hours and
+run time of the records extracted. It has the same form as the output of
+"aonui info -json". The description is computed from the same records which
+are extracted and so is guaranteed to match outbin. The -meta flag has no
+effect with NetCDF output, which is self-describing, or with -splithours,
+which always writes a description.
+
+Extracting a region
+
+The -bbox flag restricts the output to the grid points within a bounding box
+given as "latmin,latmax,lonmin,lonmax" in degrees with longitudes in degrees
+East, for example "35,60,0,40". Records are first cropped into a temporary
+GRIB2 file using the -small_grid option of wgrib2 which is then extracted in
+place of ingrib. The width, height and South-West grid point in the
+description written by -meta or -splithours are those of the cropped grid.
+The -bbox flag requires wgrib2 and only works with latitude-longitude grids.
+
+Output formats
+
+The -format flag selects the format of outbin. The default, "binary", is the
+raw dump of values described above. The "netcdf" format is a NetCDF file
+written by wgrib2 which includes the coordinates of each grid point and so can
+be used without further metadata. The netcdf format requires wgrib2 and cannot
+be used with -splithours. With -batch, NetCDF output files have a .nc
+extension.
+
+Splitting output by forecast hour
+
+If the -splithours flag is present, each forecast hour is written to a separate
+file named outbin.fNNN.bin where NNN is the zero-padded forecast hour. Each
+file contains the records for that forecast hour in Tawhiri order. A JSON file
+named outbin.json is also written describing the grid, pressures and
+parameters shared by each file along with the list of forecast hours. It has
+the same form as the output of "aonui info -json".
+
+Extracting many files
+
+If the -batch flag is present, ingrib and outbin are interpreted as
+directories. Each file in ingrib with a .grib2 or .grb2 extension is extracted
+to a file in outbin with the same name but a .bin extension. Files are
+extracted concurrently. The -jobs flag sets the maximum number of files
+extracted at once and defaults to the number of CPUs. A summary of which files
+succeeded and which failed is logged once all files have been processed.
+
+Keeping the re-ordered GRIB
+
+Usually records are passed to the GRIB tool in Tawhiri order directly and no
+re-ordered GRIB2 file is written. If the -keep flag is present, a re-ordered
+GRIB2 file is written to the system temporary directory and extracted from
+instead. The file is not removed afterwards and its path is logged so that
+exactly what was extracted can be inspected. The flag has no effect with
+-splithours or with NetCDF output.
 
 See also: aonui help tawhiri
 `,
 }
 
+// Command-line flags
+var (
+	extractSplitHours bool
+	extractBatch      bool
+	extractJobs       int
+	extractKeep       bool
+	extractFormat     string
+	extractMeta       bool
+	extractByteOrder  string
+	extractBBox       string
+)
+
+// Bounding box parsed from extractBBox (or nil if the output is not cropped)
+var extractCrop *aonui.BoundingBox
+
+func init() {
+	cmdExtract.Flag.BoolVar(&extractSplitHours, "splithours", false,
+		"write each forecast hour to a separate file")
+	cmdExtract.Flag.BoolVar(&extractBatch, "batch", false,
+		"extract all GRIB2 files in one directory to another")
+	cmdExtract.Flag.IntVar(&extractJobs, "jobs", runtime.NumCPU(),
+		"maximum number of simultaneous extractions in batch mode")
+	cmdExtract.Flag.BoolVar(&extractKeep, "keep", false,
+		"keep the intermediate re-ordered GRIB2 file")
+	cmdExtract.Flag.StringVar(&extractFormat, "format", "binary",
+		"output format: binary or netcdf")
+	cmdExtract.Flag.BoolVar(&extractMeta, "meta", false,
+		"write a JSON file describing the binary output")
+	cmdExtract.Flag.StringVar(&extractByteOrder, "byteorder", "native",
+		"byte order of binary output: native, little or big")
+	cmdExtract.Flag.StringVar(&extractBBox, "bbox", "",
+		"crop output to latmin,latmax,lonmin,lonmax")
+}
+
 func runExtract(cmd *Command, args []string) {
 	if len(args) != 2 {
 		log.Print("usage: aonui extract <ingrib> <outbin>")
@@ -30,18 +138,220 @@ func runExtract(cmd *Command, args []string) {
 	sourceFn := args[0]
 	destFn := args[1]
 
+	// Make sure we can process GRIBs before doing any work
+	if err := aonui.GribBackend.Check(); err != nil {
+		log.Print("error: ", err)
+		setExitStatus(1)
+		return
+	}
+
+	switch extractFormat {
+	case "binary":
+	case "netcdf":
+		if _, ok := aonui.GribBackend.(aonui.Wgrib2Tool); !ok {
+			log.Print("error: netcdf output requires wgrib2")
+			setExitStatus(1)
+			return
+		}
+		if extractSplitHours {
+			log.Print("error: netcdf output cannot be used with -splithours")
+			setExitStatus(1)
+			return
+		}
+	default:
+		log.Print("error: unknown output format: ", extractFormat)
+		setExitStatus(2)
+		return
+	}
+
+	switch extractByteOrder {
+	case "native":
+		aonui.ExtractByteOrder = binary.NativeEndian
+	case "little":
+		aonui.ExtractByteOrder = binary.LittleEndian
+	case "big":
+		aonui.ExtractByteOrder = binary.BigEndian
+	default:
+		log.Print("error: unknown byte order: ", extractByteOrder)
+		setExitStatus(2)
+		return
+	}
+
+	if extractBBox != "" {
+		if _, ok := aonui.GribBackend.(aonui.Wgrib2Tool); !ok {
+			log.Print("error: -bbox requires wgrib2")
+			setExitStatus(1)
+			return
+		}
+		bbox, err := parseBoundingBox(extractBBox)
+		if err != nil {
+			log.Print("error: ", err)
+			setExitStatus(2)
+			return
+		}
+		extractCrop = &bbox
+	}
+
+	// Do work
+	if extractBatch {
+		if extractSplitHours {
+			log.Print("error: -batch and -splithours cannot be used together")
+			setExitStatus(1)
+			return
+		}
+		if err := extractDir(sourceFn, destFn, extractJobs); err != nil {
+			log.Print(err)
+			setExitStatus(1)
+		}
+		return
+	}
+
+	if extractSplitHours {
+		if err := extractSplit(sourceFn, destFn); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Do not overwrite existing files
 	if _, err := os.Stat(destFn); err == nil {
 		log.Fatal("not overwriting existing file ", destFn)
 	}
 
-	// Do work
 	if err := extract(sourceFn, destFn); err != nil {
 		log.Fatal(err)
 	}
 }
 
 func extract(sourceFn, destFn string) error {
+	if extractCrop != nil {
+		croppedFn, err := cropGrib(sourceFn, destFn, *extractCrop)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(croppedFn)
+		sourceFn = croppedFn
+	}
+
+	if extractFormat == "netcdf" {
+		return extractNetCDF(sourceFn, destFn)
+	}
+
+	if extractKeep {
+		return extractViaReordered(sourceFn, destFn)
+	}
+
+	// Compute tawhiri-ordered inventory
+	log.Print("Scanning inventory of ", sourceFn)
+	inv, err := aonui.TawhiriOrderedInventory(sourceFn)
+	if err != nil {
+		return err
+	}
+
+	// Describe the output if asked
+	if extractMeta {
+		if err := writeExtractMeta(inv, sourceFn, destFn); err != nil {
+			return err
+		}
+	}
+
+	// Expand GRIB. With wgrib2, records can be streamed in Tawhiri order
+	// without writing an intermediate re-ordered GRIB.
+	log.Print("Expanding to ", destFn)
+	if _, ok := aonui.GribBackend.(aonui.Wgrib2Tool); ok {
+		return aonui.ExtractReorderedInventory(inv, sourceFn, destFn)
+	}
+	if err := aonui.GribBackend.Extract(inv, sourceFn, destFn); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// cropGrib writes the Tawhiri records of sourceFn cropped to bbox in Tawhiri
+// order to a temporary GRIB2 file alongside destFn. The caller should remove
+// the returned file once it has been extracted.
+func cropGrib(sourceFn, destFn string, bbox aonui.BoundingBox) (string, error) {
+	log.Print("Scanning inventory of ", sourceFn)
+	inv, err := aonui.TawhiriOrderedInventory(sourceFn)
+	if err != nil {
+		return "", err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(destFn), "aonui-cropped-*.grib2")
+	if err != nil {
+		return "", err
+	}
+	tmpFn := tmpFile.Name()
+	tmpFile.Close()
+
+	log.Print("Cropping ", sourceFn, " to ", tmpFn)
+	if err := aonui.Wgrib2SmallGrid(inv, sourceFn, tmpFn, bbox); err != nil {
+		os.Remove(tmpFn)
+		return "", err
+	}
+	return tmpFn, nil
+}
+
+// parseBoundingBox parses a bounding box of the form
+// "latmin,latmax,lonmin,lonmax".
+func parseBoundingBox(s string) (aonui.BoundingBox, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 4 {
+		return aonui.BoundingBox{}, fmt.Errorf("bounding box %q must have four comma-separated values", s)
+	}
+
+	values := make([]float64, 4)
+	for idx, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return aonui.BoundingBox{}, fmt.Errorf("invalid bounding box %q: %v", s, err)
+		}
+		values[idx] = v
+	}
+
+	bbox := aonui.BoundingBox{
+		LatMin: values[0], LatMax: values[1],
+		LonMin: values[2], LonMax: values[3],
+	}
+	if bbox.LatMin > bbox.LatMax {
+		return bbox, fmt.Errorf("invalid bounding box %q: latmin is greater than latmax", s)
+	}
+	return bbox, nil
+}
+
+// writeExtractMeta writes a JSON file describing the records in inv from
+// sourceFn as extracted to destFn. The file is named after destFn.
+func writeExtractMeta(inv aonui.Inventory, sourceFn, destFn string) error {
+	if len(inv) == 0 {
+		return errors.New("no Tawhiri records in GRIB")
+	}
+
+	metaFn := destFn + ".json"
+	if _, err := os.Stat(metaFn); err == nil {
+		return fmt.Errorf("not overwriting existing file %v", metaFn)
+	}
+
+	log.Print("Writing metadata to ", metaFn)
+	gi, err := collateGribInfo(inv, sourceFn)
+	if err != nil {
+		return err
+	}
+	gi.ByteOrder = byteOrderName(aonui.ExtractByteOrder)
+	return writeGribInfo(metaFn, gi)
+}
+
+// byteOrderName returns "little" or "big" according to order.
+func byteOrderName(order binary.ByteOrder) string {
+	if order.Uint16([]byte{0, 1}) == 1 {
+		return "big"
+	}
+	return "little"
+}
+
+// extractNetCDF is like extract except that destFn is written in NetCDF
+// format.
+func extractNetCDF(sourceFn, destFn string) error {
 	// Compute tawhiri-ordered inventory
 	log.Print("Scanning inventory of ", sourceFn)
 	inv, err := aonui.TawhiriOrderedInventory(sourceFn)
@@ -49,11 +359,190 @@ func extract(sourceFn, destFn string) error {
 		return err
 	}
 
-	// Expand GRIB
+	log.Print("Writing NetCDF to ", destFn)
+	return aonui.Wgrib2ExtractNetCDF(inv, sourceFn, destFn)
+}
+
+// extractViaReordered is like extract except that sourceFn is first
+// re-ordered into a temporary GRIB2 file which is then extracted. The
+// temporary file is left in place.
+func extractViaReordered(sourceFn, destFn string) error {
+	tmpFile, err := ioutil.TempFile("", "aonui-reordered-*.grib2")
+	if err != nil {
+		return err
+	}
+	tmpFn := tmpFile.Name()
+	tmpFile.Close()
+
+	log.Print("Re-ordering ", sourceFn, " to ", tmpFn)
+	if err := aonui.TawhiriReorderGrib2(sourceFn, tmpFn); err != nil {
+		return err
+	}
+	log.Print("Keeping re-ordered GRIB ", tmpFn)
+
+	// The re-ordered file is already in Tawhiri order
+	inv, err := aonui.GribBackend.Inventory(tmpFn)
+	if err != nil {
+		return err
+	}
+
+	// Describe the output if asked
+	if extractMeta {
+		if err := writeExtractMeta(inv, tmpFn, destFn); err != nil {
+			return err
+		}
+	}
+
 	log.Print("Expanding to ", destFn)
-	if err := aonui.Wgrib2Extract(inv, sourceFn, destFn); err != nil {
+	return aonui.GribBackend.Extract(inv, tmpFn, destFn)
+}
+
+// extractSplit is like extract except that each forecast hour is written to a
+// separate file whose name is derived from destPrefix. A JSON metadata file
+// describing the output is also written.
+func extractSplit(sourceFn, destPrefix string) error {
+	if extractCrop != nil {
+		croppedFn, err := cropGrib(sourceFn, destPrefix, *extractCrop)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(croppedFn)
+		sourceFn = croppedFn
+	}
+
+	// Compute tawhiri-ordered inventory
+	log.Print("Scanning inventory of ", sourceFn)
+	inv, err := aonui.TawhiriOrderedInventory(sourceFn)
+	if err != nil {
+		return err
+	}
+	if len(inv) == 0 {
+		return errors.New("no Tawhiri records in GRIB")
+	}
+
+	// Group inventory by forecast hour. Since the inventory is in Tawhiri
+	// order, records for each forecast hour are contiguous.
+	var (
+		hours    []int
+		hourInvs []aonui.Inventory
+	)
+	for _, tw := range aonui.ToTawhiris(inv) {
+		if len(hours) == 0 || hours[len(hours)-1] != tw.ForecastHour {
+			hours = append(hours, tw.ForecastHour)
+			hourInvs = append(hourInvs, aonui.Inventory{})
+		}
+		hourInvs[len(hourInvs)-1] = append(hourInvs[len(hourInvs)-1], tw.Item)
+	}
+
+	// Form output filenames and check we will not overwrite anything
+	metaFn := destPrefix + ".json"
+	destFns := []string{metaFn}
+	for _, fh := range hours {
+		destFns = append(destFns, fmt.Sprintf("%s.f%03d.bin", destPrefix, fh))
+	}
+	for _, fn := range destFns {
+		if _, err := os.Stat(fn); err == nil {
+			return fmt.Errorf("not overwriting existing file %v", fn)
+		}
+	}
+
+	// Write metadata
+	log.Print("Writing metadata to ", metaFn)
+	gi, err := collateGribInfo(inv, sourceFn)
+	if err != nil {
+		return err
+	}
+	gi.ByteOrder = byteOrderName(aonui.ExtractByteOrder)
+	if err := writeGribInfo(metaFn, gi); err != nil {
+		return err
+	}
+
+	// Expand GRIB for each forecast hour
+	for idx, hourInv := range hourInvs {
+		log.Print("Expanding to ", destFns[idx+1])
+		if err := aonui.GribBackend.Extract(hourInv, sourceFn, destFns[idx+1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeGribInfo writes gi in JSON format to a new file named fn.
+func writeGribInfo(fn string, gi gribInfo) error {
+	f, err := os.Create(fn)
+	if err != nil {
 		return err
 	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(gi)
+}
+
+// extractDir extracts each GRIB2 file in sourceDir to a binary file in destDir
+// using at most jobs simultaneous extractions. An error is returned if any
+// file failed to extract.
+func extractDir(sourceDir, destDir string, jobs int) error {
+	if jobs < 1 {
+		jobs = 1
+	}
 
+	// Find input files
+	var sourceFns []string
+	for _, pattern := range []string{"*.grib2", "*.grb2"} {
+		matches, err := filepath.Glob(filepath.Join(sourceDir, pattern))
+		if err != nil {
+			return err
+		}
+		sourceFns = append(sourceFns, matches...)
+	}
+	if len(sourceFns) == 0 {
+		return fmt.Errorf("no GRIB2 files found in %v", sourceDir)
+	}
+
+	// Extract each file concurrently recording the result
+	var wg sync.WaitGroup
+	sem := make(chan int, jobs)
+	errs := make([]error, len(sourceFns))
+	for idx, sourceFn := range sourceFns {
+		base := filepath.Base(sourceFn)
+		ext := ".bin"
+		if extractFormat == "netcdf" {
+			ext = ".nc"
+		}
+		destFn := filepath.Join(destDir,
+			strings.TrimSuffix(base, filepath.Ext(base))+ext)
+
+		wg.Add(1)
+		go func(idx int, sourceFn, destFn string) {
+			defer wg.Done()
+
+			sem <- 1
+			defer func() { <-sem }()
+
+			if _, err := os.Stat(destFn); err == nil {
+				errs[idx] = fmt.Errorf("not overwriting existing file %v", destFn)
+				return
+			}
+			errs[idx] = extract(sourceFn, destFn)
+		}(idx, sourceFn, destFn)
+	}
+	wg.Wait()
+
+	// Report results
+	nFailed := 0
+	for idx, sourceFn := range sourceFns {
+		if errs[idx] != nil {
+			log.Print("FAILED ", sourceFn, ": ", errs[idx])
+			nFailed++
+		} else {
+			log.Print("OK ", sourceFn)
+		}
+	}
+	log.Print(len(sourceFns)-nFailed, " of ", len(sourceFns), " file(s) extracted")
+
+	if nFailed > 0 {
+		return fmt.Errorf("%d file(s) failed to extract", nFailed)
+	}
 	return nil
 }
@@ -0,0 +1,157 @@
+package main
+
+// Print the grid geometry of a GRIB2 file
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/rjw57/aonui"
+)
+
+var gridDumpJson bool
+
+var cmdGrid = &Command{
+	UsageLine: "grid [-json] gribfile",
+	Short:     "print the grid geometry of a GRIB2 file",
+	Long: `
+Grid prints a complete description of the grid of the first record in the GRIB2
+file gribfile to standard output. Unlike "aonui info", which gives only the
+shape of the data, the projection, extent, spacing and scanning order of the
+grid are included. Output for a latitude-longitude grid has the following
+form:
+
+	TEMPLATE=0
+	PROJECTION=latlon
+	NX=720
+	NY=361
+	INPUTSCAN=WE:NS
+	OUTPUTSCAN=WE:SN
+	GLOBAL=true
+	LAT1=90
+	LAT2=-90
+	LON1=0
+	LON2=359.5
+	DLAT=0.5
+	DLON=0.5
+
+TEMPLATE is the GRIB2 grid definition template number and PROJECTION one of
+latlon, gaussian or lambert. Grids of other projections are given wgrib2's
+description of the projection and only the fields up to GLOBAL are printed.
+INPUTSCAN and OUTPUTSCAN give the order in which points are stored in the
+record and the order in which they are extracted. GLOBAL is true if the grid
+wraps around the globe in longitude.
+
+For latitude-longitude and Gaussian grids, LAT1 and LAT2 are the latitudes of
+the first and last rows and LON1 and LON2 the longitudes of the first and last
+columns. DLAT and DLON are the spacing between rows and columns. Rows of a
+Gaussian grid are not evenly spaced so DLAT is omitted and NGAUSSIAN gives the
+number of rows between a pole and the equator instead.
+
+For Lambert Conformal grids, LAT1 and LON1 are the position of the first grid
+point, LOV the longitude parallel to the y-axis, LATD the latitude at which the
+spacing DX and DY in metres is specified, LATIN1 and LATIN2 the latitudes at
+which the cone cuts the sphere, LATSP and LONSP the southern pole of projection
+and POLE either north or south.
+
+All angles are in degrees. This command always uses wgrib2 whatever the value
+of AONUI_GRIB_BACKEND. (See "aonui help gribtools".)
+
+If the -json flag is specified, the information is written in JSON format
+instead.
+
+See also: aonui help info
+`,
+}
+
+func init() {
+	cmdGrid.Run = runGrid // break init cycle
+	cmdGrid.Flag.BoolVar(&gridDumpJson, "json", false,
+		"dump information in JSON format")
+}
+
+func runGrid(cmd *Command, args []string) {
+	if len(args) != 1 {
+		log.Print("error: no GRIB file specified")
+		setExitStatus(2)
+		return
+	}
+	gribFn := args[0]
+
+	// Make sure we can process GRIBs before doing any work
+	if err := aonui.CheckWgrib2(); err != nil {
+		log.Print("error: ", err)
+		setExitStatus(1)
+		return
+	}
+
+	inv, err := aonui.Wgrib2Inventory(gribFn)
+	if err != nil {
+		log.Print("error: ", err)
+		setExitStatus(1)
+		return
+	}
+	if len(inv) == 0 {
+		log.Print("error: empty GRIB")
+		setExitStatus(1)
+		return
+	}
+
+	geom, err := aonui.Wgrib2GridGeometry(inv[0], gribFn)
+	if err != nil {
+		log.Print("error: ", err)
+		setExitStatus(1)
+		return
+	}
+
+	if gridDumpJson {
+		je := json.NewEncoder(os.Stdout)
+		if err := je.Encode(geom); err != nil {
+			log.Print("error writing json: ", err)
+			setExitStatus(1)
+		}
+		return
+	}
+	dumpGridGeometry(geom)
+}
+
+// dumpGridGeometry prints geom in the text format described by "aonui help
+// grid".
+func dumpGridGeometry(geom aonui.GridGeometry) {
+	fmt.Printf("TEMPLATE=%d\n", geom.Template)
+	fmt.Printf("PROJECTION=%v\n", geom.Projection)
+	fmt.Printf("NX=%d\n", geom.NX)
+	fmt.Printf("NY=%d\n", geom.NY)
+	fmt.Printf("INPUTSCAN=%v\n", geom.InputScan)
+	fmt.Printf("OUTPUTSCAN=%v\n", geom.OutputScan)
+	fmt.Printf("GLOBAL=%v\n", geom.Global)
+
+	if ll := geom.LatLon; ll != nil {
+		fmt.Printf("LAT1=%v\n", ll.Lat1)
+		fmt.Printf("LAT2=%v\n", ll.Lat2)
+		fmt.Printf("LON1=%v\n", ll.Lon1)
+		fmt.Printf("LON2=%v\n", ll.Lon2)
+		if ll.NGaussian > 0 {
+			fmt.Printf("NGAUSSIAN=%d\n", ll.NGaussian)
+		} else {
+			fmt.Printf("DLAT=%v\n", ll.DLat)
+		}
+		fmt.Printf("DLON=%v\n", ll.DLon)
+	}
+
+	if lc := geom.Lambert; lc != nil {
+		fmt.Printf("LAT1=%v\n", lc.Lat1)
+		fmt.Printf("LON1=%v\n", lc.Lon1)
+		fmt.Printf("LOV=%v\n", lc.LoV)
+		fmt.Printf("LATD=%v\n", lc.LatD)
+		fmt.Printf("LATIN1=%v\n", lc.Latin1)
+		fmt.Printf("LATIN2=%v\n", lc.Latin2)
+		fmt.Printf("LATSP=%v\n", lc.LatSP)
+		fmt.Printf("LONSP=%v\n", lc.LonSP)
+		fmt.Printf("DX=%v\n", lc.Dx)
+		fmt.Printf("DY=%v\n", lc.Dy)
+		fmt.Printf("POLE=%v\n", lc.Pole)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+// Download only geopotential height for use as an altitude reference
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/rjw57/aonui"
+)
+
+// Command-line flags
+var (
+	heightsBaseDir string
+	heightsHighRes bool
+	heightsMaxRuns int
+	heightsRun     string
+	heightsSource  string
+)
+
+var cmdHeights = &Command{
+	UsageLine: "heights [flags]",
+	Short:     "fetch geopotential height data from the GFS",
+	Long: `
+Heights will fetch only the geopotential height (HGT) records at each pressure
+and forecast hour of a GFS run and write them in Tawhiri order to a GRIB2 file.
+This is a fraction of the size of the full wind download and is sufficient for
+looking up the altitude of a given pressure level.
+
+The resulting file is named gfs.YYYYMMDDHH.hgt.grib2 where YYYY, MM, DD and HH
+are the year, month, day and hour of the run.
+
+The -basedir, -source, -highres and -maxruns flags behave as for "aonui sync".
+The -run flag may be used to specify the identifier of a particular run to
+download, for example "gfs.2014102106". If omitted, the newest complete run is
+downloaded.
+
+See also: aonui help sync
+`,
+}
+
+func init() {
+	cmdHeights.Run = runHeights // break init cycle
+	cmdHeights.Flag.StringVar(&heightsBaseDir, "basedir", ".",
+		"directory to download data to")
+	cmdHeights.Flag.BoolVar(&heightsHighRes, "highres", false,
+		"download 0.25deg data as opposed to 0.5deg")
+	cmdHeights.Flag.IntVar(&heightsMaxRuns, "maxruns", 3,
+		"maximum number of runs to examine before giving up")
+	cmdHeights.Flag.StringVar(&heightsRun, "run", "",
+		"identifier of run to download")
+	cmdHeights.Flag.StringVar(&heightsSource, "source", "gfs-0p50",
+		"name of data source to download from")
+}
+
+func runHeights(cmd *Command, args []string) {
+	// Which source to use?
+	src, err := lookupSource(heightsSource, heightsHighRes)
+	if err != nil {
+		log.Print("error: ", err)
+		setExitStatus(2)
+		return
+	}
+
+	// Fetch all of the runs
+	runs, err := src.FetchRuns()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Sort by *descending* date
+	sort.Sort(sort.Reverse(ByDate(runs)))
+
+	// Only consider the requested run if one was specified
+	if heightsRun != "" {
+		var matching []*aonui.Run
+		for _, run := range runs {
+			if run.Identifier == heightsRun {
+				matching = append(matching, run)
+			}
+		}
+		if len(matching) == 0 {
+			log.Fatal("no run named ", heightsRun)
+		}
+		runs = matching
+	}
+
+	if len(runs) > heightsMaxRuns {
+		runs = runs[:heightsMaxRuns]
+	}
+
+	for _, run := range runs {
+		destFn := filepath.Join(heightsBaseDir, run.Identifier+".hgt.grib2")
+
+		if _, err := os.Stat(destFn); err == nil {
+			log.Print("not overwriting ", destFn)
+			continue
+		}
+
+		if err := syncHeights(run, destFn); err != nil {
+			log.Print("error syncing run: ", err)
+		} else {
+			// success!
+			log.Print("run downloaded successfully")
+			return
+		}
+	}
+
+	log.Fatal("no runs were downloaded")
+}
+
+// syncHeights downloads the HGT records of run in Tawhiri order to destFn.
+func syncHeights(run *aonui.Run, destFn string) error {
+	log.Print("Fetching data for run at ", run.When, " to ", destFn)
+	output, err := os.Create(destFn)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	// Make sure to remove partial output on keyboard interrupt
+	succeeded := false
+	atexit(func() {
+		if !succeeded {
+			os.Remove(destFn)
+		}
+	})
+
+	opts := aonui.TawhiriDownloadOptions{Parameters: []string{"HGT"}}
+	if _, err := run.DownloadTawhiri(output, opts); err != nil {
+		output.Close()
+		os.Remove(destFn)
+		return err
+	}
+
+	succeeded = true
+	return nil
+}
@@ -17,3 +17,20 @@ numerical order. (This is so that the first pressure corresponds to the lowest
 geo-potential height.) Forecast hours are in increasing numerical order.
 `,
 }
+
+var helpGribTools = &Command{
+	UsageLine: "gribtools",
+	Short:     "external tools used to process GRIB2 files",
+	Long: `
+Aonui does not decode GRIB2 files itself. Instead it uses an external tool to
+parse inventories, determine grid shapes and extract data. Two tools are
+supported: wgrib2 and the grib_get and grib_get_data tools from ecCodes.
+
+By default wgrib2 is used. If the AONUI_GRIB_BACKEND environment variable is
+set to "eccodes", the ecCodes tools are used instead. In either case, the tools
+must be on the system path.
+
+The ecCodes backend converts parameter and layer names into the form used by
+wgrib2 so that inventories look the same irrespective of the tool used.
+`,
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -11,7 +12,10 @@ import (
 	"github.com/rjw57/aonui"
 )
 
-var infoDumpJson bool
+var (
+	infoDumpJson bool
+	infoNoCache  bool
+)
 
 var cmdInfo = &Command{
 	Run:       runInfo,
@@ -30,17 +34,31 @@ form:
 	PRESSURES=1000,975,950,925,900,875,850,... # etc
 	FCSTHOURS=0,3,6,9,12,15,18,21,24,27,30,... # etc
 	RUNTIME=2014102106
+	LAT0=-90
+	LON0=0
+	DLAT=0.5
+	DLON=0.5
 
 NX, NY, NPARAM, NPRESSURE and NFCSTHOUR give the sizes of each dimension of the
 data. PRESSURES and FCSTHOURS are comma-separated integers giving the
 particular pressures and forecast hours which correspondt to each point along
 the respective axes. The RUNTIME is the date and time the forecast was run on
-formatted as YYYYMMDDHH.
+formatted as YYYYMMDDHH. LAT0 and LON0 give the latitude and longitude in
+degrees of the South-West grid point and DLAT and DLON the spacing in degrees
+between rows and columns of the grid. They are omitted if the data is not on a
+regular latitude-longitude grid, e.g. the Lambert Conformal grid of the HRRR.
 
 Note that this command may take some time to complete the first time it is run
 on a file since collating the pressures and forecast hours requires scanning
 through the entire GRIB2 message.
 
+Caching information
+
+The collated information is cached in a file next to gribfile with the suffix
+.aonui-info.json appended. Subsequent invocations use the cached information if
+the size and modification time of gribfile have not changed. The -nocache flag
+forces the information to be recomputed and the cache to be rewritten.
+
 JSON formatted output
 
 If the -json flag is specified, information is written to standard output in
@@ -52,7 +70,11 @@ JSON format. The output looks similar to:
 	  "parameters": [ "HGT", "UGRD", "VGRD" ],
 	  "pressures": [ 875, 825, <etc> ],
 	  "forecastHours": [ 0, 3, <etc> ],
-	  "runTime": "2014-11-10T12:00:00Z"
+	  "runTime": "2014-11-10T12:00:00Z",
+	  "lat0": -90,
+	  "lon0": 0,
+	  "dLat": 0.5,
+	  "dLon": 0.5
 	}
 
 `,
@@ -65,12 +87,26 @@ type gribInfo struct {
 	Pressures     []int     `json:"pressures"`
 	ForecastHours []int     `json:"forecastHours"`
 	RunTime       time.Time `json:"runTime"`
+	ByteOrder     string    `json:"byteOrder,omitempty"` // Byte order of extracted values (or "" if not extracted)
+
+	// Grid geometry (or nil if not a latitude-longitude grid)
+	*LatLonInfo
+}
+
+// LatLonInfo describes a regular latitude-longitude grid
+type LatLonInfo struct {
+	Lat0 float64 `json:"lat0"`
+	Lon0 float64 `json:"lon0"`
+	DLat float64 `json:"dLat"`
+	DLon float64 `json:"dLon"`
 }
 
 func init() {
 	cmdInfo.Run = runInfo // break init cycle
 	cmdInfo.Flag.BoolVar(&infoDumpJson, "json", false,
 		"dump information in JSON format")
+	cmdInfo.Flag.BoolVar(&infoNoCache, "nocache", false,
+		"ignore any cached information")
 }
 
 func runInfo(cmd *Command, args []string) {
@@ -82,21 +118,114 @@ func runInfo(cmd *Command, args []string) {
 
 	gribFn := args[0]
 
+	// Use cached information if it is still valid
+	gi, ok := loadInfoCache(gribFn)
+	if !ok || infoNoCache {
+		var err error
+		if gi, err = computeGribInfo(gribFn); err != nil {
+			log.Print(err)
+			setExitStatus(1)
+			return
+		}
+
+		// Failing to cache is not fatal
+		if err := saveInfoCache(gribFn, gi); err != nil {
+			log.Print("warning: could not cache information: ", err)
+		}
+	}
+
+	if infoDumpJson {
+		je := json.NewEncoder(os.Stdout)
+		if err := je.Encode(gi); err != nil {
+			log.Print("error writing json: ", err)
+			setExitStatus(1)
+			return
+		}
+	} else {
+		gi.Dump()
+	}
+}
+
+// computeGribInfo parses the inventory of gribFn and collates its dimensions.
+func computeGribInfo(gribFn string) (gribInfo, error) {
+	// Make sure we can process GRIBs before doing any work
+	if err := aonui.GribBackend.Check(); err != nil {
+		return gribInfo{}, errors.New(fmt.Sprint("error: ", err))
+	}
+
 	// Get inventory from grib
 	inv, err := aonui.TawhiriOrderedInventory(gribFn)
 	if err != nil {
-		log.Print(err)
-		setExitStatus(1)
-		return
+		return gribInfo{}, err
 	}
 
 	// Check for empty file
 	if len(inv) == 0 {
-		log.Print("error: empty GRIB")
-		setExitStatus(1)
-		return
+		return gribInfo{}, errors.New("error: empty GRIB")
 	}
 
+	// Collate information from inventory
+	return collateGribInfo(inv, gribFn)
+}
+
+// An infoCache records the information collated from a GRIB2 file along with
+// the size and modification time of the file at the time.
+type infoCache struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Info    gribInfo  `json:"info"`
+}
+
+// infoCacheFilename returns the name of the cache file for gribFn.
+func infoCacheFilename(gribFn string) string {
+	return gribFn + ".aonui-info.json"
+}
+
+// loadInfoCache returns the cached information for gribFn. The returned flag
+// is false if there is no cache or if gribFn has changed since it was written.
+func loadInfoCache(gribFn string) (gribInfo, bool) {
+	fi, err := os.Stat(gribFn)
+	if err != nil {
+		return gribInfo{}, false
+	}
+
+	f, err := os.Open(infoCacheFilename(gribFn))
+	if err != nil {
+		return gribInfo{}, false
+	}
+	defer f.Close()
+
+	var cache infoCache
+	if err := json.NewDecoder(f).Decode(&cache); err != nil {
+		return gribInfo{}, false
+	}
+	if cache.Size != fi.Size() || !cache.ModTime.Equal(fi.ModTime()) {
+		return gribInfo{}, false
+	}
+
+	return cache.Info, true
+}
+
+// saveInfoCache writes gi to the cache file for gribFn.
+func saveInfoCache(gribFn string, gi gribInfo) error {
+	fi, err := os.Stat(gribFn)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(infoCacheFilename(gribFn))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cache := infoCache{Size: fi.Size(), ModTime: fi.ModTime(), Info: gi}
+	return json.NewEncoder(f).Encode(cache)
+}
+
+// collateGribInfo computes the dimensions of the Tawhiri-ordered inventory inv
+// from the GRIB2 file gribFn. The inventory must not be empty.
+func collateGribInfo(inv aonui.Inventory, gribFn string) (gribInfo, error) {
 	// Structure we will write grib info to
 	var gi gribInfo
 
@@ -141,32 +270,32 @@ func runInfo(cmd *Command, args []string) {
 	sort.Sort(sort.Reverse(sort.IntSlice(gi.Pressures)))
 
 	// Get shapes from grib
-	// HACK: only look at first item
-	shapes, err := aonui.Wgrib2GridShapes(inv[:1], gribFn)
+	shapes, err := aonui.GribBackend.GridShapes(inv, gribFn)
 	if err != nil {
-		log.Print(err)
-		setExitStatus(1)
-		return
+		return gi, err
 	}
 	if len(shapes) < 1 {
-		log.Print("error: no grids in GRIB?!")
-		setExitStatus(1)
-		return
+		return gi, errors.New("error: no grids in GRIB?!")
+	}
+	if !aonui.AllSameShape(shapes) {
+		log.Print("warning: records have differing grid shapes, using the shape of the first")
 	}
 
 	gi.Width = shapes[0].Columns
 	gi.Height = shapes[0].Rows
 
-	if infoDumpJson {
-		je := json.NewEncoder(os.Stdout)
-		if err := je.Encode(gi); err != nil {
-			log.Print("error writing json: ", err)
-			setExitStatus(1)
-			return
+	// Get grid geometry
+	// HACK: only look at first item
+	grid, err := aonui.GribBackend.LatLonGrid(inv[0], gribFn)
+	if err == nil {
+		gi.LatLonInfo = &LatLonInfo{
+			Lat0: grid.Lat0, Lon0: grid.Lon0, DLat: grid.DLat, DLon: grid.DLon,
 		}
-	} else {
-		gi.Dump()
+	} else if err != aonui.ErrNotLatLonGrid {
+		return gi, err
 	}
+
+	return gi, nil
 }
 
 func (gi gribInfo) Dump() {
@@ -195,4 +324,10 @@ func (gi gribInfo) Dump() {
 	fmt.Print("\n")
 
 	fmt.Printf("RUNTIME=%v\n", gi.RunTime.Format("2006010215"))
+	if gi.LatLonInfo != nil {
+		fmt.Printf("LAT0=%v\n", gi.Lat0)
+		fmt.Printf("LON0=%v\n", gi.Lon0)
+		fmt.Printf("DLAT=%v\n", gi.DLat)
+		fmt.Printf("DLON=%v\n", gi.DLon)
+	}
 }
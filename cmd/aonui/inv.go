@@ -3,15 +3,20 @@ package main
 // Dump the inventory from a GRIB2 file using wgrib2
 
 import (
+	"encoding/csv"
 	"fmt"
+	"io"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/rjw57/aonui"
 )
 
 var cmdInv = &Command{
-	UsageLine: "inv [-nosort] [-nofilter] gribfile",
+	UsageLine: "inv [-nosort] [-nofilter] [-minfh hour] [-maxfh hour] [-format fmt] gribfile",
 	Short:     "filter and sort GRIB2 inventories into Tawhiri order",
 	Long: `
 Inv dumps and optionally filters and sorts a GRIB2's inventory into the order
@@ -32,9 +37,20 @@ Inv will remove inventory items not used by Tawhiri. This behaviour can be
 disabled via the -nofilter flag. In this case non-Tawhiri inventory
 items will be sorted after Tawhiri ones.
 
+The -minfh and -maxfh flags restrict output to Tawhiri items whose forecast
+hour lies within the given range, inclusive. By default, there is no
+restriction.
+
 With -nosort and -nofilter both enabled, inv should generate an inventory
 identical to that produced by "wgrib2 -s".
 
+The -format flag selects the output format. The default, "wgrib2", outputs an
+inventory in wgrib2 "short" format. If the format is "csv", one CSV row is
+output per record with a header row naming the columns record, offset, extent,
+when, parameters, layer, type, forecastHour and pressure. Multiple parameters
+are separated by semicolons. The forecastHour and pressure columns are empty
+for records not used by Tawhiri.
+
 See also: aonui help tawhiri
 `,
 }
@@ -42,12 +58,18 @@ See also: aonui help tawhiri
 // Command-line flags
 var (
 	noSort, noFilter bool
+	minFcstHour      int
+	maxFcstHour      int
+	invFormat        string
 )
 
 func init() {
 	cmdInv.Run = runInv // break init loop
 	cmdInv.Flag.BoolVar(&noSort, "nosort", false, "Do not sort inventory into \"Tawhiri order\"")
 	cmdInv.Flag.BoolVar(&noFilter, "nofilter", false, "Do not remove non-tawhiri items")
+	cmdInv.Flag.IntVar(&minFcstHour, "minfh", 0, "Minimum forecast hour to output")
+	cmdInv.Flag.IntVar(&maxFcstHour, "maxfh", -1, "Maximum forecast hour to output (or -1 for no limit)")
+	cmdInv.Flag.StringVar(&invFormat, "format", "wgrib2", "Output format: wgrib2 or csv")
 }
 
 func runInv(cmd *Command, args []string) {
@@ -58,9 +80,22 @@ func runInv(cmd *Command, args []string) {
 		return
 	}
 
+	if invFormat != "wgrib2" && invFormat != "csv" {
+		fmt.Fprintf(os.Stderr, "error: unknown format: %v\n", invFormat)
+		setExitStatus(2)
+		return
+	}
+
+	// Make sure we can process GRIBs before doing any work
+	if err := aonui.GribBackend.Check(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		setExitStatus(1)
+		return
+	}
+
 	// Load and parse inventory
 	gribFn := args[0]
-	inv, err := aonui.Wgrib2Inventory(gribFn)
+	inv, err := aonui.GribBackend.Inventory(gribFn)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: failed to parse grib2: %v\n", err)
 		setExitStatus(1)
@@ -81,19 +116,69 @@ func runInv(cmd *Command, args []string) {
 		tws = filteredTws
 	}
 
+	// Filter by forecast hour. Invalid items have no meaningful forecast
+	// hour and so are left alone.
+	filteredTws := []*aonui.TawhiriItem{}
+	for _, tw := range tws {
+		if tw.IsValid && tw.ForecastHour < minFcstHour {
+			continue
+		}
+		if tw.IsValid && maxFcstHour >= 0 && tw.ForecastHour > maxFcstHour {
+			continue
+		}
+		filteredTws = append(filteredTws, tw)
+	}
+	tws = filteredTws
+
 	// Sort if asked. Note that sorting in this manner is effectively a
 	// Swartzian transform.
 	if !noSort {
 		sort.Sort(aonui.ByTawhiri(tws))
 	}
 
+	// Print inventory
+	if invFormat == "csv" {
+		if err := writeInventoryCSV(os.Stdout, tws); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			setExitStatus(1)
+		}
+		return
+	}
+
 	// De-parse
 	inv = aonui.FromTawhiris(tws)
 
-	// Print inventory
 	for _, item := range inv {
 		for _, ln := range item.Wgrib2Strings() {
 			fmt.Println(ln)
 		}
 	}
 }
+
+// writeInventoryCSV writes tws to w in CSV format with a header row.
+func writeInventoryCSV(w io.Writer, tws []*aonui.TawhiriItem) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"record", "offset", "extent", "when", "parameters", "layer",
+		"type", "forecastHour", "pressure",
+	})
+	for _, tw := range tws {
+		var fcstHour, pressure string
+		if tw.IsValid {
+			fcstHour, pressure = strconv.Itoa(tw.ForecastHour), strconv.Itoa(tw.Pressure)
+		}
+		cw.Write([]string{
+			strconv.Itoa(tw.Item.RecordNumber),
+			strconv.FormatInt(tw.Item.Offset, 10),
+			strconv.FormatInt(tw.Item.Extent, 10),
+			tw.Item.When.Format(time.RFC3339),
+			strings.Join(tw.Item.Parameters, ";"),
+			tw.Item.LayerName,
+			tw.Item.TypeName,
+			fcstHour,
+			pressure,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
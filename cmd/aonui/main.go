@@ -1,24 +1,36 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
 // Commands lists the available commands and help topics.
 // The order here is the order in which they are printed by 'aonui help'.
 var commands = []*Command{
 	cmdSync,
+	cmdHeights,
 	cmdExtract,
 	cmdInfo,
+	cmdGrid,
 	cmdInv,
+	cmdVars,
+	cmdVerify,
 	cmdReorder,
+	cmdCat,
+	cmdValueDiff,
+	cmdDiff,
+	cmdCatalog,
 
 	helpTawhiri,
+	helpGribTools,
 }
 
 func main() {
@@ -37,11 +49,17 @@ func main() {
 	}
 
 	// Set signal handler so that "atexit" functions are called on keyboard
-	// interrupt.
+	// interrupt or termination. If the command supports it, the first
+	// SIGTERM instead requests a graceful shutdown.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		for s := range c {
+			if s == syscall.SIGTERM && atomic.LoadInt32(&gracefulShutdown) != 0 && shutdownCtx.Err() == nil {
+				log.Printf("captured %v, finishing work in progress; signal again to exit immediately", s)
+				requestShutdown()
+				continue
+			}
 			log.Printf("captured %v, cleaning up", s)
 			exit()
 		}
@@ -78,6 +96,18 @@ func setExitStatus(n int) {
 	exitMu.Unlock()
 }
 
+// Context cancelled by the first SIGTERM if the running command has called
+// enableGracefulShutdown. Such commands should stop starting new work once it
+// is cancelled but finish the work in progress.
+var shutdownCtx, requestShutdown = context.WithCancel(context.Background())
+
+// Non-zero if the running command supports graceful shutdown
+var gracefulShutdown int32
+
+func enableGracefulShutdown() {
+	atomic.StoreInt32(&gracefulShutdown, 1)
+}
+
 var atexitFuncs []func()
 
 func atexit(f func()) {
@@ -0,0 +1,88 @@
+package main
+
+// Manifests recording the progress of partially downloaded runs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A byteRange is a contiguous region of a file
+type byteRange struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	SHA256 string `json:"sha256,omitempty"` // Hex digest of the region (or "" if unknown)
+
+	// Length of the records in the dataset according to its inventory (or
+	// 0 if unknown)
+	Expected int64 `json:"expected,omitempty"`
+}
+
+// A syncManifest records which datasets of a run have been written to the
+// output file and where.
+type syncManifest struct {
+	Run      string               `json:"run"`
+	Datasets map[string]byteRange `json:"datasets"`
+}
+
+// manifestFilename returns the name of the manifest for the output file
+// destFn.
+func manifestFilename(destFn string) string {
+	return destFn + ".partial"
+}
+
+// loadSyncManifest loads the manifest for a partial download of run from fn.
+// If fn does not exist, an empty manifest is returned.
+func loadSyncManifest(fn string, run string) (*syncManifest, error) {
+	manifest := &syncManifest{Run: run, Datasets: make(map[string]byteRange)}
+
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("error parsing %v: %v", fn, err)
+	}
+	if manifest.Run != run {
+		return nil, fmt.Errorf("%v is for run %v, not %v", fn, manifest.Run, run)
+	}
+
+	return manifest, nil
+}
+
+// End returns the offset just past the last byte written to the output.
+func (m *syncManifest) End() int64 {
+	var end int64
+	for _, r := range m.Datasets {
+		if r.Offset+r.Length > end {
+			end = r.Offset + r.Length
+		}
+	}
+	return end
+}
+
+// Save atomically writes the manifest to fn.
+func (m *syncManifest) Save(fn string) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn))
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(tmpFile).Encode(m)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), fn)
+}
@@ -10,8 +10,7 @@ import (
 )
 
 var cmdReorder = &Command{
-	Run:       runReorder,
-	UsageLine: "reorder ingribfile outgribfile",
+	UsageLine: "reorder [-keepunused] [-dedup] [-verify] [-scan] [-jobs n] ingribfile outgribfile",
 	Short:     "re-order a GRIB2 file into Tawhiri order",
 	Long: `
 Reorder will take an existing GRIB2 file on disk and write out a new GRIB2 file
@@ -19,12 +18,54 @@ with the records re-ordered into the order Tawhiri expects. (See "aonui help
 tawhiri" for details on this ordering.)
 
 Input is read from ingribfile and written to outgribfile. Records not used by
-Tawhiri will not be written to the output.
+Tawhiri will not be written to the output unless the -keepunused flag is
+present. In that case they are written after the Tawhiri records in the order
+they appear in ingribfile.
+
+If the -dedup flag is present, only the first of several records with the same
+forecast hour, pressure and parameter is written. Such duplicates appear, for
+example, when the primary and secondary GFS files overlap and would otherwise
+give Tawhiri two copies of the same data.
+
+Records are usually copied one at a time. The -jobs flag sets the number of
+records copied at once, each read via a separate handle on ingribfile. Values
+greater than one can make re-ordering faster on solid state disks.
+
+If the -verify flag is present, outgribfile is checked once written to make sure
+it is made up of complete GRIB2 messages, one for each record written.
+
+The inventory of ingribfile is usually found with wgrib2. If the -scan flag is
+present, the messages of ingribfile are decoded directly instead and wgrib2 is
+not needed. Only the common parameters, such as HGT, UGRD and VGRD, on
+isobaric, height above ground and surface layers are recognised in this way.
 
 See also: aonui help tawhiri
 `,
 }
 
+// Command-line flags
+var (
+	reorderKeepUnused bool
+	reorderVerify     bool
+	reorderDedup      bool
+	reorderJobs       int
+	reorderScan       bool
+)
+
+func init() {
+	cmdReorder.Run = runReorder // break init cycle
+	cmdReorder.Flag.BoolVar(&reorderKeepUnused, "keepunused", false,
+		"keep records not used by Tawhiri")
+	cmdReorder.Flag.BoolVar(&reorderVerify, "verify", false,
+		"check output after writing")
+	cmdReorder.Flag.BoolVar(&reorderDedup, "dedup", false,
+		"drop duplicate records")
+	cmdReorder.Flag.IntVar(&reorderJobs, "jobs", 1,
+		"number of records to copy at once")
+	cmdReorder.Flag.BoolVar(&reorderScan, "scan", false,
+		"find records without wgrib2")
+}
+
 func runReorder(cmd *Command, args []string) {
 	// Get file from command line
 	if len(args) != 2 {
@@ -36,7 +77,22 @@ func runReorder(cmd *Command, args []string) {
 	gribFn := args[0]
 	outFn := args[1]
 
-	if err := aonui.TawhiriReorderGrib2(gribFn, outFn); err != nil {
+	// Make sure we can process GRIBs before doing any work
+	if !reorderScan {
+		if err := aonui.GribBackend.Check(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			setExitStatus(1)
+			return
+		}
+	}
+
+	opts := aonui.TawhiriReorderOptions
+	opts.KeepUnused = reorderKeepUnused
+	opts.Verify = reorderVerify
+	opts.Dedup = reorderDedup
+	opts.Workers = reorderJobs
+	opts.ScanInventory = reorderScan
+	if err := aonui.ReorderGrib2With(gribFn, outFn, opts); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		setExitStatus(1)
 		return
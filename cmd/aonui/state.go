@@ -0,0 +1,62 @@
+package main
+
+// State recording the newest run downloaded by sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A syncState records the newest run successfully downloaded by sync so that
+// later invocations can stop early if there is nothing new.
+type syncState struct {
+	Run     string    `json:"run"`     // Identifier of the run
+	When    time.Time `json:"when"`    // Time of the run
+	Updated time.Time `json:"updated"` // Time the state was written
+}
+
+// loadSyncState loads the state from fn. If fn does not exist, the zero state
+// is returned.
+func loadSyncState(fn string) (*syncState, error) {
+	state := &syncState{}
+
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(state); err != nil {
+		return nil, fmt.Errorf("error parsing %v: %v", fn, err)
+	}
+
+	return state, nil
+}
+
+// Save writes the state to fn. The state is written to a temporary file which
+// is renamed over fn so that an interrupted write does not lose the state.
+func (s *syncState) Save(fn string) error {
+	s.Updated = time.Now().UTC()
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn))
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(tmpFile).Encode(s)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), fn)
+}
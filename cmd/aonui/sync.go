@@ -1,40 +1,69 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/rjw57/aonui"
 )
 
-const maximumSimultaneousDownloads = 5
-
-// Global semaphore used to limit the number of simultaneous downloads
-var fetchSem = make(chan int, maximumSimultaneousDownloads)
-
 // A StringListValue wraps a slice of strings and implements the Value intrface
 // for flag allowing it to be used as a command line flag.
 type StringListValue []string
 
-func (sl StringListValue) String() string      { return strings.Join(sl, ",") }
-func (sl StringListValue) Get() interface{}    { return sl }
-func (sl *StringListValue) Set(s string) error { *sl = strings.Split(s, ","); return nil }
+func (sl StringListValue) String() string   { return strings.Join(sl, ",") }
+func (sl StringListValue) Get() interface{} { return sl }
+func (sl *StringListValue) Set(s string) error {
+	*sl = nil
+	for _, v := range strings.Split(s, ",") {
+		if v != "" {
+			*sl = append(*sl, v)
+		}
+	}
+	return nil
+}
 
 // Command-line flags
 var (
-	syncBaseDir        string
-	syncHighRes        bool
-	syncMaxRuns        int
-	syncParameters     StringListValue = []string{"HGT", "UGRD", "VGRD"}
-	syncFilenamePrefix string
+	syncBaseDir         string
+	syncHighRes         bool
+	syncMaxRuns         int
+	syncParameters      StringListValue = []string{"HGT", "UGRD", "VGRD"}
+	syncFilenamePrefix  string
+	syncCheckHours      bool
+	syncPipeCommand     string
+	syncTimingsFn       string
+	syncSource          string
+	syncAllLayers       bool
+	syncConcurrency     int
+	syncOutputTemplate  string
+	syncEvents          bool
+	syncVerifyChecksum  bool
+	syncSecondary       bool
+	syncSince           string
+	syncInventoryCache  string
+	syncCatalog         bool
+	syncRateLimit       int64
+	syncCompress        string
+	syncGzip            bool
+	syncStateFn         string
+	syncHostConcurrency int
+	syncMaxBytes        int64
+	syncMaxFailures     int
 )
 
 var cmdSync = &Command{
@@ -51,26 +80,86 @@ Setting base directory
 The -basedir flag specifies the directory data should be downloaded to. If
 omitted, the current working directory is used.
 
+Selecting the data source
+
+The -source flag selects which data source to download from by name. The
+default, "gfs-0p50", is the 0.5 degree GFS data. Other sources include
+"gfs-0p25" and "gfs-1p00" for the 0.25 and 1 degree GFS data and "gefs-c00",
+"gefs-p01", etc. for the control and perturbed members of the Global Ensemble
+Forecast System (GEFS). The "hrrr" source is the hourly High-Resolution Rapid
+Refresh over the contiguous United States. The "gfs-0p50-s3" source is the 0.5
+degree GFS data as mirrored in the NOAA Open Data S3 bucket which can be more
+reliable than the NOAA servers. Specifying an unknown source will print a list
+of all known sources.
+
 Downloading high reolsution data
 
-If the -highres flag is present, 0.25 degree data will be downloaded. If
-omitted, the 0.5 degree data is downloaded.
+The -highres flag is an alias for "-source gfs-0p25".
 
 Specifying the oldest run to sync
 
 The -maxruns flag controls how far into the past sync will look for data before
 stopping. The default value of 3 means examine the 3 newest runs on the server
-starting with the newest. If any run is a) incomplete on the server or b)
-already downloaded proceed to the next until the list of runs is exhausted.
+starting with the newest. Runs newer than the newest complete run are passed
+over. If any run is a) incomplete on the server or b) already downloaded
+proceed to the next until the list of runs is exhausted. If none of the runs
+are complete, sync exits with a non-zero status.
 
 The utility attempts to be robust in the face of flaky network connections or a
 flaky server by re-trying failed downloads.
 
+Catching up on missed runs
+
+Usually sync stops once it has downloaded a single run. If the -since flag is
+given an RFC3339 time, such as "2015-01-02T00:00:00Z", sync instead tries to
+download every run on the server which is newer than that time, oldest last.
+The -maxruns flag is ignored. The runs are first checked for completeness with
+up to -concurrency runs checked at once and incomplete runs are skipped. Runs
+which have already been downloaded are skipped. Once all runs have been tried,
+sync logs how many were downloaded, failed or already present and exits with a
+non-zero status if any failed.
+
+Setting the number of simultaneous downloads
+
+Datasets within a run are downloaded concurrently. The -concurrency flag sets
+the maximum number of datasets downloaded at once. The default is 5. The
+-concurrency-per-host flag additionally limits the number of datasets
+downloaded at once from any one host so that, when datasets are spread over
+several servers, no single server is overloaded. By default, there is no
+per-host limit.
+
+Giving up when the server is down
+
+Each dataset is retried several times before sync gives up on it. So that an
+outage of the server does not mean waiting for every dataset to exhaust its
+retries, the rest of a run is abandoned once -max-failures datasets in a row
+have failed every try. The default is 10. A value of 0 never abandons a run
+early.
+
+Limiting bandwidth
+
+The -ratelimit flag caps the total rate at which records are downloaded, in
+bytes per second, across all simultaneous downloads. Note that limiting the
+rate makes each download take longer and so may cause the data source's fetch
+timeout to be reached.
+
 Specifing which parameters to download
 
 By default, aonui sync will download the HGT, UGRD and VGRD parameters from the
 dataset. Use the -params flag to specify an alternate set. The set of
-parameters to download should be a comma-separated lists.
+parameters to download should be a comma-separated lists. At least one
+parameter must be given.
+
+The GFS splits its parameters between primary ("pgrb2") and secondary
+("pgrb2b") files for each forecast hour. By default, only the primary files are
+downloaded. If the -secondary flag is present, records are also downloaded from
+the secondary files. Records in a secondary file with the same parameter,
+layer and forecast type as a record in the corresponding primary file are
+skipped so that the output does not contain duplicates.
+
+By default, only records on isobaric layers (i.e. those whose layer is of the
+form "XXX mb") are downloaded. If the -alllayers flag is present, records on
+all layers, such as the surface or a height above ground, are downloaded.
 
 Specifying filename for download
 
@@ -80,6 +169,145 @@ zeros.
 
 The -prefix flag sets an additional prefix to add to the front of this name.
 
+The -output flag overrides this name with a Go text/template expanded for each
+run. The template is executed with the run as its data so, for example,
+{{.Identifier}} is the run's identifier and {{.When.Year}} and {{.When.Hour}}
+are the year and hour of the run. Use the printf function for leading zeros:
+
+	-output '{{.When.Year}}/{{printf "%02d" .When.Month}}/{{.Identifier}}.grib2'
+
+Relative names are taken relative to the base directory. Any parent directories
+are created as needed. The -prefix flag is ignored if -output is given.
+
+Resuming partial downloads
+
+While a run is being downloaded, a manifest recording which datasets have been
+written is kept alongside the output in a file with a .partial extension. If
+sync is interrupted or some datasets fail to download, the output and manifest
+are left in place. The next invocation of sync will resume the download,
+fetching only those datasets not yet written. The manifest is removed once
+every dataset has been downloaded.
+
+Checksums
+
+Once a run has been downloaded, the SHA256 digest of the output is written to
+a file alongside it with a .sha256 extension in the format used by sha256sum.
+
+The servers do not publish checksums, and certainly not for the subset of
+records downloaded, and so the data cannot be checked against the server's
+copy. Instead, the number of bytes fetched from each dataset is checked against
+the sizes of its records given by the inventory and a fetch which falls short
+is retried. The length and digest of each dataset are recorded as it is written
+to the output. If the -verify-checksum flag is present, the output is re-read
+once complete and each dataset checked against its recorded digest and against
+the length expected from its inventory. If any do not match, the output is
+removed and the run treated as failed.
+
+Checking for missing forecast hours
+
+Sync logs any forecast hours which are missing from the middle of a run's
+sequence of forecast hours. If the -checkhours flag is present, such a run is
+treated as incomplete and is not downloaded.
+
+Limiting the size of output
+
+The -maxbytes flag caps the size in bytes of the output for each run. A run
+whose records would total more than the cap is not downloaded. If, while
+downloading, writing a dataset would take the output over the cap, writing
+stops, the output is removed and the run treated as failed. The number of
+bytes written and expected are logged. When compressing, the cap applies to
+the uncompressed size.
+
+Compressing output
+
+If the -compress flag is given, output files are compressed as they are
+written with the given method, either "gzip" or "zstd", and have the suffix
+.gz or .zst respectively appended to their names. The -gzip flag is an alias
+for "-compress gzip". Gzip compression is built in while zstd compression
+requires the zstd command to be installed. Partial downloads of compressed
+output cannot be resumed and -compress cannot be used with -pipe or
+-verify-checksum.
+
+Records in GRIB2 files are already packed so compression gains little. Expect
+the output to shrink by roughly 5-15% depending on the parameters downloaded.
+Zstd is generally considerably faster than gzip for a similar ratio.
+
+Streaming data to another command
+
+If the -pipe flag is given, the downloaded run is written to the standard input
+of the specified command instead of to a file. The command is run via "sh -c".
+If the command exits with a non-zero status, sync exits with the same status.
+Runs for which the output file already exists in the base directory are still
+skipped.
+
+Caching inventories
+
+Before downloading records from a dataset, sync fetches the dataset's inventory.
+If the -inventorycache flag specifies a directory, inventories are stored there
+and re-used by later invocations of sync as long as the dataset on the server
+has not changed length. This saves re-fetching inventories when, for example,
+sync is re-run with a different set of parameters.
+
+Remembering the newest run
+
+When sync is run frequently, for example from cron, most invocations find that
+the newest run has already been downloaded. If the -state flag names a file,
+relative to the base directory, the identifier of the newest run successfully
+downloaded is recorded in it. If the newest run on the server matches the
+recorded run, sync exits successfully straight away without fetching any
+datasets. Similarly, if the newest complete run matches the recorded run, sync
+exits successfully without downloading anything. The file is created if it
+does not exist.
+
+Cataloguing downloaded runs
+
+If the -catalog flag is present, each run successfully downloaded to a file is
+recorded in a catalog named catalog.json in the base directory. The catalog
+lists the identifier, time, source, filename, size, parameters and forecast
+hours of each run. It is replaced atomically after each run. Use "aonui
+catalog" to rebuild the catalog from the files in a directory.
+
+Stopping gracefully
+
+If sync receives a SIGTERM signal, for example from a service manager, it
+stops starting new downloads but lets those in progress finish and be written
+to the output before exiting. The output is left in place to be resumed by a
+later invocation. A second signal, or an interrupt from the keyboard, exits
+immediately.
+
+Download progress
+
+Before downloading any data, sync fetches the inventory of each dataset in the
+run and logs the total size of the records to be fetched. As each dataset is
+written to the output, the overall progress is logged as a percentage of this
+total.
+
+Recording download timings
+
+Once a run has been fetched, the time taken to download each dataset is
+logged. If the -timings flag is given, these timings are also written in CSV
+format to the specified file. The CSV has the columns identifier,
+forecastHour, start, durationSeconds, bytes, tries and succeeded.
+
+Machine-readable events
+
+If the -events flag is present, sync writes one JSON object per line to
+standard error for each of the following events in addition to its usual log
+output:
+
+	run_selected     a run is about to be downloaded
+	dataset_started  download of a dataset has started
+	dataset_done     a dataset was downloaded
+	dataset_failed   a dataset could not be downloaded
+	run_done         download of a run has finished
+
+Each object has an "event" field naming the event and a "time" field. Run
+events have a "run" field giving the run's identifier and dataset events
+"dataset" and "forecastHour" fields. The dataset_done event also has "bytes"
+and "durationSeconds" fields. The dataset_failed event and unsuccessful
+run_done events have an "error" field. The run_selected event has an "output"
+field giving the output filename and the run_done event a "succeeded" field.
+
 `,
 }
 
@@ -94,17 +322,124 @@ func init() {
 	cmdSync.Flag.Var(&syncParameters, "params", "list of parameters to download")
 	cmdSync.Flag.StringVar(&syncFilenamePrefix, "prefix", "",
 		"prefix for downloaded files")
+	cmdSync.Flag.BoolVar(&syncCheckHours, "checkhours", false,
+		"skip runs with missing forecast hours")
+	cmdSync.Flag.StringVar(&syncPipeCommand, "pipe", "",
+		"command to stream downloaded data to instead of writing a file")
+	cmdSync.Flag.StringVar(&syncTimingsFn, "timings", "",
+		"file to write per-dataset download timings to in CSV format")
+	cmdSync.Flag.StringVar(&syncSource, "source", "gfs-0p50",
+		"name of data source to download from")
+	cmdSync.Flag.BoolVar(&syncAllLayers, "alllayers", false,
+		"download records on all layers, not just isobaric ones")
+	cmdSync.Flag.IntVar(&syncConcurrency, "concurrency", 5,
+		"maximum number of simultaneous downloads")
+	cmdSync.Flag.IntVar(&syncHostConcurrency, "concurrency-per-host", 0,
+		"maximum number of simultaneous downloads from each host (0 for no limit)")
+	cmdSync.Flag.IntVar(&syncMaxFailures, "max-failures",
+		aonui.DefaultFetchStrategy.MaxConsecutiveFailures,
+		"number of datasets failing in a row after which a run is abandoned (0 for no limit)")
+	cmdSync.Flag.StringVar(&syncOutputTemplate, "output", "",
+		"template for output filenames")
+	cmdSync.Flag.BoolVar(&syncEvents, "events", false,
+		"write JSON lifecycle events to standard error")
+	cmdSync.Flag.BoolVar(&syncVerifyChecksum, "verify-checksum", false,
+		"check downloaded data against checksums once written")
+	cmdSync.Flag.BoolVar(&syncSecondary, "secondary", false,
+		"also download from secondary parameter files")
+	cmdSync.Flag.StringVar(&syncSince, "since", "",
+		"download all runs after this RFC3339 time")
+	cmdSync.Flag.StringVar(&syncInventoryCache, "inventorycache", "",
+		"directory to cache dataset inventories in")
+	cmdSync.Flag.BoolVar(&syncCatalog, "catalog", false,
+		"record downloaded runs in catalog.json in the base directory")
+	cmdSync.Flag.Int64Var(&syncRateLimit, "ratelimit", 0,
+		"maximum total download rate in bytes per second (0 for no limit)")
+	cmdSync.Flag.StringVar(&syncCompress, "compress", "",
+		"compress output files with gzip or zstd")
+	cmdSync.Flag.BoolVar(&syncGzip, "gzip", false,
+		"alias for -compress gzip")
+	cmdSync.Flag.StringVar(&syncStateFn, "state", "",
+		"file recording the newest run downloaded")
+	cmdSync.Flag.Int64Var(&syncMaxBytes, "maxbytes", 0,
+		"maximum size in bytes of each run's output (0 for no limit)")
 }
 
 func runSync(cmd *Command, args []string) {
 	baseDir, highRes, maxRuns := syncBaseDir, syncHighRes, syncMaxRuns
 
+	if len(syncParameters) == 0 {
+		log.Print("error: at least one parameter must be specified")
+		setExitStatus(2)
+		return
+	}
+
+	if syncConcurrency < 1 {
+		log.Print("error: concurrency must be at least 1")
+		setExitStatus(2)
+		return
+	}
+
+	if syncGzip {
+		syncCompress = "gzip"
+	}
+	if syncCompress != "" {
+		if err := checkCompression(syncCompress); err != nil {
+			log.Print("error: ", err)
+			setExitStatus(2)
+			return
+		}
+		if syncPipeCommand != "" || syncVerifyChecksum {
+			log.Print("error: -compress cannot be used with -pipe or -verify-checksum")
+			setExitStatus(2)
+			return
+		}
+	}
+
+	// Cutoff for runs to download (if any)
+	var since time.Time
+	if syncSince != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, syncSince); err != nil {
+			log.Print("error: invalid -since time: ", err)
+			setExitStatus(2)
+			return
+		}
+	}
+
+	aonui.SetInventoryCacheDir(syncInventoryCache)
+	enableGracefulShutdown()
+
+	// Semaphore used to limit the number of simultaneous downloads
+	fetchSem := make(chan int, syncConcurrency)
+
+	// Template for output filenames (if any)
+	var outputTmpl *template.Template
+	if syncOutputTemplate != "" {
+		var err error
+		if outputTmpl, err = template.New("output").Parse(syncOutputTemplate); err != nil {
+			log.Print("error: invalid output template: ", err)
+			setExitStatus(2)
+			return
+		}
+	}
+
 	// Which source to use?
-	src := aonui.GFSHalfDegreeDataset
-	if highRes {
-		src = aonui.GFSQuarterDegreeDataset
+	src, err := lookupSource(syncSource, highRes)
+	if err != nil {
+		log.Print("error: ", err)
+		setExitStatus(2)
+		return
 	}
 
+	if syncRateLimit > 0 {
+		src.FetchStrategy.RateLimit = syncRateLimit
+	}
+	if syncHostConcurrency > 0 {
+		src.FetchStrategy.MaxFetchesPerHost = syncHostConcurrency
+	}
+	src.FetchStrategy.MaxConsecutiveFailures = syncMaxFailures
+
 	// Fetch all of the runs
 	runs, err := src.FetchRuns()
 	if err != nil {
@@ -114,39 +449,242 @@ func runSync(cmd *Command, args []string) {
 	// Sort by *descending* date
 	sort.Sort(sort.Reverse(ByDate(runs)))
 
-	succeeded := false
-	for _, run := range runs[:maxRuns] {
-		destFn := filepath.Join(baseDir, syncFilenamePrefix+run.Identifier+".grib2")
+	// Stop early if the newest run has already been downloaded
+	var (
+		state   *syncState
+		stateFn string
+	)
+	if syncStateFn != "" {
+		stateFn = syncStateFn
+		if !filepath.IsAbs(stateFn) {
+			stateFn = filepath.Join(baseDir, stateFn)
+		}
+		if state, err = loadSyncState(stateFn); err != nil {
+			log.Print("error: ", err)
+			setExitStatus(1)
+			return
+		}
+		if len(runs) > 0 && runs[0].Identifier == state.Run {
+			log.Print("newest run ", state.Run, " has already been downloaded")
+			return
+		}
+	}
+
+	// Lifecycle events (if any)
+	var events *eventLog
+	if syncEvents {
+		events = newEventLog(os.Stderr)
+	}
+
+	// Which runs should we consider? Usually the most recent few starting
+	// from the newest complete one but, if given a cutoff, all runs after it.
+	candidates := runs
+	if maxRuns >= 0 && len(candidates) > maxRuns {
+		candidates = candidates[:maxRuns]
+	}
+	if syncSince == "" {
+		// A lookback of zero would examine every run
+		if len(candidates) == 0 {
+			log.Print("error: no runs to examine")
+			setExitStatus(1)
+			return
+		}
+		latest, err := src.LatestCompleteRun(len(candidates))
+		if err != nil {
+			log.Print("error: ", err)
+			setExitStatus(1)
+			return
+		}
+		if state != nil && latest.Identifier == state.Run {
+			log.Print("newest complete run ", state.Run, " has already been downloaded")
+			return
+		}
+		for len(candidates) > 0 && candidates[0].When.After(latest.When) {
+			candidates = candidates[1:]
+		}
+	} else {
+		candidates = nil
+		for _, run := range runs {
+			if run.When.After(since) {
+				candidates = append(candidates, run)
+			}
+		}
+		log.Print("Found ", len(candidates), " run(s) after ", since)
+	}
+
+	nSucceeded, nFailed, nSkipped, nIncomplete := 0, 0, 0, 0
+
+	// When catching up, probe the candidates in parallel and pass over those
+	// which are incomplete on the server rather than probing each in turn.
+	if syncSince != "" && len(candidates) > 0 {
+		statuses, err := src.FetchCompleteRuns(len(candidates), syncConcurrency)
+		if err != nil {
+			log.Print("error: ", err)
+			setExitStatus(1)
+			return
+		}
+		incomplete := make(map[string]bool)
+		for _, status := range statuses {
+			if status.Err == nil && !status.Complete {
+				incomplete[status.Run.Identifier] = true
+			}
+		}
+
+		complete := candidates[:0:0]
+		for _, run := range candidates {
+			if incomplete[run.Identifier] {
+				log.Print("run ", run.Identifier, " is incomplete, skipping")
+				nIncomplete++
+				continue
+			}
+			complete = append(complete, run)
+		}
+		candidates = complete
+	}
+
+	for _, run := range candidates {
+		destFn, err := syncDestFilename(baseDir, outputTmpl, run)
+		if err != nil {
+			log.Print("error: ", err)
+			setExitStatus(1)
+			return
+		}
+		destFn += compressionSuffixes[syncCompress]
 
 		if _, err := os.Stat(destFn); err == nil {
-			log.Print("not overwriting ", destFn)
-			continue
+			if _, err := os.Stat(manifestFilename(destFn)); err != nil {
+				log.Print("not overwriting ", destFn)
+				nSkipped++
+				continue
+			}
+			log.Print("resuming partial download of ", destFn)
+		}
+
+		events.Emit("run_selected", map[string]interface{}{"run": run.Identifier, "output": destFn})
+		err = syncRun(run, destFn, syncParameters, fetchSem, events)
+		doneFields := map[string]interface{}{"run": run.Identifier, "succeeded": err == nil}
+		if err != nil {
+			doneFields["error"] = err.Error()
+		}
+		events.Emit("run_done", doneFields)
+
+		// Partial downloads are left in place to be resumed
+		if shutdownCtx.Err() != nil {
+			log.Print("shut down before all runs were downloaded")
+			setExitStatus(1)
+			return
 		}
 
-		if err := syncRun(run, destFn); err != nil {
-			log.Print("error syncing run: ", err)
+		var incompleteErr *aonui.ErrIncompleteRun
+		if errors.As(err, &incompleteErr) {
+			// Nothing has been written so simply move on to the next run
+			log.Print(incompleteErr, ", skipping")
+			nIncomplete++
+		} else if err != nil {
+			log.Print("error syncing run ", run.Identifier, ": ", err)
+			nFailed++
 
-			// ensure we remove destFn if we created it
-			if os.IsExist(err) {
-				log.Print("Removing ", destFn)
-				os.Remove(destFn)
+			// propagate a failure of the consumer command
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				setExitStatus(exitErr.ExitCode())
+				return
 			}
+
+			// don't leave behind output which cannot be resumed
+			removeUnresumableOutput(destFn, run)
 		} else {
 			// success!
-			log.Print("run downloaded successfully")
-			succeeded = true
-			break
+			log.Print("run ", run.Identifier, " downloaded successfully")
+			nSucceeded++
+
+			// Remember the newest run downloaded
+			if state != nil && run.When.After(state.When) {
+				state.Run, state.When = run.Identifier, run.When
+				if err := state.Save(stateFn); err != nil {
+					log.Print("Error saving state: ", err)
+				}
+			}
+
+			// Unless catching up, we only want the latest run
+			if syncSince == "" {
+				break
+			}
 		}
 	}
 
-	if !succeeded {
+	if syncSince != "" {
+		log.Print(fmt.Sprintf("%d run(s) downloaded, %d failed, %d incomplete, %d already present",
+			nSucceeded, nFailed, nIncomplete, nSkipped))
+		if nFailed > 0 {
+			setExitStatus(1)
+		}
+		return
+	}
+
+	if nSucceeded == 0 {
 		log.Fatal("no runs were downloaded")
 	}
 }
 
-func syncRun(run *aonui.Run, destFn string) error {
+// removeUnresumableOutput removes destFn, the output of a failed download of
+// run, unless it is a partial download with a manifest recording at least one
+// dataset which a later sync can resume. Otherwise the file would be left
+// truncated and later syncs would refuse to overwrite it.
+func removeUnresumableOutput(destFn string, run *aonui.Run) {
+	if _, err := os.Stat(destFn); err != nil {
+		return
+	}
+
+	manifestFn := manifestFilename(destFn)
+	manifest, err := loadSyncManifest(manifestFn, run.Identifier)
+	if err == nil && len(manifest.Datasets) > 0 {
+		log.Print("leaving partial download of ", destFn, " to be resumed")
+		return
+	}
+
+	log.Print("Removing ", destFn)
+	os.Remove(destFn)
+	os.Remove(manifestFn)
+}
+
+// syncDestFilename returns the name of the file run should be downloaded to.
+// If tmpl is non-nil, it is executed with run to form the name. Otherwise the
+// name is formed from the run's identifier and the -prefix flag. Relative names
+// are relative to baseDir. Parent directories of the file are created if they
+// do not exist.
+func syncDestFilename(baseDir string, tmpl *template.Template, run *aonui.Run) (string, error) {
+	if tmpl == nil {
+		return filepath.Join(baseDir, syncFilenamePrefix+run.Identifier+".grib2"), nil
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, run); err != nil {
+		return "", fmt.Errorf("error expanding output template: %v", err)
+	}
+	destFn := buf.String()
+	if destFn == "" {
+		return "", errors.New("output template expanded to an empty filename")
+	}
+	if !filepath.IsAbs(destFn) {
+		destFn = filepath.Join(baseDir, destFn)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destFn), 0777); err != nil {
+		return "", err
+	}
+
+	return destFn, nil
+}
+
+// syncRun downloads the records for params from each dataset in run and
+// concatenates them into destFn. The capacity of fetchSem limits the number
+// of simultaneous downloads. Dataset events are written to events.
+func syncRun(run *aonui.Run, destFn string, params []string, fetchSem chan int, events *eventLog) error {
 	log.Print("Fetching data for run at ", run.When)
 
+	// Failures counted for this attempt should not affect later ones
+	defer run.ResetCircuitBreaker()
+
 	// Get datasets for this run
 	datasets, err := run.FetchDatasets()
 	if err != nil {
@@ -154,71 +692,306 @@ func syncRun(run *aonui.Run, destFn string) error {
 	}
 	log.Print("Run has ", len(datasets), " dataset(s)")
 
-	if len(datasets) < run.Source.MinDatasets {
-		log.Print("Run has too few, expecting at least ", run.Source.MinDatasets)
-		return errors.New("too few datasets in source")
+	// Forecast hours present in the run
+	hours := []int{}
+	for _, ds := range datasets {
+		if run.Source.MaxForecastHour > 0 && ds.ForecastHour > run.Source.MaxForecastHour {
+			continue
+		}
+		hours = append(hours, ds.ForecastHour)
 	}
 
+	if err := run.CheckComplete(datasets); err != nil {
+		// Say which forecast hours have yet to appear
+		if expected := run.ExpectedForecastHours(); len(expected) > 0 {
+			log.Print("Run is missing forecast hour(s): ",
+				run.Schedule().MissingHoursUntil(hours, expected[len(expected)-1]))
+		}
+		return err
+	}
+
+	// Check for gaps in the forecast hours
+	if missing := run.Schedule().MissingHours(hours); len(missing) > 0 {
+		log.Print("Run is missing forecast hour(s): ", missing)
+		if syncCheckHours {
+			return errors.New("run has missing forecast hours")
+		}
+	}
+
+	// Find the primary dataset for each forecast hour and drop secondary
+	// datasets unless asked otherwise. If we have a max forecast hour, drop
+	// later datasets.
+	primaries := make(map[int]*aonui.Dataset)
+	selected := []*aonui.Dataset{}
+	for _, ds := range datasets {
+		if run.Source.MaxForecastHour > 0 && ds.ForecastHour > run.Source.MaxForecastHour {
+			continue
+		}
+		if !ds.IsSecondary() {
+			primaries[ds.ForecastHour] = ds
+		}
+		if syncSecondary || !ds.IsSecondary() {
+			selected = append(selected, ds)
+		}
+	}
+	datasets = selected
+
 	// File source for temporary files
-	tfs := TemporaryFileSource{BaseDir: syncBaseDir, Prefix: "dataset-"}
+	tfs := TemporaryFileSource{BaseDir: filepath.Dir(destFn), Prefix: "dataset-"}
 	defer tfs.RemoveAll()
 
 	// Make sure to remove temporary files on keyboard interrupt
 	atexit(func() { tfs.RemoveAll() })
 
-	// Open the output file
-	log.Print("Fetching run to ", destFn)
-	output, err := os.Create(destFn)
+	// Load the manifest of any previous partial download and skip those
+	// datasets already written. Partial downloads are not resumed when
+	// streaming to a command or compressing.
+	resumable := syncPipeCommand == "" && syncCompress == ""
+	manifestFn := manifestFilename(destFn)
+	manifest, err := loadSyncManifest(manifestFn, run.Identifier)
+	if err != nil {
+		return err
+	}
+	if resumable && len(manifest.Datasets) > 0 {
+		log.Print("Resuming with ", len(manifest.Datasets), " dataset(s) already downloaded")
+		remaining := []*aonui.Dataset{}
+		for _, ds := range datasets {
+			if _, ok := manifest.Datasets[ds.Identifier]; !ok {
+				remaining = append(remaining, ds)
+			}
+		}
+		datasets = remaining
+	}
+
+	// Work out which records to fetch from each dataset and how much data
+	// that is in total
+	plans := planDatasets(datasets, primaries, params, fetchSem)
+	var totalToFetch int64
+	for _, plan := range plans {
+		for _, item := range plan.Items {
+			totalToFetch += item.Extent
+		}
+	}
+	log.Print("Run will fetch ", ByteCount(totalToFetch), " from ", len(datasets), " dataset(s)")
+
+	// Don't start a download which cannot fit
+	totalSize := manifest.End() + totalToFetch
+	if syncMaxBytes > 0 && totalSize > syncMaxBytes {
+		return fmt.Errorf("run is %v, more than -maxbytes of %v", ByteCount(totalSize), ByteCount(syncMaxBytes))
+	}
+
+	// Open the output file or consumer command
+	var output io.WriteCloser
+	if syncPipeCommand != "" {
+		log.Print("Streaming run to ", syncPipeCommand)
+		output, err = startPipeOutput(syncPipeCommand)
+	} else if syncCompress != "" {
+		log.Print("Fetching run to ", destFn, " with ", syncCompress, " compression")
+		output, err = createCompressedOutput(destFn, syncCompress)
+	} else {
+		log.Print("Fetching run to ", destFn)
+		output, err = openResumableOutput(destFn, manifest.End())
+		if err == nil {
+			err = manifest.Save(manifestFn)
+		}
+	}
 	if err != nil {
 		log.Print("Error creating output: ", err)
 		return err
 	}
 
-	// Ensure the file is closed on function exit
+	// Ensure the output is closed on function exit
 	defer output.Close()
 
-	// Concatenate temporary files as they are finished
+	// Concatenate temporary files as they are finished. If writing to the
+	// output fails, keep draining the temporary files so that the fetching
+	// goroutines can finish.
+	var (
+		totalWritten int64
+		writeErr     error
+		capExceeded  bool
+		timings      timingLog
+		nFailed      int
+	)
+	offset := manifest.End()
 	fetchStart := time.Now()
-	for f := range fetchDatasetsData(&tfs, datasets) {
-		if input, err := os.Open(f.Name()); err != nil {
-			log.Print("Error copying temporary file: ", err)
-		} else {
-			io.Copy(output, input)
-			input.Close()
+	// Downloads in progress are only abandoned once -maxbytes is exceeded.
+	// A shutdown lets them finish so that they reach the output.
+	fetchCtx, cancelFetches := context.WithCancel(context.Background())
+	defer cancelFetches()
+	for fd := range fetchDatasetsData(fetchCtx, &tfs, datasets, plans, &timings, fetchSem, events) {
+		f := fd.File
+
+		// Stop writing before the output exceeds the cap. Nothing more
+		// will be written so abandon the remaining downloads.
+		if writeErr == nil && syncMaxBytes > 0 {
+			if fi, err := os.Stat(f.Name()); err == nil && offset+fi.Size() > syncMaxBytes {
+				writeErr = fmt.Errorf("output would exceed -maxbytes of %v: %v written of %v",
+					ByteCount(syncMaxBytes), ByteCount(offset), ByteCount(totalSize))
+				capExceeded = true
+				cancelFetches()
+			}
+		}
+
+		if writeErr == nil {
+			if input, err := os.Open(f.Name()); err != nil {
+				log.Print("Error copying temporary file: ", err)
+				nFailed++
+			} else {
+				h := sha256.New()
+				n, err := io.Copy(io.MultiWriter(output, h), input)
+				totalWritten += n
+				writeErr = err
+				input.Close()
+
+				// Record progress
+				if err == nil && resumable {
+					manifest.Datasets[fd.Dataset.Identifier] = byteRange{
+						Offset: offset, Length: n, SHA256: hex.EncodeToString(h.Sum(nil)),
+						Expected: plans[fd.Dataset].Items.TotalExtent(),
+					}
+					writeErr = manifest.Save(manifestFn)
+				}
+				offset += n
+
+				if totalToFetch > 0 {
+					log.Print(fmt.Sprintf("Progress: %v of %v (%.0f%%)",
+						ByteCount(totalWritten), ByteCount(totalToFetch),
+						100*float64(totalWritten)/float64(totalToFetch)))
+				}
+			}
 		}
 		tfs.Remove(f)
 	}
 
-	fetchDuration := time.Since(fetchStart)
-	fi, err := output.Stat()
-	if err != nil {
-		log.Print("Error: ", err)
-		return err
+	// Report timings
+	timings.Dump()
+	if syncTimingsFn != "" {
+		if err := timings.WriteCSVFile(syncTimingsFn); err != nil {
+			log.Print("Error writing timings: ", err)
+		}
+	}
+
+	// Close the output. For a consumer command this waits for it to exit.
+	closeErr := output.Close()
+	if writeErr != nil {
+		log.Print("Error writing output: ", writeErr)
+	}
+
+	// Resuming would only exceed the cap again
+	if capExceeded && syncPipeCommand == "" {
+		log.Print("Removing ", destFn)
+		os.Remove(destFn)
+		os.Remove(manifestFn)
+	}
+	if closeErr != nil {
+		return closeErr
 	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	fetchDuration := time.Since(fetchStart)
 	log.Print(fmt.Sprintf("Overall download speed: %v/sec",
-		ByteCount(float64(fi.Size())/fetchDuration.Seconds())))
+		ByteCount(float64(totalWritten)/fetchDuration.Seconds())))
 
-	return nil
-}
+	// Check every dataset made it to the output
+	for _, t := range timings.Timings() {
+		if !t.Succeeded {
+			nFailed++
+		}
+	}
+	if nFailed > 0 {
+		return fmt.Errorf("%d dataset(s) failed to download", nFailed)
+	}
 
-func fetchDatasetsData(tfs *TemporaryFileSource, datasets []*aonui.Dataset) chan *os.File {
-	// Which records are we interested in?
-	paramsOfInterest := syncParameters
+	// The remainder only applies to output files
+	if syncPipeCommand != "" {
+		return nil
+	}
 
-	var wg sync.WaitGroup
-	tmpFilesChan := make(chan *os.File)
+	// Check the output is as we wrote it if asked
+	if syncVerifyChecksum {
+		if err := verifyManifestChecksums(destFn, manifest); err != nil {
+			log.Print("Removing corrupt output ", destFn)
+			os.Remove(destFn)
+			os.Remove(manifestFn)
+			return err
+		}
+		log.Print("Verified checksums of ", len(manifest.Datasets), " dataset(s)")
+	}
 
-	trySleepDuration, err := time.ParseDuration("10s")
-	if err != nil {
-		log.Fatal(err)
+	// The download is complete so the manifest is no longer needed
+	os.Remove(manifestFn)
+
+	// Record a checksum of the whole output
+	if err := writeChecksumFile(destFn); err != nil {
+		log.Print("Error writing checksum: ", err)
 	}
 
-	for _, ds := range datasets {
-		// If we have a max forecast hour, and this dataset is later, skip
-		if ds.Run.Source.MaxForecastHour > 0 && ds.ForecastHour > ds.Run.Source.MaxForecastHour {
-			continue
+	// Record the run in the catalog if asked
+	if syncCatalog {
+		// There is one hour per dataset and so, with secondary
+		// datasets, each hour may appear more than once.
+		sortedHours := append([]int{}, hours...)
+		sort.Ints(sortedHours)
+		forecastHours := []int{}
+		for _, h := range sortedHours {
+			if n := len(forecastHours); n == 0 || forecastHours[n-1] != h {
+				forecastHours = append(forecastHours, h)
+			}
 		}
+		entry := catalogEntry{
+			Identifier:    run.Identifier,
+			When:          run.When,
+			Source:        sourceName(run.Source),
+			Filename:      destFn,
+			Parameters:    params,
+			ForecastHours: forecastHours,
+		}
+		if err := addToCatalog(syncBaseDir, entry); err != nil {
+			log.Print("Error updating catalog: ", err)
+		}
+	}
 
+	return nil
+}
+
+// openResumableOutput opens destFn for writing after the first length bytes,
+// discarding anything beyond them. If destFn does not exist, it is created.
+func openResumableOutput(destFn string, length int64) (*os.File, error) {
+	f, err := os.OpenFile(destFn, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(length); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(length, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// A fetchedDataset is a dataset which has been downloaded to a temporary file.
+type fetchedDataset struct {
+	Dataset *aonui.Dataset
+	File    *os.File
+}
+
+// fetchDatasetsData concurrently downloads datasets to temporary files which
+// are sent along the returned channel as they complete. The timing of each
+// download is recorded in timings. At most cap(fetchSem) datasets are
+// downloaded at once. Once a shutdown is requested, no new downloads are
+// started but those in progress are allowed to finish. Once ctx is cancelled,
+// those in progress are abandoned as well.
+func fetchDatasetsData(ctx context.Context, tfs *TemporaryFileSource, datasets []*aonui.Dataset, plans map[*aonui.Dataset]*datasetPlan, timings *timingLog, fetchSem chan int, events *eventLog) chan fetchedDataset {
+	var wg sync.WaitGroup
+	tmpFilesChan := make(chan fetchedDataset)
+
+	for _, ds := range datasets {
 		wg.Add(1)
 
 		go func(dataset *aonui.Dataset) {
@@ -227,39 +1000,74 @@ func fetchDatasetsData(tfs *TemporaryFileSource, datasets []*aonui.Dataset) chan
 			fetchSem <- 1
 			defer func() { <-fetchSem }()
 
-			// Perform download. Attempt download repeatedly
-			maximumTries := dataset.Run.Source.FetchStrategy.MaximumRetries
-			var tmpFile *os.File
-			for tries := 0; tries < maximumTries; tries++ {
-				// Create a temporary file for output
-				tmpFile, err = tfs.Create()
-				if err != nil {
-					log.Print("Error creating temporary file: ", err)
+			// Do not start new downloads when shutting down or
+			// cancelled. The dataset is recorded as having failed so
+			// that the run is not treated as complete.
+			if ctx.Err() != nil || shutdownCtx.Err() != nil {
+				timings.Add(datasetTiming{
+					Identifier:   dataset.Identifier,
+					ForecastHour: dataset.ForecastHour,
+					Start:        time.Now(),
+				})
+				return
+			}
+
+			timing := datasetTiming{
+				Identifier:   dataset.Identifier,
+				ForecastHour: dataset.ForecastHour,
+				Start:        time.Now(),
+			}
+			eventFields := func(extra map[string]interface{}) map[string]interface{} {
+				fields := map[string]interface{}{
+					"run":          dataset.Run.Identifier,
+					"dataset":      dataset.Identifier,
+					"forecastHour": dataset.ForecastHour,
 				}
+				for k, v := range extra {
+					fields[k] = v
+				}
+				return fields
+			}
+			events.Emit("dataset_started", eventFields(nil))
 
-				log.Print("Fetching ", dataset.Identifier,
-					" (try ", tries+1, " of ", maximumTries, ")")
-				err := fetchDataset(tmpFile, dataset, paramsOfInterest)
-				if err == nil {
-					break
+			// Perform download. Retries are handled when fetching the
+			// inventory and records.
+			plan := plans[dataset]
+			timing.Tries = plan.Tries
+			tmpFile, err := tfs.Create()
+			if err != nil {
+				log.Print("Error creating temporary file: ", err)
+			} else {
+				log.Print("Fetching ", dataset.Identifier)
+				nWritten, fetchErr := fetchDataset(ctx, tmpFile, dataset, plan)
+				if fetchErr == nil {
+					timing.Bytes = nWritten
+					timing.Succeeded = true
 				} else {
-					log.Print("Error fetching dataset: ", err)
+					log.Print("Error fetching dataset: ", fetchErr)
+					tmpFile.Close()
+					tfs.Remove(tmpFile)
+					tmpFile = nil
 				}
+				err = fetchErr
+			}
 
-				// Remove this temporary file
-				tmpFile.Close()
-				tfs.Remove(tmpFile)
-				tmpFile = nil
+			timing.Duration = time.Since(timing.Start)
+			timings.Add(timing)
 
-				// Sleep until the next try
-				time.Sleep(trySleepDuration)
+			if err != nil {
+				events.Emit("dataset_failed", eventFields(map[string]interface{}{"error": err.Error()}))
+			} else {
+				events.Emit("dataset_done", eventFields(map[string]interface{}{
+					"bytes": timing.Bytes, "durationSeconds": timing.Duration.Seconds(),
+				}))
 			}
 
 			if tmpFile == nil {
 				log.Print("error: failed to download ", dataset.Identifier)
 			} else {
 				tmpFile.Close()
-				tmpFilesChan <- tmpFile
+				tmpFilesChan <- fetchedDataset{Dataset: dataset, File: tmpFile}
 			}
 		}(ds)
 	}
@@ -274,47 +1082,149 @@ func fetchDatasetsData(tfs *TemporaryFileSource, datasets []*aonui.Dataset) chan
 	return tmpFilesChan
 }
 
-func fetchDataset(output io.Writer, dataset *aonui.Dataset, paramsOfInterest []string) error {
-	// Fetch inventory for this dataset
-	inventory, err := dataset.FetchInventory()
-	if err != nil {
-		return err
+// A datasetPlan records which records will be fetched from a dataset.
+type datasetPlan struct {
+	Items aonui.Inventory // Records to fetch
+	Tries int             // Tries needed to fetch the inventory
+	Err   error           // Error fetching the inventory (or nil)
+}
+
+// planDatasets fetches the inventory of each dataset and selects the records
+// for paramsOfInterest. Records in a secondary dataset which are also in the
+// primary dataset for the same forecast hour in primaries are not selected.
+// At most cap(fetchSem) inventories are fetched at once and each is fetched
+// only once.
+func planDatasets(datasets []*aonui.Dataset, primaries map[int]*aonui.Dataset, paramsOfInterest []string, fetchSem chan int) map[*aonui.Dataset]*datasetPlan {
+	// Work out which inventories are needed
+	needed := make(map[*aonui.Dataset]bool)
+	for _, ds := range datasets {
+		needed[ds] = true
+		if primary := primaries[ds.ForecastHour]; ds.IsSecondary() && primary != nil {
+			needed[primary] = true
+		}
 	}
 
-	// Calculate which items to save
+	// Fetch them concurrently
 	var (
-		totalToFetch int64
-		fetchItems   []*aonui.InventoryItem
+		wg          sync.WaitGroup
+		mu          sync.Mutex
+		inventories = make(map[*aonui.Dataset]*datasetPlan)
 	)
-	for _, item := range inventory {
-		saveItem := false
-		for _, poi := range paramsOfInterest {
-			for _, p := range item.Parameters {
-				saveItem = saveItem || poi == p
+	for ds := range needed {
+		wg.Add(1)
+		go func(dataset *aonui.Dataset) {
+			defer wg.Done()
+
+			fetchSem <- 1
+			defer func() { <-fetchSem }()
+
+			// Do not start new fetches when shutting down
+			if err := shutdownCtx.Err(); err != nil {
+				mu.Lock()
+				inventories[dataset] = &datasetPlan{Err: err}
+				mu.Unlock()
+				return
 			}
-		}
 
-		// HACK: we also are only interested in wind velocities at a
-		// particular pressure. (i.e. ones whose "LayerName" field is of
-		// the form "XXX mb".)
-		saveItem = saveItem && strings.HasSuffix(item.LayerName, " mb")
+			inventory, tries, err := fetchInventoryWithRetries(dataset)
+			if err != nil {
+				log.Print("Error fetching inventory for ", dataset.Identifier, ": ", err)
+			}
 
-		if saveItem {
-			fetchItems = append(fetchItems, item)
-			totalToFetch += item.Extent
+			mu.Lock()
+			inventories[dataset] = &datasetPlan{Items: inventory, Tries: tries, Err: err}
+			mu.Unlock()
+		}(ds)
+	}
+	wg.Wait()
+
+	// Select records from each dataset
+	plans := make(map[*aonui.Dataset]*datasetPlan)
+	for _, ds := range datasets {
+		inv := inventories[ds]
+		plan := &datasetPlan{Tries: inv.Tries, Err: inv.Err}
+		plans[ds] = plan
+		if plan.Err != nil {
+			continue
 		}
+
+		// Records from the dataset, dropping those of a secondary
+		// dataset which duplicate the primary dataset (if any)
+		items := inv.Items
+		if primary := primaries[ds.ForecastHour]; ds.IsSecondary() && primary != nil {
+			primaryInv := inventories[primary]
+			if primaryInv.Err != nil {
+				plan.Err = primaryInv.Err
+				continue
+			}
+			items = aonui.MergeInventories(primaryInv.Items, inv.Items).Filter(
+				func(item *aonui.InventoryItem) bool { return item.Dataset == ds })
+		}
+
+		// Calculate which items to save. Unless asked otherwise, we are
+		// only interested in records at a particular pressure. (i.e.
+		// ones whose "LayerName" field is of the form "XXX mb".)
+		plan.Items = items.WithParameters(paramsOfInterest...).Filter(
+			func(item *aonui.InventoryItem) bool {
+				return syncAllLayers || strings.HasSuffix(item.LayerName, " mb")
+			})
 	}
 
-	if len(fetchItems) == 0 {
+	return plans
+}
+
+// fetchDataset writes the records selected by plan from dataset to output
+// returning the number of bytes written. Fetching the records is retried by
+// FetchAndWriteRecords and abandoned if ctx is cancelled.
+func fetchDataset(ctx context.Context, output io.Writer, dataset *aonui.Dataset, plan *datasetPlan) (int64, error) {
+	if plan.Err != nil {
+		return 0, plan.Err
+	}
+
+	if len(plan.Items) == 0 {
 		log.Print("No items to fetch")
-		return nil
+		return 0, nil
+	}
+
+	var totalToFetch int64
+	for _, item := range plan.Items {
+		totalToFetch += item.Extent
 	}
 
 	log.Print(fmt.Sprintf("Fetching %d records from %v (%v)",
-		len(fetchItems), dataset.Identifier, ByteCount(totalToFetch)))
-	if _, err := dataset.FetchAndWriteRecords(output, fetchItems); err != nil {
-		return err
+		len(plan.Items), dataset.Identifier, ByteCount(totalToFetch)))
+	return aonui.FetchAndWriteMergedRecordsContext(ctx, output, plan.Items)
+}
+
+// fetchInventoryWithRetries fetches the inventory of dataset retrying as
+// specified by the data source's FetchStrategy. Returns the number of tries
+// made. Fetching is abandoned if the run's circuit breaker trips.
+func fetchInventoryWithRetries(dataset *aonui.Dataset) (aonui.Inventory, int, error) {
+	strategy := dataset.Run.Source.FetchStrategy
+
+	// Give up early if too many other datasets of the run have failed
+	breaker := dataset.Run.CircuitBreaker()
+	if err := breaker.Err(); err != nil {
+		return nil, 0, err
 	}
 
-	return nil
+	for tries := 1; ; tries++ {
+		inventory, err := dataset.FetchInventory()
+		if err == nil {
+			breaker.Record(nil)
+			return inventory, tries, nil
+		}
+		if tries >= strategy.MaximumRetries {
+			breaker.Record(err)
+			return nil, tries, err
+		}
+		log.Print("Error fetching inventory for ", dataset.Identifier, ": ", err,
+			" (try ", tries, " of ", strategy.MaximumRetries, ")")
+
+		select {
+		case <-time.After(strategy.RetryDelay(tries - 1)):
+		case <-breaker.Done():
+			return nil, tries, breaker.Err()
+		}
+	}
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rjw57/aonui"
+)
+
+// fileExists returns true if fn exists.
+func fileExists(fn string) bool {
+	_, err := os.Stat(fn)
+	return err == nil
+}
+
+func TestRemoveUnresumableOutput(t *testing.T) {
+	run := &aonui.Run{Identifier: "gfs.2014060100"}
+
+	for _, test := range []struct {
+		Name       string
+		Manifest   *syncManifest // Manifest to write (or nil for none)
+		WantRemove bool
+	}{
+		{Name: "no manifest", WantRemove: true},
+		{
+			Name:       "empty manifest",
+			Manifest:   &syncManifest{Run: run.Identifier, Datasets: map[string]byteRange{}},
+			WantRemove: true,
+		},
+		{
+			Name:       "manifest for another run",
+			Manifest:   &syncManifest{Run: "gfs.2014060106", Datasets: map[string]byteRange{"f000": {Length: 10}}},
+			WantRemove: true,
+		},
+		{
+			Name:     "resumable",
+			Manifest: &syncManifest{Run: run.Identifier, Datasets: map[string]byteRange{"f000": {Length: 10}}},
+		},
+	} {
+		// A partially written output as left by a failed download
+		destFn := filepath.Join(t.TempDir(), "gfs.2014060100.grib2")
+		if err := ioutil.WriteFile(destFn, []byte("GRIB truncated"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if test.Manifest != nil {
+			if err := test.Manifest.Save(manifestFilename(destFn)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		removeUnresumableOutput(destFn, run)
+
+		if removed := !fileExists(destFn); removed != test.WantRemove {
+			t.Errorf("%v: output removed is %v, want %v", test.Name, removed, test.WantRemove)
+		}
+		if test.WantRemove && fileExists(manifestFilename(destFn)) {
+			t.Errorf("%v: manifest left behind", test.Name)
+		}
+	}
+}
+
+func TestFetchDatasetsDataShutdown(t *testing.T) {
+	oldCtx, oldRequest := shutdownCtx, requestShutdown
+	shutdownCtx, requestShutdown = context.WithCancel(context.Background())
+	defer func() { shutdownCtx, requestShutdown = oldCtx, oldRequest }()
+
+	// A shutdown is requested when half of the record has been sent
+	record := "GRIB" + strings.Repeat("x", 96)
+	started, resume := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(record[:50]))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-resume
+		w.Write([]byte(record[50:]))
+	}))
+	defer server.Close()
+	go func() {
+		<-started
+		requestShutdown()
+		close(resume)
+	}()
+
+	u, err := url.Parse(server.URL + "/gfs.t00z.pgrb2.0p50.f000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &aonui.DataSource{FetchStrategy: aonui.FetchStrategy{MaximumRetries: 1}}
+	run := &aonui.Run{Source: src, Identifier: "gfs.2014060100", URL: u}
+	dataset := &aonui.Dataset{Run: run, Identifier: "gfs.t00z.pgrb2.0p50.f000", URL: u}
+	plans := map[*aonui.Dataset]*datasetPlan{
+		dataset: {Items: aonui.Inventory{{RecordNumber: 1, Offset: 0, Extent: 100, Dataset: dataset}}},
+	}
+
+	tfs := TemporaryFileSource{BaseDir: t.TempDir()}
+	var timings timingLog
+	nFetched := 0
+	for fd := range fetchDatasetsData(context.Background(), &tfs, []*aonui.Dataset{dataset}, plans, &timings, make(chan int, 1), nil) {
+		contents, err := ioutil.ReadFile(fd.File.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != record {
+			t.Errorf("fetched %d bytes, want %d", len(contents), len(record))
+		}
+		nFetched++
+	}
+
+	if shutdownCtx.Err() == nil {
+		t.Fatal("shutdown was not requested during the download")
+	}
+	if nFetched != 1 {
+		t.Errorf("%d datasets fetched, want 1", nFetched)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+// Recording of per-dataset download timings
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A datasetTiming records how an individual dataset download went.
+type datasetTiming struct {
+	Identifier   string
+	ForecastHour int
+	Start        time.Time
+	Duration     time.Duration // Total time including retries
+	Bytes        int64
+	Tries        int // Tries needed to fetch the inventory
+	Succeeded    bool
+}
+
+// A timingLog collects datasetTimings from concurrent downloads.
+type timingLog struct {
+	mu      sync.Mutex
+	timings []datasetTiming
+}
+
+// Add records a new timing. It is safe to call from multiple goroutines.
+func (tl *timingLog) Add(t datasetTiming) {
+	tl.mu.Lock()
+	tl.timings = append(tl.timings, t)
+	tl.mu.Unlock()
+}
+
+// Timings returns the recorded timings sorted by forecast hour and then
+// identifier.
+func (tl *timingLog) Timings() []datasetTiming {
+	tl.mu.Lock()
+	timings := append([]datasetTiming(nil), tl.timings...)
+	tl.mu.Unlock()
+
+	sort.Sort(byForecastHour(timings))
+	return timings
+}
+
+// Dump logs a one-line summary of each timing.
+func (tl *timingLog) Dump() {
+	for _, t := range tl.Timings() {
+		status := "ok"
+		if !t.Succeeded {
+			status = "FAILED"
+		}
+		log.Print(fmt.Sprintf("%v: %v in %v, %d tries, %v",
+			t.Identifier, ByteCount(t.Bytes), t.Duration, t.Tries, status))
+	}
+}
+
+// WriteCSVFile writes the timings in CSV format to a new file named fn.
+func (tl *timingLog) WriteCSVFile(fn string) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{
+		"identifier", "forecastHour", "start", "durationSeconds",
+		"bytes", "tries", "succeeded",
+	})
+	for _, t := range tl.Timings() {
+		w.Write([]string{
+			t.Identifier,
+			strconv.Itoa(t.ForecastHour),
+			t.Start.UTC().Format(time.RFC3339),
+			strconv.FormatFloat(t.Duration.Seconds(), 'f', 3, 64),
+			strconv.FormatInt(t.Bytes, 10),
+			strconv.Itoa(t.Tries),
+			strconv.FormatBool(t.Succeeded),
+		})
+	}
+	w.Flush()
+
+	return w.Error()
+}
+
+// byForecastHour is used to sort timings by forecast hour
+type byForecastHour []datasetTiming
+
+func (a byForecastHour) Len() int      { return len(a) }
+func (a byForecastHour) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byForecastHour) Less(i, j int) bool {
+	if a[i].ForecastHour != a[j].ForecastHour {
+		return a[i].ForecastHour < a[j].ForecastHour
+	}
+	return a[i].Identifier < a[j].Identifier
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"compress/gzip"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"os/exec"
+	"strings"
 
 	"github.com/rjw57/aonui"
 )
@@ -14,16 +19,43 @@ import (
 type ByteCount int64
 
 func (bytes ByteCount) String() string {
-	switch {
-	case bytes < 2<<10:
-		return fmt.Sprintf("%dB", bytes)
-	case bytes < 2<<20:
-		return fmt.Sprintf("%dKiB", bytes>>10)
-	case bytes < 2<<30:
-		return fmt.Sprintf("%dMiB", bytes>>20)
-	default:
-		return fmt.Sprintf("%dGiB", bytes>>30)
+	// Format the magnitude with the sign in front
+	sign, magnitude := "", math.Abs(float64(bytes))
+	if bytes < 0 {
+		sign = "-"
+	}
+
+	if magnitude < 1<<10 {
+		return fmt.Sprintf("%v%.0fB", sign, magnitude)
+	}
+
+	// Pick the unit after rounding so that values just below a threshold
+	// are not printed as, e.g., "1024.0KiB"
+	value := magnitude / (1 << 10)
+	for _, unit := range []string{"KiB", "MiB"} {
+		if math.Round(value*10) < 1024*10 {
+			return fmt.Sprintf("%v%.1f%v", sign, value, unit)
+		}
+		value /= 1 << 10
 	}
+	return fmt.Sprintf("%v%.1fGiB", sign, value)
+}
+
+// lookupSource returns the data source with the given name. If highRes is
+// true, the 0.25 degree GFS source is returned irrespective of name. If there
+// is no such source, the error lists the known sources.
+func lookupSource(name string, highRes bool) (*aonui.DataSource, error) {
+	if highRes {
+		name = "gfs-0p25"
+	}
+
+	src, ok := aonui.DataSources[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown source %q, known sources are: %v",
+			name, strings.Join(aonui.DataSourceNames(), ", "))
+	}
+
+	return src, nil
 }
 
 // ByDate is used to sort runs by date
@@ -96,3 +128,135 @@ func (tfs *TemporaryFileSource) RemoveAll() error {
 
 	return lastErr
 }
+
+// A pipeOutput is an io.WriteCloser which writes to the standard input of a
+// command.
+type pipeOutput struct {
+	w    *io.PipeWriter
+	done chan error
+
+	closed   bool
+	closeErr error
+}
+
+// startPipeOutput starts the shell command cmdLine and returns a pipeOutput
+// writing to its standard input.
+func startPipeOutput(cmdLine string) (*pipeOutput, error) {
+	return startCommandOutput(exec.Command("sh", "-c", cmdLine))
+}
+
+// startCommandOutput starts cmd and returns a pipeOutput writing to its
+// standard input. The command's standard output and error default to ours.
+func startCommandOutput(cmd *exec.Cmd) (*pipeOutput, error) {
+	r, w := io.Pipe()
+
+	cmd.Stdin = r
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// Wait for the command in the background. If the command exits before
+	// all input has been written, unblock any pending writes.
+	po := &pipeOutput{w: w, done: make(chan error, 1)}
+	go func() {
+		err := cmd.Wait()
+		r.CloseWithError(errors.New("consumer command exited"))
+		po.done <- err
+	}()
+
+	return po, nil
+}
+
+func (po *pipeOutput) Write(p []byte) (int, error) {
+	return po.w.Write(p)
+}
+
+// Close signals end of input to the command and waits for it to exit. The
+// command's exit status is reported as an *exec.ExitError. Subsequent calls
+// return the same result.
+func (po *pipeOutput) Close() error {
+	if !po.closed {
+		po.w.Close()
+		po.closeErr = <-po.done
+		po.closed = true
+	}
+	return po.closeErr
+}
+
+// Suffixes appended to the names of files compressed with each supported
+// compression method.
+var compressionSuffixes = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// checkCompression returns an error if method is not a supported compression
+// method or the tool it needs is not installed.
+func checkCompression(method string) error {
+	if _, ok := compressionSuffixes[method]; !ok {
+		return fmt.Errorf("unknown compression method: %v", method)
+	}
+	if method == "zstd" {
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return errors.New("zstd not found")
+		}
+	}
+	return nil
+}
+
+// A compressedOutput is an io.WriteCloser which compresses data written to it
+// into a file.
+type compressedOutput struct {
+	io.WriteCloser // Compressor writing to f
+	f              *os.File
+
+	closed   bool
+	closeErr error
+}
+
+// createCompressedOutput creates destFn and returns a compressedOutput which
+// writes to it compressed with method. Gzip compression is done in-process
+// while zstd compression uses the external zstd command.
+func createCompressedOutput(destFn string, method string) (*compressedOutput, error) {
+	f, err := os.Create(destFn)
+	if err != nil {
+		return nil, err
+	}
+
+	co := &compressedOutput{f: f}
+	switch method {
+	case "gzip":
+		co.WriteCloser = gzip.NewWriter(f)
+	case "zstd":
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdout = f
+		co.WriteCloser, err = startCommandOutput(cmd)
+	default:
+		err = fmt.Errorf("unknown compression method: %v", method)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return co, nil
+}
+
+// Close flushes any compressed data and closes the file. Subsequent calls
+// return the same result.
+func (co *compressedOutput) Close() error {
+	if !co.closed {
+		if err := co.WriteCloser.Close(); err != nil {
+			co.closeErr = fmt.Errorf("error compressing output: %v", err)
+		}
+		if err := co.f.Close(); err != nil && co.closeErr == nil {
+			co.closeErr = err
+		}
+		co.closed = true
+	}
+	return co.closeErr
+}
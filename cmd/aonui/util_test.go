@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestByteCountString(t *testing.T) {
+	for _, tc := range []struct {
+		bytes ByteCount
+		want  string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KiB"},
+		{-1024, "-1.0KiB"},
+		{1536, "1.5KiB"},
+		{1<<20 - 52, "1023.9KiB"},
+		{1<<20 - 51, "1.0MiB"},
+		{1<<20 - 1, "1.0MiB"},
+		{1 << 20, "1.0MiB"},
+		{-(1<<20 - 1), "-1.0MiB"},
+		{1<<30 - 1, "1.0GiB"},
+		{1 << 30, "1.0GiB"},
+		{5 << 40, "5120.0GiB"},
+	} {
+		if got := tc.bytes.String(); got != tc.want {
+			t.Errorf("ByteCount(%d).String() = %q, want %q", int64(tc.bytes), got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+// Compare the values of a single record between two GRIB2 files
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/rjw57/aonui"
+)
+
+var cmdValueDiff = &Command{
+	UsageLine: "valuediff [flags] gribfileA gribfileB",
+	Short:     "compare data values of a record in two GRIB2 files",
+	Long: `
+Valuediff extracts a single record from each of gribfileA and gribfileB and
+prints statistics on the difference between them. The difference is computed
+as B - A at each grid point. This is useful for quantifying how much one run
+of the GFS changed relative to another.
+
+The record is selected by parameter, pressure and forecast hour via the -param,
+-pressure and -fcsthour flags. The defaults select UGRD at 500 mb for forecast
+hour 0. Output has the following form:
+
+	MEAN=0.1234
+	RMS=2.3456
+	MIN=-12.5
+	MAX=14.25
+	MAXABSDIFF=14.25
+	MAXABSDIFFX=312
+	MAXABSDIFFY=201
+
+MAXABSDIFFX and MAXABSDIFFY give the column and row of the grid point with the
+largest absolute difference. Columns are numbered West-to-East and rows
+South-to-North starting from zero.
+
+Both files must have the same grid shape.
+`,
+}
+
+// Command-line flags
+var (
+	valueDiffParam    string
+	valueDiffPressure int
+	valueDiffFcstHour int
+)
+
+func init() {
+	cmdValueDiff.Run = runValueDiff // break init cycle
+	cmdValueDiff.Flag.StringVar(&valueDiffParam, "param", "UGRD",
+		"parameter to compare")
+	cmdValueDiff.Flag.IntVar(&valueDiffPressure, "pressure", 500,
+		"pressure in mb of record to compare")
+	cmdValueDiff.Flag.IntVar(&valueDiffFcstHour, "fcsthour", 0,
+		"forecast hour of record to compare")
+}
+
+func runValueDiff(cmd *Command, args []string) {
+	if len(args) != 2 {
+		log.Print("error: exactly two GRIB files must be specified")
+		setExitStatus(1)
+		return
+	}
+
+	// Make sure we can process GRIBs before doing any work. Grids are
+	// always decoded with wgrib2.
+	if err := aonui.CheckWgrib2(); err != nil {
+		log.Print("error: ", err)
+		setExitStatus(1)
+		return
+	}
+
+	// Read matching grid from each file
+	var grids []*aonui.Grid
+	for _, gribFn := range args {
+		grid, err := readMatchingGrid(gribFn)
+		if err != nil {
+			log.Print("error reading ", gribFn, ": ", err)
+			setExitStatus(1)
+			return
+		}
+		grids = append(grids, grid)
+	}
+
+	a, b := grids[0], grids[1]
+	if a.Shape != b.Shape {
+		log.Print("error: grid shapes differ: ", a.Shape, " vs ", b.Shape)
+		setExitStatus(1)
+		return
+	}
+
+	stats := diffGrids(a, b)
+	stats.Dump()
+}
+
+// readMatchingGrid finds the record in gribFn matching the parameter,
+// pressure and forecast hour flags and decodes it.
+func readMatchingGrid(gribFn string) (*aonui.Grid, error) {
+	inv, err := aonui.TawhiriOrderedInventory(gribFn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tw := range aonui.ToTawhiris(inv) {
+		if tw.ForecastHour != valueDiffFcstHour || tw.Pressure != valueDiffPressure {
+			continue
+		}
+		for _, p := range tw.Item.Parameters {
+			if p == valueDiffParam {
+				return aonui.Wgrib2ReadGrid(tw.Item, gribFn)
+			}
+		}
+	}
+
+	return nil, errors.New("no matching record found")
+}
+
+// diffStats holds statistics on the difference between two grids
+type diffStats struct {
+	Mean, RMS, Min, Max float64
+	MaxAbsDiff          float64
+	MaxAbsX, MaxAbsY    int
+}
+
+// diffGrids computes statistics of the field b - a. The grids must have the
+// same shape.
+func diffGrids(a, b *aonui.Grid) diffStats {
+	stats := diffStats{Min: math.Inf(1), Max: math.Inf(-1)}
+
+	var sum, sumSq float64
+	for idx := range a.Values {
+		d := float64(b.Values[idx]) - float64(a.Values[idx])
+		sum += d
+		sumSq += d * d
+		stats.Min = math.Min(stats.Min, d)
+		stats.Max = math.Max(stats.Max, d)
+
+		if math.Abs(d) > stats.MaxAbsDiff {
+			stats.MaxAbsDiff = math.Abs(d)
+			stats.MaxAbsX = idx % a.Shape.Columns
+			stats.MaxAbsY = idx / a.Shape.Columns
+		}
+	}
+
+	if n := float64(len(a.Values)); n > 0 {
+		stats.Mean = sum / n
+		stats.RMS = math.Sqrt(sumSq / n)
+	}
+
+	return stats
+}
+
+func (s diffStats) Dump() {
+	fmt.Printf("MEAN=%v\n", s.Mean)
+	fmt.Printf("RMS=%v\n", s.RMS)
+	fmt.Printf("MIN=%v\n", s.Min)
+	fmt.Printf("MAX=%v\n", s.Max)
+	fmt.Printf("MAXABSDIFF=%v\n", s.MaxAbsDiff)
+	fmt.Printf("MAXABSDIFFX=%d\n", s.MaxAbsX)
+	fmt.Printf("MAXABSDIFFY=%d\n", s.MaxAbsY)
+}
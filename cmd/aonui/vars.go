@@ -0,0 +1,86 @@
+package main
+
+// List the distinct variables in a GRIB2 file
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rjw57/aonui"
+)
+
+var varsDumpJson bool
+
+var cmdVars = &Command{
+	UsageLine: "vars [-json] gribfile",
+	Short:     "list the parameters and layers in a GRIB2 file",
+	Long: `
+Vars lists each distinct combination of parameter, layer and type found in the
+inventory of the GRIB2 file gribfile along with the number of records it
+appears in. Unlike "aonui inv" and "aonui info", no records are filtered out
+and no assumptions are made about Tawhiri's conventions so vars can be used to
+discover what a file contains. Output has the following form:
+
+	PARAM  LAYER              TYPE         COUNT
+	HGT    1000 mb            anl          1
+	HGT    1000 mb            3 hour fcst  1
+	UGRD   10 m above ground  anl          1
+
+The output is sorted by parameter, layer and type. A record with more than one
+parameter counts towards each of them.
+
+If the -json flag is specified, a JSON array with one object per combination
+is written instead. Each object has the keys parameter, layer, type and count.
+
+See also: aonui help inv
+`,
+}
+
+func init() {
+	cmdVars.Run = runVars // break init cycle
+	cmdVars.Flag.BoolVar(&varsDumpJson, "json", false,
+		"dump variables in JSON format")
+}
+
+func runVars(cmd *Command, args []string) {
+	if len(args) != 1 {
+		log.Print("error: no GRIB file specified")
+		setExitStatus(2)
+		return
+	}
+	gribFn := args[0]
+
+	// Make sure we can process GRIBs before doing any work
+	if err := aonui.GribBackend.Check(); err != nil {
+		log.Print("error: ", err)
+		setExitStatus(1)
+		return
+	}
+
+	inv, err := aonui.GribBackend.Inventory(gribFn)
+	if err != nil {
+		log.Print("error: ", err)
+		setExitStatus(1)
+		return
+	}
+	vars := inv.Variables()
+
+	if varsDumpJson {
+		je := json.NewEncoder(os.Stdout)
+		if err := je.Encode(vars); err != nil {
+			log.Print("error writing json: ", err)
+			setExitStatus(1)
+		}
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PARAM\tLAYER\tTYPE\tCOUNT")
+	for _, v := range vars {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%d\n", v.Parameter, v.LayerName, v.TypeName, v.Count)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,180 @@
+package main
+
+// Check a GRIB2 file contains every record expected
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/rjw57/aonui"
+)
+
+// Command-line flags
+var (
+	verifyMinHour   int
+	verifyMaxHour   int
+	verifyStep      int
+	verifyPressures StringListValue
+	verifyParams    StringListValue = []string{"HGT", "UGRD", "VGRD"}
+	verifySource    string
+)
+
+var cmdVerify = &Command{
+	UsageLine: "verify [flags] gribfile",
+	Short:     "check a GRIB2 file has every expected record",
+	Long: `
+Verify checks that the GRIB2 file gribfile contains a record for every
+combination of forecast hour, pressure and parameter expected. Each missing
+combination is printed to standard output in the following form:
+
+	MISSING FCSTHOUR=27 PRESSURE=500 PARAM=UGRD
+
+If any records are missing, verify exits with a non-zero status.
+
+The expected forecast hours are those from -minhour to -maxhour inclusive in
+steps of -step. The defaults of 0, 192 and 3 match the hours downloaded by
+"aonui sync" from the 0.5 degree GFS. If the -source flag names a data source,
+such as "gfs-0p25", the forecast hours published by that source are expected
+instead and -minhour, -maxhour and -step are ignored. This allows for sources
+whose forecast hours are not evenly spaced. (See "aonui help sync" for the
+names of data sources.) The -pressures flag gives a
+comma-separated list of expected pressures in mb. It defaults to the isobaric
+levels published by the -source or, if no source is given or the source's
+levels are unknown, those of the 0.5 degree GFS. Pressures with no records at
+all are also logged. The -params flag gives a comma-separated list of expected
+parameters and defaults to HGT, UGRD and VGRD.
+
+Only records used by Tawhiri are considered. (See "aonui help tawhiri".)
+
+See also: aonui help info
+`,
+}
+
+func init() {
+	cmdVerify.Run = runVerify // break init cycle
+	cmdVerify.Flag.IntVar(&verifyMinHour, "minhour", 0,
+		"first expected forecast hour")
+	cmdVerify.Flag.IntVar(&verifyMaxHour, "maxhour", 192,
+		"last expected forecast hour")
+	cmdVerify.Flag.IntVar(&verifyStep, "step", 3,
+		"interval in hours between expected forecast hours")
+	cmdVerify.Flag.StringVar(&verifySource, "source", "",
+		"name of data source whose forecast hours are expected")
+
+	cmdVerify.Flag.Var(&verifyPressures, "pressures",
+		"list of expected pressures in mb (default: those of -source)")
+	cmdVerify.Flag.Var(&verifyParams, "params", "list of expected parameters")
+}
+
+// A verifyKey identifies a record by forecast hour, pressure and parameter.
+type verifyKey struct {
+	ForecastHour, Pressure int
+	Parameter              string
+}
+
+func runVerify(cmd *Command, args []string) {
+	if len(args) != 1 {
+		log.Print("error: no GRIB file specified")
+		setExitStatus(2)
+		return
+	}
+	gribFn := args[0]
+
+	// Forecast hours and pressures expected
+	var hours []int
+	levelSrc := &aonui.GFSHalfDegreeDataset
+	if verifySource != "" {
+		src, err := lookupSource(verifySource, false)
+		if err != nil {
+			log.Print("error: ", err)
+			setExitStatus(2)
+			return
+		}
+		if src.PressureLevels != nil {
+			levelSrc = src
+		}
+		if hours = src.ExpectedForecastHours(); hours == nil {
+			log.Print("error: forecast hours of ", verifySource, " are unknown")
+			setExitStatus(2)
+			return
+		}
+	} else {
+		if verifyStep < 1 {
+			log.Print("error: step must be at least 1")
+			setExitStatus(2)
+			return
+		}
+		for fh := verifyMinHour; fh <= verifyMaxHour; fh += verifyStep {
+			hours = append(hours, fh)
+		}
+	}
+
+	var pressures []int
+	for _, s := range verifyPressures {
+		p, err := strconv.Atoi(s)
+		if err != nil {
+			log.Print("error: invalid pressure: ", s)
+			setExitStatus(2)
+			return
+		}
+		pressures = append(pressures, p)
+	}
+	if pressures != nil {
+		levelSrc = &aonui.DataSource{PressureLevels: pressures}
+	}
+	pressures = levelSrc.PressureLevels
+
+	// Make sure we can process GRIBs before doing any work
+	if err := aonui.GribBackend.Check(); err != nil {
+		log.Print("error: ", err)
+		setExitStatus(1)
+		return
+	}
+
+	inv, err := aonui.GribBackend.Inventory(gribFn)
+	if err != nil {
+		log.Print("error: ", err)
+		setExitStatus(1)
+		return
+	}
+
+	// Record which records are present
+	present := make(map[verifyKey]bool)
+	var filePressures []int
+	for _, tw := range aonui.ToTawhiris(inv) {
+		if !tw.IsValid {
+			continue
+		}
+		filePressures = append(filePressures, tw.Pressure)
+		for _, param := range tw.Item.Parameters {
+			present[verifyKey{tw.ForecastHour, tw.Pressure, param}] = true
+		}
+	}
+
+	// Pressures with no records at all usually mean a level was not downloaded
+	if missing := levelSrc.MissingPressureLevels(filePressures); len(missing) > 0 {
+		log.Print(gribFn, " has no records at pressure(s) ", missing)
+	}
+
+	// Report those which are missing
+	nMissing := 0
+	for _, fh := range hours {
+		for _, pressure := range pressures {
+			for _, param := range verifyParams {
+				if present[verifyKey{fh, pressure, param}] {
+					continue
+				}
+				fmt.Printf("MISSING FCSTHOUR=%d PRESSURE=%d PARAM=%v\n", fh, pressure, param)
+				nMissing++
+			}
+		}
+	}
+
+	if nMissing > 0 {
+		log.Print(gribFn, " is missing ", nMissing, " record(s)")
+		setExitStatus(1)
+		return
+	}
+	log.Print(gribFn, " has every expected record")
+}
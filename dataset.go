@@ -3,12 +3,21 @@
 package aonui
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,39 +28,256 @@ type Dataset struct {
 	URL            *url.URL
 	TypeIdentifier string
 	ForecastHour   int
+	Member         string // Ensemble member (or "" if not part of an ensemble)
+	Length         int64  // Length in bytes given by the run's listing (or 0 if unknown)
+}
+
+// IsSecondary returns true if the dataset is one of the GFS "pgrb2b" files
+// holding secondary parameters. Some records in secondary files duplicate
+// those in the corresponding primary "pgrb2" file.
+func (ds *Dataset) IsSecondary() bool {
+	return strings.HasPrefix(ds.TypeIdentifier, "pgrb2b")
 }
 
 // FetchInventory will fetch and parse the GRIB inventory associated with a Dataset. The inventory URL is constructed from the Dataset URL and is not guaranteed to exist.
+// A gzip-compressed inventory at GzipInventoryURL is used in preference to the
+// one at InventoryURL if the server has one. Hosts found not to have one are
+// remembered and not asked again. See also SetInventoryCacheDir.
+//
+// The length of the dataset is needed to parse the inventory. It is taken from
+// ds.Length if the run's listing gave it and is otherwise fetched first with a
+// HEAD request. Use FetchInventoryWithLength if the length is known some other
+// way.
 func (ds *Dataset) FetchInventory() (Inventory, error) {
-	// Fetch headers for the actual dataset. This is required to get the
-	// complete length.
-	resp, err := http.Head(ds.URL.String())
+	if ds.Length > 0 {
+		return ds.FetchInventoryWithLength(ds.Length)
+	}
+	datasetLength, err := ds.FetchLength()
 	if err != nil {
 		return nil, err
 	}
+	return ds.FetchInventoryWithLength(datasetLength)
+}
+
+// FetchLength fetches the length in bytes of the dataset from the
+// Content-Length the server gives in reply to a HEAD request.
+func (ds *Dataset) FetchLength() (int64, error) {
+	strategy := ds.Run.Source.FetchStrategy
+	client, err := strategy.client(strategy.indexTimeout())
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := strategy.newRequest(context.Background(), "HEAD", ds.URL.String())
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP error when fetching dataset headers: %d",
+		return 0, fmt.Errorf("HTTP error when fetching dataset headers: %d",
 			resp.StatusCode)
 	}
 
-	// Record and verify the content length
-	datasetLength := resp.ContentLength
+	if resp.ContentLength < 0 {
+		return 0, errors.New("server did not give Content-Length for dataset")
+	}
+	return resp.ContentLength, nil
+}
+
+// FetchInventoryWithLength is like FetchInventory but datasetLength, the
+// length in bytes of the dataset, is given by the caller, e.g. from an earlier
+// listing or a value it has cached, which saves a request to the server. If
+// the inventory is in the cache, no requests are made at all. The length is
+// not checked against the server so an incorrect length gives an incorrect
+// Extent for the last record.
+func (ds *Dataset) FetchInventoryWithLength(datasetLength int64) (Inventory, error) {
 	if datasetLength < 0 {
-		return nil, errors.New("server did not give Content-Length for dataset")
+		return nil, fmt.Errorf("invalid dataset length %d", datasetLength)
 	}
 
-	// Fetch the inventory
-	resp, err = http.Get(ds.InventoryURL().String())
+	// Use the cached inventory if we have one
+	if inv := loadCachedInventory(ds.URL.String(), datasetLength); inv != nil {
+		ds.annotate(inv)
+		return inv, nil
+	}
+
+	strategy := ds.Run.Source.FetchStrategy
+	client, err := strategy.client(strategy.indexTimeout())
 	if err != nil {
 		return nil, err
 	}
+
+	// Fetch the inventory, preferring the compressed version if the server
+	// may have one
+	var inv Inventory
+	host := ds.URL.Host
+	if !noGzipInventories.Has(host) {
+		var unavailable bool
+		inv, unavailable, err = ds.fetchInventoryFrom(client, ds.GzipInventoryURL(), datasetLength)
+		if unavailable {
+			logger().Debugf("No usable compressed inventories on %v: %v", host, err)
+			noGzipInventories.Add(host)
+		}
+	}
+	if inv == nil {
+		if inv, _, err = ds.fetchInventoryFrom(client, ds.InventoryURL(), datasetLength); err != nil {
+			return nil, err
+		}
+	}
+
+	// Cache inventory. Failing to do so is not fatal.
+	if err := saveCachedInventory(ds.URL.String(), datasetLength, inv); err != nil {
+		logger().Warnf("Error caching inventory for %v: %v", ds.Identifier, err)
+	}
+
+	ds.annotate(inv)
+	return inv, nil
+}
+
+// fetchInventoryFrom fetches and parses the inventory at invURL decompressing
+// it if necessary. If the server does not have the inventory or it could not
+// be decompressed, unavailable is true.
+func (ds *Dataset) fetchInventoryFrom(client *http.Client, invURL *url.URL, datasetLength int64) (inv Inventory, unavailable bool, err error) {
+	resp, err := ds.Run.Source.FetchStrategy.get(client, invURL.String())
+	if err != nil {
+		return nil, false, err
+	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP error when fetching inventory: %d", resp.StatusCode)
+		return nil, true, fmt.Errorf("HTTP error when fetching inventory: %d", resp.StatusCode)
+	}
+
+	// Decompress the inventory if necessary. The transport will already
+	// have done so if it asked for a compressed response itself.
+	var body io.Reader = resp.Body
+	if !resp.Uncompressed && (strings.HasSuffix(invURL.Path, ".gz") ||
+		resp.Header.Get("Content-Encoding") == "gzip") {
+		gzBody, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, true, fmt.Errorf("error decompressing inventory: %v", err)
+		}
+		defer gzBody.Close()
+		body = gzBody
+	}
+
+	inv, err = ParseInventory(body, datasetLength)
+	return inv, false, err
+}
+
+// A hostSet is a set of hosts which is safe for concurrent use.
+type hostSet struct {
+	mu    sync.Mutex
+	hosts map[string]bool
+}
+
+// Add adds host to the set.
+func (s *hostSet) Add(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hosts == nil {
+		s.hosts = make(map[string]bool)
+	}
+	s.hosts[host] = true
+}
+
+// Has reports whether host is in the set.
+func (s *hostSet) Has(host string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hosts[host]
+}
+
+// Hosts which do not provide compressed inventories. Remembering them saves a
+// request for each dataset.
+var noGzipInventories hostSet
+
+// annotate records ds as the dataset each item of inv was fetched from.
+func (ds *Dataset) annotate(inv Inventory) {
+	for _, item := range inv {
+		item.Dataset = ds
+	}
+}
+
+// FetchMergedInventory fetches the inventories of the primary and secondary
+// datasets for a forecast hour, e.g. the GFS "pgrb2" and "pgrb2b" files, and
+// merges them with MergeInventories. Each record's Dataset is the dataset it
+// is to be fetched from.
+// Use FetchAndWriteMergedRecords to fetch records from the merged inventory.
+func FetchMergedInventory(primary, secondary *Dataset) (Inventory, error) {
+	if primary.ForecastHour != secondary.ForecastHour {
+		return nil, fmt.Errorf("cannot merge datasets with forecast hours %d and %d",
+			primary.ForecastHour, secondary.ForecastHour)
+	}
+
+	primaryInv, err := primary.FetchInventory()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching inventory for %v: %v", primary.Identifier, err)
+	}
+	secondaryInv, err := secondary.FetchInventory()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching inventory for %v: %v", secondary.Identifier, err)
+	}
+
+	return MergeInventories(primaryInv, secondaryInv), nil
+}
+
+// MergeInventories merges the inventories of the primary and secondary
+// datasets for a forecast hour. The records of primary come first followed by
+// those of secondary whose Key is not that of any record of primary.
+func MergeInventories(primary, secondary Inventory) Inventory {
+	inPrimary := make(map[string]bool)
+	for _, item := range primary {
+		inPrimary[item.Key()] = true
+	}
+
+	merged := append(Inventory{}, primary...)
+	for _, item := range secondary {
+		if !inPrimary[item.Key()] {
+			merged = append(merged, item)
+		}
 	}
+	return merged
+}
 
-	// Parse inventory
-	return ParseInventory(resp.Body, datasetLength)
+// FetchAndWriteMergedRecords writes records, which may come from several
+// datasets, to output in order. Each run of consecutive records from the same
+// dataset is fetched with that dataset's FetchAndWriteRecords. Every record
+// must have its Dataset set, as it is for those returned by FetchInventory
+// and FetchMergedInventory. If fetching fails part way through, the records
+// from earlier datasets will already have been written to output.
+func FetchAndWriteMergedRecords(output io.Writer, records Inventory) (int64, error) {
+	return FetchAndWriteMergedRecordsContext(context.Background(), output, records)
+}
+
+// FetchAndWriteMergedRecordsContext is like FetchAndWriteMergedRecords but
+// fetching is abandoned if ctx is cancelled.
+func FetchAndWriteMergedRecordsContext(ctx context.Context, output io.Writer, records Inventory) (int64, error) {
+	for _, item := range records {
+		if item.Dataset == nil {
+			return 0, fmt.Errorf("record %d has no dataset to fetch it from", item.RecordNumber)
+		}
+	}
+
+	var nWritten int64
+	for start := 0; start < len(records); {
+		ds := records[start].Dataset
+		end := start + 1
+		for end < len(records) && records[end].Dataset == ds {
+			end++
+		}
+
+		n, err := ds.fetchAndWriteRecords(ctx, output, records[start:end], nil)
+		nWritten += n
+		if err != nil {
+			return nWritten, fmt.Errorf("error fetching records from %v: %v", ds.Identifier, err)
+		}
+		start = end
+	}
+	return nWritten, nil
 }
 
 // InventoryURL will return the URL which is *assumed* to point to the
@@ -62,32 +288,172 @@ func (ds *Dataset) InventoryURL() *url.URL {
 	return &inURL
 }
 
+// GzipInventoryURL will return the URL which is *assumed* to point to a
+// gzip-compressed version of the inventory. Not all servers provide one.
+func (ds *Dataset) GzipInventoryURL() *url.URL {
+	inURL := ds.InventoryURL()
+	inURL.Path = inURL.Path + ".gz"
+	return inURL
+}
+
 // FetchAndWriteRecords fetches a set of records from an individual dataset and
 // writes them sequentially to an io.Writer.
 func (ds *Dataset) FetchAndWriteRecords(output io.Writer, records []*InventoryItem) (int64, error) {
-	// Create a new HTTP client since we'll be adding custom headers
-	client := new(http.Client)
+	return ds.FetchAndWriteRecordsProgress(output, records, nil)
+}
+
+// FetchAndWriteRecordsProgress is like FetchAndWriteRecords but calls progress
+// after each write to output with the number of bytes written so far and the
+// total number of bytes in records. If progress is nil, it is not called.
+// Records with ExtentUnknown set cannot be fetched and an error is returned
+// without fetching anything if there are any.
+//
+// Failed fetches are retried as specified by the data source's FetchStrategy.
+// If the run's CircuitBreaker trips, ErrTooManyFailures is returned without
+// further tries. Before retrying, any partial output is discarded by
+// truncating output if it is an *os.File which can seek. If partial output
+// was written to any other io.Writer, such as a pipe, it cannot be rewound and
+// an error is returned instead.
+func (ds *Dataset) FetchAndWriteRecordsProgress(output io.Writer, records []*InventoryItem,
+	progress func(written, total int64)) (int64, error) {
+	return ds.fetchAndWriteRecords(context.Background(), output, records, progress)
+}
+
+// FetchAndWriteRecordsContext is like FetchAndWriteRecords but fetching is
+// abandoned if ctx is cancelled.
+func (ds *Dataset) FetchAndWriteRecordsContext(ctx context.Context, output io.Writer, records []*InventoryItem) (int64, error) {
+	return ds.fetchAndWriteRecords(ctx, output, records, nil)
+}
+
+// fetchAndWriteRecords implements FetchAndWriteRecordsProgress. Fetching is
+// abandoned if ctx is cancelled. Being cancelled is not counted as a failure
+// by the run's CircuitBreaker.
+func (ds *Dataset) fetchAndWriteRecords(ctx context.Context, output io.Writer, records []*InventoryItem,
+	progress func(written, total int64)) (int64, error) {
+	strategy := ds.Run.Source.FetchStrategy
+	nTries := strategy.MaximumRetries
+	if nTries < 1 {
+		nTries = 1
+	}
+
+	// Record where output starts so that it may be rewound on failure. A file
+	// which cannot seek, such as a pipe, is treated like any other writer.
+	file, canRewind := output.(*os.File)
+	var fileStart int64
+	if canRewind {
+		var err error
+		if fileStart, err = file.Seek(0, io.SeekCurrent); err != nil {
+			canRewind = false
+		}
+	}
+
+	// Count bytes written and report progress
+	var total int64
+	for _, r := range records {
+		if r.ExtentUnknown {
+			return 0, fmt.Errorf("record %d has unknown extent and cannot be fetched",
+				r.RecordNumber)
+		}
+		total += r.Extent
+	}
+	pw := &progressWriter{W: output, Total: total, Progress: progress}
+
+	// Give up early if too many other datasets of the run have failed
+	breaker := ds.Run.CircuitBreaker()
+	if err := breaker.Err(); err != nil {
+		return 0, err
+	}
+
+	for try := 0; ; try++ {
+		nWritten, err := ds.fetchRecords(ctx, pw, records)
 
-	// Create specific request
-	req, err := http.NewRequest("GET", ds.URL.String(), nil)
+		// A server may close the connection early without an error
+		// and so check nothing was lost
+		if err == nil && nWritten != total {
+			err = fmt.Errorf("fetched %d bytes, expected %d", nWritten, total)
+		}
+
+		if err == nil {
+			breaker.Record(nil)
+			return nWritten, nil
+		}
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if try+1 >= nTries {
+			err = fmt.Errorf("giving up after %d tries: %v", nTries, err)
+			breaker.Record(err)
+			return 0, err
+		}
+		logger().Warnf("Error fetching records from %v: %v. Retrying.", ds.Identifier, err)
+
+		// Discard partial output
+		if pw.Written > 0 {
+			if !canRewind {
+				return 0, fmt.Errorf("cannot rewind output after failed fetch: %v", err)
+			}
+			if err := file.Truncate(fileStart); err != nil {
+				return 0, err
+			}
+			if _, err := file.Seek(fileStart, io.SeekStart); err != nil {
+				return 0, err
+			}
+			pw.Written = 0
+		}
+
+		select {
+		case <-time.After(strategy.RetryDelay(try)):
+		case <-breaker.Done():
+			return 0, breaker.Err()
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// fetchRecords makes a single attempt at fetching records from the dataset
+// and writing them to output. The fetch is abandoned if ctx is cancelled.
+func (ds *Dataset) fetchRecords(ctx context.Context, output io.Writer, records []*InventoryItem) (int64, error) {
+	// Wait our turn if the number of fetches from the host is limited. The
+	// limit is per try so that sleeping before a retry does not hold up
+	// other datasets.
+	if sem := ds.Run.Source.FetchStrategy.hostSemaphore(ds.URL.Host); sem != nil {
+		sem <- 1
+		defer func() { <-sem }()
+	}
+
+	// Get an HTTP client configured by the fetch strategy. Its connections are
+	// pooled and re-used by later fetches.
+	client, err := ds.Run.Source.FetchStrategy.client(0)
+	if err != nil {
+		return 0, err
+	}
+
+	// Create specific request. The request is cancelled on timeout.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := ds.Run.Source.FetchStrategy.newRequest(ctx, "GET", ds.URL.String())
 	if err != nil {
 		return 0, err
 	}
 
 	// Add a Range header to request specifying which bytes we require.
 	rangeSpecs := []string{}
-	for _, r := range records {
+	for _, r := range coalesceRecords(records) {
 		// Note that the range is *inclusive*.
-		rangeSpec := fmt.Sprintf("%d-%d", r.Offset, r.Offset+r.Extent-1)
+		rangeSpec := fmt.Sprintf("%d-%d", r.First, r.Last)
 		rangeSpecs = append(rangeSpecs, rangeSpec)
 	}
 	req.Header.Add("Range", "bytes="+strings.Join(rangeSpecs, ","))
 
-	// We perform request and copy in a separate goroutine and also have a
-	// timeout. Set the timeout from the fetch strategy.
-	timeout := make(chan bool, 1)
+	// We perform request and copy in a separate goroutine and also have
+	// timeouts. The fetch times out if no data is received for the strategy's
+	// FetchTimeout or if it takes longer than MaxFetchDuration overall.
+	strategy := ds.Run.Source.FetchStrategy
 	fetchErr := make(chan error, 1)
 	done := make(chan int64, 1)
+	activity := &activityBody{}
+	activity.Touch()
 
 	go func() {
 		// Fire off request
@@ -105,8 +471,27 @@ func (ds *Dataset) FetchAndWriteRecords(output io.Writer, records []*InventoryIt
 			return
 		}
 
-		// Everything looks good, start copying
-		nWritten, err := io.Copy(output, resp.Body)
+		// Throttle the download if asked
+		if limiter := strategy.limiter(); limiter != nil {
+			resp.Body = &rateLimitedBody{ReadCloser: resp.Body, Limiter: limiter}
+		}
+
+		// Record when data is received
+		activity.ReadCloser = resp.Body
+		resp.Body = activity
+
+		// Everything looks good, start copying. The ranges are sent in
+		// offset order and so, if the records are not, the response is
+		// buffered and then written in the order of records.
+		var nWritten int64
+		if sort.SliceIsSorted(records, func(i, j int) bool { return records[i].Offset < records[j].Offset }) {
+			nWritten, err = copyPartialContent(output, resp, strategy.CheckGribMagic)
+		} else {
+			var buf bytes.Buffer
+			if _, err = copyPartialContent(&buf, resp, strategy.CheckGribMagic); err == nil {
+				nWritten, err = scatterRecords(output, buf.Bytes(), records)
+			}
+		}
 		if err != nil {
 			fetchErr <- err
 			return
@@ -116,21 +501,242 @@ func (ds *Dataset) FetchAndWriteRecords(output io.Writer, records []*InventoryIt
 		done <- nWritten
 	}()
 
-	// Start timeout
-	go func() {
-		time.Sleep(ds.Run.Source.FetchStrategy.FetchTimeout)
-		timeout <- true
-	}()
+	// Periodically check for a stalled fetch
+	var stallCheck <-chan time.Time
+	if strategy.FetchTimeout > 0 {
+		interval := strategy.FetchTimeout / 10
+		if interval < minStallCheckInterval {
+			interval = minStallCheckInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		stallCheck = ticker.C
+	}
+
+	// Start overall timeout
+	var deadline <-chan time.Time
+	if strategy.MaxFetchDuration > 0 {
+		timer := time.NewTimer(strategy.MaxFetchDuration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	var timeoutErr error
+	for timeoutErr == nil {
+		select {
+		case err := <-fetchErr:
+			// There was some error when fetching
+			return 0, err
+		case nWritten := <-done:
+			// All was good
+			return nWritten, nil
+		case <-stallCheck:
+			if activity.Idle() > strategy.FetchTimeout {
+				timeoutErr = fmt.Errorf("Request stalled for %v", strategy.FetchTimeout)
+			}
+		case <-deadline:
+			timeoutErr = fmt.Errorf("Request took longer than %v", strategy.MaxFetchDuration)
+		case <-ctx.Done():
+			timeoutErr = ctx.Err()
+		}
+	}
 
+	// Request timed out or was cancelled. Cancel it and wait for the copy to stop so that
+	// nothing more is written to output.
+	cancel()
 	select {
-	case err := <-fetchErr:
-		// There was some error when fetching
+	case <-fetchErr:
+	case <-done:
+	}
+	return 0, timeoutErr
+}
+
+// Minimum interval between checks for a stalled fetch
+const minStallCheckInterval = 10 * time.Millisecond
+
+// An activityBody wraps a response body recording when data was last read
+// from it. It is safe to call Idle while another goroutine is reading.
+type activityBody struct {
+	io.ReadCloser
+	lastRead int64 // Time of last read as returned by UnixNano()
+}
+
+func (b *activityBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.Touch()
+	}
+	return n, err
+}
+
+// Touch records that data has just been read.
+func (b *activityBody) Touch() {
+	atomic.StoreInt64(&b.lastRead, time.Now().UnixNano())
+}
+
+// Idle returns the time since data was last read.
+func (b *activityBody) Idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&b.lastRead)))
+}
+
+// copyPartialContent copies the payload of a partial content response to
+// output. If the server replied with multiple ranges as a multipart/byteranges
+// body, only the data from each part is written in the order the parts were
+// sent. If checkMagic is true, the data for each range must start with the
+// GRIB magic bytes and nothing is written from a range which does not.
+func copyPartialContent(output io.Writer, resp *http.Response, checkMagic bool) (int64, error) {
+	copyRange := io.Copy
+	if checkMagic {
+		copyRange = copyGribRange
+	}
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		// A single range is sent as the body itself
+		return copyRange(output, resp.Body)
+	}
+
+	boundary := params["boundary"]
+	if boundary == "" {
+		return 0, errors.New("multipart/byteranges response has no boundary")
+	}
+
+	var nWritten int64
+	reader := multipart.NewReader(resp.Body, boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nWritten, nil
+		} else if err != nil {
+			return nWritten, err
+		}
+
+		n, err := copyRange(output, part)
+		nWritten += n
+		if err != nil {
+			return nWritten, err
+		}
+	}
+}
+
+// copyGribRange is like io.Copy but returns an error without writing anything
+// if src does not start with the GRIB magic bytes.
+func copyGribRange(dst io.Writer, src io.Reader) (int64, error) {
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(src, magic)
+	if err == io.EOF {
+		// An empty range
+		return 0, nil
+	} else if err != nil && err != io.ErrUnexpectedEOF {
 		return 0, err
-	case nWritten := <-done:
-		// All was good
-		return nWritten, nil
-	case <-timeout:
-		// Request timed out
-		return 0, errors.New("Request timed out")
 	}
+	if !bytes.Equal(magic[:n], []byte("GRIB")) {
+		return 0, fmt.Errorf("fetched data is not GRIB, starts with %q", magic[:n])
+	}
+
+	return io.Copy(dst, io.MultiReader(bytes.NewReader(magic), src))
+}
+
+// DownloadOptions specifies which records are fetched by Dataset.Download.
+type DownloadOptions struct {
+	// If non-empty, only records whose layer name ends with this suffix are
+	// fetched. For example, " mb" selects records on isobaric layers.
+	LayerSuffix string
+
+	// If non-nil, called as records are written. See
+	// FetchAndWriteRecordsProgress.
+	Progress func(written, total int64)
+}
+
+// Download fetches the inventory of the dataset and writes those records with
+// any of params as a parameter (or every record if params is empty) to w.
+// Records are further filtered as specified by opts. Returns the number of
+// bytes written.
+func (ds *Dataset) Download(w io.Writer, params []string, opts DownloadOptions) (int64, error) {
+	inventory, err := ds.FetchInventory()
+	if err != nil {
+		return 0, err
+	}
+
+	// Select records to fetch
+	records := inventory.Filter(func(item *InventoryItem) bool {
+		return strings.HasSuffix(item.LayerName, opts.LayerSuffix) && hasAnyParameter(item, params)
+	})
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	return ds.FetchAndWriteRecordsProgress(w, records, opts.Progress)
+}
+
+// A progressWriter passes writes through to W calling Progress (if non-nil)
+// after each one.
+type progressWriter struct {
+	W        io.Writer
+	Written  int64 // Number of bytes written so far
+	Total    int64 // Total number of bytes expected
+	Progress func(written, total int64)
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.W.Write(p)
+	pw.Written += int64(n)
+	if pw.Progress != nil {
+		pw.Progress(pw.Written, pw.Total)
+	}
+	return n, err
+}
+
+// A byteSpan is an inclusive range of bytes within a dataset.
+type byteSpan struct {
+	First, Last int64
+}
+
+// coalesceRecords returns the spans of bytes covered by records in offset
+// order merging records which immediately follow one another in the dataset.
+// The bytes of the spans are therefore in offset order which need not be the
+// order of records. See scatterRecords.
+func coalesceRecords(records []*InventoryItem) []byteSpan {
+	spans := []byteSpan{}
+	for _, r := range recordsByOffset(records) {
+		if n := len(spans); n > 0 && spans[n-1].Last+1 == r.Offset {
+			spans[n-1].Last = r.EndOffset() - 1
+			continue
+		}
+		spans = append(spans, byteSpan{First: r.Offset, Last: r.EndOffset() - 1})
+	}
+	return spans
+}
+
+// recordsByOffset returns a copy of records sorted by offset.
+func recordsByOffset(records []*InventoryItem) []*InventoryItem {
+	sorted := append([]*InventoryItem(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+	return sorted
+}
+
+// scatterRecords writes the bytes of records to output in the order of
+// records. The bytes of all records are given in data in offset order as
+// fetched using the spans from coalesceRecords.
+func scatterRecords(output io.Writer, data []byte, records []*InventoryItem) (int64, error) {
+	// Find where each record starts within data
+	starts := make(map[*InventoryItem]int64)
+	var length int64
+	for _, r := range recordsByOffset(records) {
+		starts[r] = length
+		length += r.Extent
+	}
+	if int64(len(data)) != length {
+		return 0, fmt.Errorf("fetched %d bytes, expected %d", len(data), length)
+	}
+
+	var nWritten int64
+	for _, r := range records {
+		n, err := output.Write(data[starts[r] : starts[r]+r.Extent])
+		nWritten += int64(n)
+		if err != nil {
+			return nWritten, err
+		}
+	}
+	return nWritten, nil
 }
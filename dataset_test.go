@@ -0,0 +1,245 @@
+package aonui
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDataset returns a dataset served by handler fetched with strategy.
+func newTestDataset(t *testing.T, handler http.HandlerFunc, strategy FetchStrategy) *Dataset {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL + "/gfs.t00z.pgrb2.0p50.f000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &DataSource{FetchStrategy: strategy}
+	run := &Run{Source: src, Identifier: "gfs.2014060100", URL: u}
+	return &Dataset{Run: run, Identifier: "gfs.t00z.pgrb2.0p50.f000", URL: u}
+}
+
+func TestFetchAndWriteRecordsShort(t *testing.T) {
+	// Reply with fewer bytes than requested and no Content-Length so that
+	// the client sees a clean end to the body.
+	ds := newTestDataset(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("GRIB" + strings.Repeat("x", 46)))
+		w.(http.Flusher).Flush()
+	}, FetchStrategy{MaximumRetries: 1, CheckGribMagic: true})
+
+	var out bytes.Buffer
+	records := []*InventoryItem{{RecordNumber: 1, Offset: 0, Extent: 100}}
+	if _, err := ds.FetchAndWriteRecords(&out, records); err == nil {
+		t.Fatal("expected an error for a truncated fetch")
+	}
+}
+
+func TestFetchAndWriteRecordsNotGrib(t *testing.T) {
+	ds := newTestDataset(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("<html>" + strings.Repeat("x", 94)))
+	}, FetchStrategy{MaximumRetries: 1, CheckGribMagic: true})
+
+	var out bytes.Buffer
+	records := []*InventoryItem{{RecordNumber: 1, Offset: 0, Extent: 100}}
+	if _, err := ds.FetchAndWriteRecords(&out, records); err == nil {
+		t.Fatal("expected an error for a reply which is not GRIB")
+	}
+	if out.Len() != 0 {
+		t.Errorf("%d bytes written for a reply which is not GRIB", out.Len())
+	}
+}
+
+func TestFetchAndWriteRecords(t *testing.T) {
+	data := "GRIB" + strings.Repeat("x", 96)
+	ds := newTestDataset(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Range"); got != "bytes=0-99" {
+			t.Errorf("unexpected range %q", got)
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(data))
+	}, FetchStrategy{MaximumRetries: 1, CheckGribMagic: true})
+
+	var out bytes.Buffer
+	records := []*InventoryItem{{RecordNumber: 1, Offset: 0, Extent: 100}}
+	n, err := ds.FetchAndWriteRecords(&out, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 100 || out.String() != data {
+		t.Errorf("wrote %d bytes %q", n, out.String())
+	}
+}
+
+func TestFetchAndWriteRecordsOutOfOrder(t *testing.T) {
+	data := "GRIB" + strings.Repeat("x", 96) + "GRIB" + strings.Repeat("y", 46)
+	ds := newTestDataset(t, func(w http.ResponseWriter, r *http.Request) {
+		// Adjacent records are fetched as one range whatever their order
+		if got := r.Header.Get("Range"); got != "bytes=0-149" {
+			t.Errorf("unexpected range %q", got)
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(data))
+	}, FetchStrategy{MaximumRetries: 1, CheckGribMagic: true})
+
+	var out bytes.Buffer
+	records := []*InventoryItem{
+		{RecordNumber: 2, Offset: 100, Extent: 50},
+		{RecordNumber: 1, Offset: 0, Extent: 100},
+	}
+	n, err := ds.FetchAndWriteRecords(&out, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := data[100:] + data[:100]; n != 150 || out.String() != want {
+		t.Errorf("wrote %d bytes %q, want %q", n, out.String(), want)
+	}
+}
+
+func TestCoalesceRecords(t *testing.T) {
+	records := []*InventoryItem{
+		{RecordNumber: 3, Offset: 150, Extent: 50},
+		{RecordNumber: 1, Offset: 0, Extent: 100},
+		{RecordNumber: 4, Offset: 300, Extent: 10},
+		{RecordNumber: 2, Offset: 100, Extent: 50},
+	}
+	want := []byteSpan{{First: 0, Last: 199}, {First: 300, Last: 309}}
+	if got := coalesceRecords(records); !reflect.DeepEqual(got, want) {
+		t.Errorf("got spans %+v, want %+v", got, want)
+	}
+	if records[0].RecordNumber != 3 {
+		t.Error("records were re-ordered in place")
+	}
+}
+
+func TestFetchAndWriteRecordsCancelled(t *testing.T) {
+	// Send the start of the record and then stall until the client goes
+	ds := newTestDataset(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("GRIB"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}, FetchStrategy{MaximumRetries: 3, MaxConsecutiveFailures: 1, CheckGribMagic: true})
+	defer ds.Run.ResetCircuitBreaker()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	var out bytes.Buffer
+	records := []*InventoryItem{{RecordNumber: 1, Offset: 0, Extent: 100}}
+	if _, err := ds.FetchAndWriteRecordsContext(ctx, &out, records); err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+
+	// Being cancelled is not a failure of the run
+	if err := ds.Run.CircuitBreaker().Err(); err != nil {
+		t.Errorf("circuit breaker tripped: %v", err)
+	}
+}
+
+func TestFetchAndWriteRecordsPipe(t *testing.T) {
+	data := "GRIB" + strings.Repeat("x", 96)
+	for _, test := range []struct {
+		Name    string
+		Failure string // Body sent by the first, failing, reply
+		WantErr bool
+	}{
+		{Name: "nothing written", Failure: ""},
+		{Name: "partial output", Failure: data[:50], WantErr: true},
+	} {
+		nRequests := 0
+		ds := newTestDataset(t, func(w http.ResponseWriter, r *http.Request) {
+			nRequests++
+			w.WriteHeader(http.StatusPartialContent)
+			if nRequests == 1 {
+				w.Write([]byte(test.Failure))
+			} else {
+				w.Write([]byte(data))
+			}
+		}, FetchStrategy{MaximumRetries: 2})
+
+		// A pipe cannot seek and so cannot be rewound
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents := make(chan string)
+		go func() {
+			b, _ := ioutil.ReadAll(r)
+			contents <- string(b)
+		}()
+
+		records := []*InventoryItem{{RecordNumber: 1, Offset: 0, Extent: 100}}
+		_, err = ds.FetchAndWriteRecords(w, records)
+		w.Close()
+		got := <-contents
+		r.Close()
+
+		if test.WantErr {
+			if err == nil || !strings.Contains(err.Error(), "cannot rewind") {
+				t.Errorf("%v: got error %v, want one about rewinding", test.Name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%v: %v", test.Name, err)
+		} else if got != data {
+			t.Errorf("%v: wrote %q", test.Name, got)
+		}
+	}
+}
+
+func TestFetchInventoryWithoutGzip(t *testing.T) {
+	const index = "1:0:d=2014060100:HGT:500 mb:anl:\n"
+	var gzRequests int
+	ds := newTestDataset(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, ".idx.gz"):
+			// Neither found nor decompressible
+			gzRequests++
+			w.Write([]byte("not gzip"))
+		case strings.HasSuffix(r.URL.Path, ".idx"):
+			w.Write([]byte(index))
+		default:
+			http.NotFound(w, r)
+		}
+	}, FetchStrategy{MaximumRetries: 1})
+
+	for i := 0; i < 3; i++ {
+		inv, err := ds.FetchInventoryWithLength(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(inv) != 1 || inv[0].Extent != 100 || inv[0].Dataset != ds {
+			t.Errorf("unexpected inventory %+v", inv)
+		}
+	}
+
+	// The host is only asked once for a compressed inventory
+	if gzRequests != 1 {
+		t.Errorf("compressed inventory requested %d times, want 1", gzRequests)
+	}
+}
+
+func TestMergeInventories(t *testing.T) {
+	primary := Inventory{
+		{RecordNumber: 1, Parameters: []string{"HGT"}, LayerName: "500 mb", TypeName: "anl"},
+	}
+	secondary := Inventory{
+		{RecordNumber: 1, Parameters: []string{"HGT"}, LayerName: "500 mb", TypeName: "anl"},
+		{RecordNumber: 2, Parameters: []string{"HGT"}, LayerName: "550 mb", TypeName: "anl"},
+	}
+
+	merged := MergeInventories(primary, secondary)
+	if len(merged) != 2 || merged[0] != primary[0] || merged[1] != secondary[1] {
+		t.Errorf("unexpected merged inventory %+v", merged)
+	}
+}
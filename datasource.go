@@ -1,10 +1,13 @@
 package aonui
 
 import (
+	"context"
+	"fmt"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"code.google.com/p/go.net/html"
@@ -12,19 +15,103 @@ import (
 
 // A DataSource contains information on where to get runs and datasets from
 type DataSource struct {
-	Root            string        // Root URL for dataset
-	RunPattern      string        // Pattern to match directories containing individual runs
-	DatasetPattern  string        // Pattern to match individual datasets within a run
-	FetchStrategy   FetchStrategy // Strategy to use when fetching data
-	MaxForecastHour int           // Maximum forecast hour to fetch (or 0 to fetch all)
-	MinDatasets     int           // Minimum number of datasets to be "good" (or 0 for no limit)
+	Root            string           // Root URL for dataset
+	RunPattern      string           // Pattern to match directories containing individual runs
+	DatasetPattern  string           // Pattern to match individual datasets within a run
+	FetchStrategy   FetchStrategy    // Strategy to use when fetching data
+	MaxForecastHour int              // Maximum forecast hour to fetch (or 0 to fetch all)
+	MinDatasets     int              // Minimum number of datasets to be "good" (or 0 for no limit)
+	Schedule        ForecastSchedule // Expected forecast hours of each run (or nil if unknown)
+	PressureLevels  []int            // Isobaric levels in mb provided by each dataset (or nil if unknown)
+
+	// If non-empty, directories matched by RunPattern contain
+	// sub-directories matched by RunSubdirPattern each of which is an
+	// individual run. In this case RunPattern usually only matches the date
+	// and RunSubdirPattern the hour of the run.
+	RunSubdirPattern string
+
+	// If non-empty, datasets are found in this directory relative to each
+	// run's directory.
+	DatasetDir string
+
+	// If non-empty, each directory matched by RunPattern contains the
+	// datasets of a run for each of these hours. In this case RunPattern
+	// usually only matches the date and each run's hour is taken from the
+	// "runHour" subexpression of DatasetPattern. Runs in the future are
+	// omitted.
+	RunHours []int
+
+	// If true, Root is an Amazon S3 bucket whose "directories" are listed
+	// via the ListObjectsV2 API rather than by fetching HTML listings.
+	S3 bool
+
+	// Schedules for runs at particular hours which replace Schedule for
+	// those runs (or nil if all runs follow Schedule). For example, some
+	// models forecast further ahead at the main synoptic hours.
+	RunSchedules map[int]ForecastSchedule
+}
+
+// ScheduleFor returns the expected forecast hours of runs at runHour. This is
+// the schedule for runHour in RunSchedules, if any, and Schedule otherwise.
+func (ds *DataSource) ScheduleFor(runHour int) ForecastSchedule {
+	if s, ok := ds.RunSchedules[runHour]; ok {
+		return s
+	}
+	return ds.Schedule
+}
+
+// ExpectedForecastHours returns the forecast hours each run of the source is
+// expected to have according to its Schedule in increasing order. Hours after
+// MaxForecastHour, if set, are omitted. Returns nil if the schedule is
+// unknown. Runs at hours in RunSchedules may differ. See
+// Run.ExpectedForecastHours.
+func (ds *DataSource) ExpectedForecastHours() []int {
+	return ds.expectedForecastHours(ds.Schedule)
+}
+
+// expectedForecastHours returns the hours of schedule up to MaxForecastHour
+// or nil if schedule is empty.
+func (ds *DataSource) expectedForecastHours(schedule ForecastSchedule) []int {
+	if len(schedule) == 0 {
+		return nil
+	}
+
+	maxHour := schedule.LastHour()
+	if ds.MaxForecastHour > 0 && ds.MaxForecastHour < maxHour {
+		maxHour = ds.MaxForecastHour
+	}
+	return schedule.Hours(maxHour)
+}
+
+// MissingPressureLevels returns those levels in ds.PressureLevels which are
+// absent from pressures. The result preserves the order of ds.PressureLevels.
+func (ds *DataSource) MissingPressureLevels(pressures []int) []int {
+	present := make(map[int]bool)
+	for _, p := range pressures {
+		present[p] = true
+	}
+
+	missing := []int{}
+	for _, p := range ds.PressureLevels {
+		if !present[p] {
+			missing = append(missing, p)
+		}
+	}
+	return missing
 }
 
 // FetchRuns will fetch available runs in a dataset. Note that partial runs
 // (i.e. those with only some of the datasets uploaded) will also be returned
 // and so one should be careful to check the number of datasets matches what
-// you expect.
+// you expect. If a run appears more than once in the listing, only the most
+// recently modified copy is returned.
 func (ds *DataSource) FetchRuns() ([]*Run, error) {
+	return ds.FetchRunsContext(context.Background())
+}
+
+// FetchRunsContext is like FetchRuns but the fetch is abandoned if ctx is
+// cancelled.
+func (ds *DataSource) FetchRunsContext(ctx context.Context) ([]*Run, error) {
 	// Form base URL
 	baseURL, err := url.Parse(ds.Root)
 	if err != nil {
@@ -38,7 +125,7 @@ func (ds *DataSource) FetchRuns() ([]*Run, error) {
 	}
 
 	// Fetch runs
-	doc, err := getAndParse(ds.Root, ds.FetchStrategy)
+	doc, err := ds.fetchListing(ctx, baseURL)
 	if err != nil {
 		return nil, err
 	}
@@ -47,18 +134,240 @@ func (ds *DataSource) FetchRuns() ([]*Run, error) {
 	runChan := make(chan *Run)
 
 	// Walk entire parse tree...
-	ctx := &parseRunsContext{BaseURL: baseURL, RunRegexp: runRegexp}
-	go func(c chan *Run, ds *DataSource, ctx *parseRunsContext) {
+	parseCtx := &parseRunsContext{BaseURL: baseURL, RunRegexp: runRegexp}
+	go func(c chan *Run, ds *DataSource, parseCtx *parseRunsContext) {
 		defer close(c)
 		walkNodeTree(doc, func(node *html.Node) {
-			ctx.matchRunNode(node, ds, c)
+			parseCtx.matchRunNode(ctx, node, ds, c)
 		})
-	}(runChan, ds, ctx)
+	}(runChan, ds, parseCtx)
+
+	// Return runs, collapsing duplicate identifiers into the most recently
+	// modified run.
+	runs := []*Run{}
+	runIndices := make(map[string]int)
+	for run := range runChan {
+		idx, seen := runIndices[run.Identifier]
+		if !seen {
+			runIndices[run.Identifier] = len(runs)
+			runs = append(runs, run)
+		} else if run.LastModified.After(runs[idx].LastModified) {
+			runs[idx] = run
+		}
+	}
+
+	// The walk stops sending runs if ctx is cancelled
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Expand sub-directories into runs if necessary
+	if ds.RunSubdirPattern != "" {
+		if runs, err = ds.fetchRunSubdirs(ctx, runs); err != nil {
+			return nil, err
+		}
+	}
+
+	// Expand directories into one run per hour if necessary
+	if len(ds.RunHours) > 0 {
+		runs = ds.expandRunHours(runs, time.Now())
+	}
+
+	// Point runs at the directory containing datasets
+	if ds.DatasetDir != "" {
+		datasetDirURL, err := url.Parse(ds.DatasetDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, run := range runs {
+			run.URL = run.URL.ResolveReference(datasetDirURL)
+		}
+	}
+
+	return runs, nil
+}
+
+// LatestCompleteRun returns the most recent run with at least MinDatasets
+// datasets. Only the newest lookback runs are examined or, if lookback is not
+// positive, all runs. An error is returned if none of them are complete.
+func (ds *DataSource) LatestCompleteRun(lookback int) (*Run, error) {
+	runs, err := ds.FetchRuns()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort by *descending* date
+	sort.Slice(runs, func(i, j int) bool { return runs[i].When.After(runs[j].When) })
+	if lookback > 0 && len(runs) > lookback {
+		runs = runs[:lookback]
+	}
+
+	for _, run := range runs {
+		datasets, err := run.FetchDatasets()
+		if err != nil {
+			return nil, err
+		}
+		if run.CheckComplete(datasets) == nil {
+			return run, nil
+		}
+		logger().Infof("Run %v has only %d datasets", run.Identifier, len(datasets))
+	}
+
+	return nil, fmt.Errorf("no complete run found in the newest %d runs", len(runs))
+}
+
+// A RunStatus records how many datasets were found in a run.
+type RunStatus struct {
+	Run         *Run
+	NumDatasets int   // Number of datasets in the run (or 0 if Err is non-nil)
+	Complete    bool  // True if NumDatasets is at least the source's MinDatasets
+	Err         error // Error fetching the run's datasets (or nil)
+}
+
+// FetchCompleteRuns fetches the datasets of the newest lookback runs, or of all
+// runs if lookback is not positive, with at most concurrency fetches at once. The returned statuses are sorted newest
+// first. Failing to fetch the datasets of a run is recorded in its status
+// rather than returned as an error.
+func (ds *DataSource) FetchCompleteRuns(lookback, concurrency int) ([]*RunStatus, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	runs, err := ds.FetchRuns()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort by *descending* date
+	sort.Slice(runs, func(i, j int) bool { return runs[i].When.After(runs[j].When) })
+	if lookback > 0 && len(runs) > lookback {
+		runs = runs[:lookback]
+	}
+
+	// Probe each run. Each goroutine writes only its own status.
+	statuses := make([]*RunStatus, len(runs))
+	sem := make(chan int, concurrency)
+	var wg sync.WaitGroup
+	for idx, run := range runs {
+		wg.Add(1)
+		go func(idx int, run *Run) {
+			defer wg.Done()
+
+			sem <- 1
+			defer func() { <-sem }()
+
+			status := &RunStatus{Run: run}
+			if datasets, err := run.FetchDatasets(); err != nil {
+				status.Err = err
+			} else {
+				status.NumDatasets = len(datasets)
+				status.Complete = run.CheckComplete(datasets) == nil
+			}
+			statuses[idx] = status
+		}(idx, run)
+	}
+	wg.Wait()
+
+	return statuses, nil
+}
+
+// fetchListing fetches and parses the listing of the directory at dirURL.
+func (ds *DataSource) fetchListing(ctx context.Context, dirURL *url.URL) (*html.Node, error) {
+	if !ds.S3 {
+		return getAndParse(ctx, dirURL.String(), ds.FetchStrategy)
+	}
+
+	rootURL, err := url.Parse(ds.Root)
+	if err != nil {
+		return nil, err
+	}
+	return getAndParseS3(ctx, rootURL, dirURL, ds.FetchStrategy)
+}
+
+// expandRunHours returns a run for each of ds.RunHours on the day of each run
+// in dirs. The identifier of each run is formed by appending the hour to the
+// directory's identifier. Runs after now are omitted.
+func (ds *DataSource) expandRunHours(dirs []*Run, now time.Time) []*Run {
+	runs := []*Run{}
+	for _, dir := range dirs {
+		y, m, d := dir.When.Date()
+		for _, hour := range ds.RunHours {
+			when := time.Date(y, m, d, hour, 0, 0, 0, time.UTC)
+			if when.After(now) {
+				continue
+			}
+
+			run := *dir // NB: Copy of dir
+			run.Identifier = fmt.Sprintf("%v%02d", dir.Identifier, hour)
+			run.When = when
+			runs = append(runs, &run)
+		}
+	}
+	return runs
+}
+
+// fetchRunSubdirs fetches the listing of each directory in parents and returns
+// a run for each sub-directory matching ds.RunSubdirPattern. The identifier of
+// each run is formed by appending the sub-directory name to the parent's
+// identifier. The date of each run is taken from the parent and the hour from
+// the "hour" subexpression of RunSubdirPattern.
+func (ds *DataSource) fetchRunSubdirs(ctx context.Context, parents []*Run) ([]*Run, error) {
+	subdirRegexp, err := regexp.Compile(ds.RunSubdirPattern)
+	if err != nil {
+		return nil, err
+	}
 
-	// Return runs
 	runs := []*Run{}
-	for ds := range runChan {
-		runs = append(runs, ds)
+	for _, parent := range parents {
+		doc, err := ds.fetchListing(ctx, parent.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		seen := make(map[string]bool)
+		walkNodeTree(doc, func(node *html.Node) {
+			if node.Type != html.ElementNode || node.Data != "a" {
+				return
+			}
+
+			for _, a := range node.Attr {
+				if a.Key != "href" {
+					continue
+				}
+
+				// Resolve the reference. Skip invalid references
+				subdirURL, subdir, ok := resolveHref(parent.URL, a.Val)
+				if !ok {
+					continue
+				}
+
+				// Does this match our pattern for sub-directories?
+				submatches := subdirRegexp.FindStringSubmatch(subdir)
+				if submatches == nil || seen[subdir] {
+					continue
+				}
+				seen[subdir] = true
+
+				hour := parent.When.Hour()
+				for idx, subexpName := range subdirRegexp.SubexpNames() {
+					if subexpName != "hour" {
+						continue
+					}
+					if h, err := strconv.Atoi(submatches[idx]); err == nil {
+						hour = h
+					}
+				}
+
+				y, m, d := parent.When.Date()
+				runs = append(runs, &Run{
+					Source:       ds,
+					Identifier:   parent.Identifier + subdir,
+					URL:          subdirURL,
+					When:         time.Date(y, m, d, hour, 0, 0, 0, time.UTC),
+					LastModified: listingModTime(node),
+				})
+			}
+		})
 	}
 
 	return runs, nil
@@ -71,8 +380,9 @@ type parseRunsContext struct {
 }
 
 // Parse an individual node from a HTML parse tree looking for an anchor
-// pointing to a GFS run. If the node is a GFS run, send the run along out.
-func (ctx *parseRunsContext) matchRunNode(node *html.Node, ds *DataSource, out chan *Run) {
+// pointing to a GFS run. If the node is a GFS run, send the run along out
+// unless cancelCtx has been cancelled.
+func (ctx *parseRunsContext) matchRunNode(cancelCtx context.Context, node *html.Node, ds *DataSource, out chan *Run) {
 	// Is this node an anchor tag? If not, just return signalling completion.
 	if node.Type != html.ElementNode || node.Data != "a" {
 		return
@@ -84,8 +394,11 @@ func (ctx *parseRunsContext) matchRunNode(node *html.Node, ds *DataSource, out c
 			continue
 		}
 
-		// Trim any trailing slash
-		identifier := strings.TrimRight(a.Val, "/")
+		// Resolve the reference. Skip invalid references
+		url, identifier, ok := resolveHref(ctx.BaseURL, a.Val)
+		if !ok {
+			continue
+		}
 
 		// Does this match our pattern for runs?
 		submatches := ctx.RunRegexp.FindStringSubmatch(identifier)
@@ -93,13 +406,6 @@ func (ctx *parseRunsContext) matchRunNode(node *html.Node, ds *DataSource, out c
 			continue
 		}
 
-		// Parse as a relative URL. Skip invalid references
-		relURL, err := url.Parse(a.Val)
-		if err != nil {
-			continue
-		}
-		url := ctx.BaseURL.ResolveReference(relURL)
-
 		var year, month, day, hour int
 		for idx, subexpName := range ctx.RunRegexp.SubexpNames() {
 			// Parse submatch as an integer (if possible)
@@ -122,9 +428,16 @@ func (ctx *parseRunsContext) matchRunNode(node *html.Node, ds *DataSource, out c
 		}
 
 		when := time.Date(year, time.Month(month), day, hour, 0, 0, 0, time.UTC)
-		run := &Run{Source: ds, Identifier: identifier, URL: url, When: when}
+		run := &Run{
+			Source: ds, Identifier: identifier, URL: url, When: when,
+			LastModified: listingModTime(node),
+		}
 
 		// Send run to output channel
-		out <- run
+		select {
+		case out <- run:
+		case <-cancelCtx.Done():
+			return
+		}
 	}
 }
@@ -0,0 +1,117 @@
+package aonui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newListingSource returns a source with GFS-style run names whose root
+// directory listing is listing.
+func newListingSource(t *testing.T, listing string) *DataSource {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(listing))
+	}))
+	t.Cleanup(server.Close)
+
+	return &DataSource{
+		Root:       server.URL + "/gfs/",
+		RunPattern: `^gfs\.(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})(?P<hour>\d{2})$`,
+	}
+}
+
+func TestFetchRunsDuplicates(t *testing.T) {
+	// The run for 00Z has been re-uploaded and appears twice. The run for
+	// 12Z has no modification time and must not take that of the next row.
+	src := newListingSource(t, `<html><body><pre>
+<a href="gfs.2014060100/">gfs.2014060100/</a>  01-Jun-2014 03:28    -
+<a href="gfs.2014060112/">gfs.2014060112/</a>
+<a href="gfs.2014060106/">gfs.2014060106/</a>  01-Jun-2014 09:28    -
+<a href="gfs.2014060100/">gfs.2014060100/</a>  01-Jun-2014 10:05    -
+</pre></body></html>`)
+
+	runs, err := src.FetchRuns()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]time.Time{
+		"gfs.2014060100": time.Date(2014, 6, 1, 10, 5, 0, 0, time.UTC),
+		"gfs.2014060106": time.Date(2014, 6, 1, 9, 28, 0, 0, time.UTC),
+		"gfs.2014060112": {},
+	}
+	if len(runs) != len(want) {
+		t.Fatalf("got %d runs, want %d", len(runs), len(want))
+	}
+	for _, run := range runs {
+		if lastModified, ok := want[run.Identifier]; !ok {
+			t.Errorf("unexpected run %v", run.Identifier)
+		} else if !run.LastModified.Equal(lastModified) {
+			t.Errorf("run %v modified %v, want %v", run.Identifier, run.LastModified, lastModified)
+		}
+	}
+}
+
+func TestFetchRunsHrefShapes(t *testing.T) {
+	// The first two anchors point at the same run in different ways
+	src := newListingSource(t, `<html><body><pre>
+<a href="?C=M;O=A">Last modified</a>
+<a href="./gfs.2024010100/">gfs.2024010100/</a>
+<a href="http://example.com/gfs/gfs.2024010100/">gfs.2024010100/</a>
+<a href="//example.com/gfs/gfs.2024010106">gfs.2024010106</a>
+</pre></body></html>`)
+
+	runs, err := src.FetchRuns()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identifiers := []string{}
+	for _, run := range runs {
+		identifiers = append(identifiers, run.Identifier)
+	}
+	sort.Strings(identifiers)
+	if want := []string{"gfs.2024010100", "gfs.2024010106"}; !reflect.DeepEqual(identifiers, want) {
+		t.Errorf("got runs %v, want %v", identifiers, want)
+	}
+}
+
+func TestLatestCompleteRunAll(t *testing.T) {
+	src := newListingSource(t, `<html><body><pre>
+<a href="gfs.2014060100/">gfs.2014060100/</a>  01-Jun-2014 03:28    -
+<a href="gfs.2014060106/">gfs.2014060106/</a>  01-Jun-2014 09:28    -
+</pre></body></html>`)
+	src.DatasetPattern = `^gfs\.t(?P<runHour>\d{2})z\.pgrb2\.0p50\.f(?P<forecastHour>\d{3})$`
+
+	// A lookback which is not positive examines every run
+	for _, lookback := range []int{0, -1} {
+		run, err := src.LatestCompleteRun(lookback)
+		if err != nil {
+			t.Errorf("lookback %d: %v", lookback, err)
+		} else if run.Identifier != "gfs.2014060106" {
+			t.Errorf("lookback %d: got run %v, want gfs.2014060106", lookback, run.Identifier)
+		}
+	}
+}
+
+func TestFetchCompleteRunsAll(t *testing.T) {
+	src := newListingSource(t, `<html><body><pre>
+<a href="gfs.2014060100/">gfs.2014060100/</a>  01-Jun-2014 03:28    -
+<a href="gfs.2014060106/">gfs.2014060106/</a>  01-Jun-2014 09:28    -
+</pre></body></html>`)
+	src.DatasetPattern = `^gfs\.t(?P<runHour>\d{2})z\.pgrb2\.0p50\.f(?P<forecastHour>\d{3})$`
+
+	// A lookback which is not positive probes every run
+	for _, lookback := range []int{0, -1} {
+		statuses, err := src.FetchCompleteRuns(lookback, 2)
+		if err != nil {
+			t.Errorf("lookback %d: %v", lookback, err)
+		} else if len(statuses) != 2 {
+			t.Errorf("lookback %d: got %d statuses, want 2", lookback, len(statuses))
+		}
+	}
+}
@@ -0,0 +1,402 @@
+// Functions for dealing with the ecCodes GRIB tools
+
+package aonui
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Commands used for launching the ecCodes tools. On each invocation, these
+// commands are looked up in the system path.
+var (
+	EccodesGetCommand     = "grib_get"
+	EccodesGetDataCommand = "grib_get_data"
+)
+
+// EccodesTool is a GribTool which uses the grib_get and grib_get_data tools
+// from ecCodes. See EccodesGetCommand and EccodesGetDataCommand.
+type EccodesTool struct{}
+
+// Check returns an error if the ecCodes tools cannot be found.
+func (EccodesTool) Check() error {
+	for _, command := range []string{EccodesGetCommand, EccodesGetDataCommand} {
+		if _, err := exec.LookPath(command); err != nil {
+			return fmt.Errorf("%v not found; install ecCodes from %v", command, eccodesURL)
+		}
+	}
+	return nil
+}
+
+// URL from which ecCodes may be obtained
+const eccodesURL = "https://confluence.ecmwf.int/display/ECC"
+
+// Map from ecCodes short names to the parameter names used by wgrib2. Short
+// names not in this map are converted to upper case.
+var eccodesParameterNames = map[string]string{
+	"gh":    "HGT",
+	"u":     "UGRD",
+	"v":     "VGRD",
+	"t":     "TMP",
+	"r":     "RH",
+	"q":     "SPFH",
+	"w":     "VVEL",
+	"absv":  "ABSV",
+	"10u":   "UGRD",
+	"10v":   "VGRD",
+	"2t":    "TMP",
+	"2r":    "RH",
+	"sp":    "PRES",
+	"prmsl": "PRMSL",
+}
+
+// Inventory uses grib_get to parse the inventory of the GRIB2 file fn. The
+// output of grib_get is converted into the wgrib2 "short" format and parsed
+// with ParseInventory.
+func (EccodesTool) Inventory(fn string) (Inventory, error) {
+	// Get total length of GRIB2 file
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return nil, err
+	}
+	totalLength := fi.Size()
+
+	// Get the keys we need from each message
+	messages, err := eccodesGetMessages(fn,
+		"offset,dataDate,dataTime,shortName,typeOfLevel,level,stepRange,stepType")
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert each field into wgrib2 format. Messages with more than one
+	// field are numbered as sub-records, e.g. "3.1" and "3.2", as wgrib2
+	// does.
+	var lines []string
+	for msgIdx, message := range messages {
+		for fieldIdx, fields := range message {
+			record := strconv.Itoa(msgIdx + 1)
+			if len(message) > 1 {
+				record += "." + strconv.Itoa(fieldIdx+1)
+			}
+			line, err := eccodesToWgrib2(record, fields)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	return ParseInventory(strings.NewReader(strings.Join(lines, "\n")), totalLength)
+}
+
+// eccodesToWgrib2 converts the fields offset, dataDate, dataTime, shortName,
+// typeOfLevel, level, stepRange and stepType output by grib_get for the record
+// numbered record, e.g. "3" or "3.1", into a wgrib2 "short" inventory line.
+func eccodesToWgrib2(record string, fields []string) (string, error) {
+	if len(fields) != 8 {
+		return "", fmt.Errorf("expected 8 fields from grib_get, got %d", len(fields))
+	}
+	offset, dataDate, dataTime := fields[0], fields[1], fields[2]
+	shortName, typeOfLevel, level := fields[3], fields[4], fields[5]
+	stepRange, stepType := fields[6], fields[7]
+
+	// dataTime is of the form HHMM with leading zeros omitted
+	hhmm, err := strconv.Atoi(dataTime)
+	if err != nil {
+		return "", fmt.Errorf("invalid dataTime: %v", dataTime)
+	}
+
+	param, ok := eccodesParameterNames[shortName]
+	if !ok {
+		param = strings.ToUpper(shortName)
+	}
+
+	var layer string
+	switch typeOfLevel {
+	case "isobaricInhPa":
+		layer = level + " mb"
+	case "isobaricInPa":
+		pa, err := strconv.ParseFloat(level, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid level: %v", level)
+		}
+		layer = strconv.FormatFloat(pa/100, 'g', -1, 64) + " mb"
+	case "surface":
+		layer = "surface"
+	case "heightAboveGround":
+		layer = level + " m above ground"
+	case "meanSea":
+		layer = "mean sea level"
+	default:
+		layer = typeOfLevel + " " + level
+	}
+
+	var typeName string
+	switch {
+	case stepType == "instant" && stepRange == "0":
+		typeName = "anl"
+	case stepType == "accum":
+		typeName = stepRange + " hour acc fcst"
+	case stepType == "avg":
+		typeName = stepRange + " hour ave fcst"
+	default:
+		typeName = stepRange + " hour fcst"
+	}
+
+	return fmt.Sprintf("%v:%v:d=%v%02d:%v:%v:%v:",
+		record, offset, dataDate, hhmm/100, param, layer, typeName), nil
+}
+
+// Extract uses grib_get_data to decode the records in inv from sourceFn and
+// writes them to destFn.
+func (EccodesTool) Extract(inv Inventory, sourceFn string, destFn string) error {
+	// Write the records to a temporary GRIB2 in the order required
+	tmpFn, err := recordsToTempFile(inv, sourceFn)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFn)
+
+	// Get the shape and scanning direction of each record
+	keys, err := eccodesGetInts(tmpFn, "Ni,Nj,jScansPositively")
+	if err != nil {
+		return err
+	}
+
+	// Open output
+	output, err := os.Create(destFn)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	// Decode values
+	cmd := execCommand(EccodesGetDataCommand, "-F", "%.9g", tmpFn)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Read each record's values in turn. Lines which are not of the form
+	// "lat lon value" are headers and are skipped.
+	scanner := bufio.NewScanner(stdout)
+	var writeErr error
+	for _, k := range keys {
+		columns, rows, scansNorthward := k[0], k[1], k[2] != 0
+		values := make([]float32, 0, columns*rows)
+		for len(values) < columns*rows && scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 3 {
+				continue
+			}
+			v, err := strconv.ParseFloat(fields[2], 32)
+			if err != nil {
+				continue
+			}
+			values = append(values, float32(v))
+		}
+		if len(values) < columns*rows {
+			writeErr = errors.New("too few values read from grib_get_data")
+			break
+		}
+
+		// Write rows South-to-North
+		for row := 0; row < rows; row++ {
+			srcRow := row
+			if !scansNorthward {
+				srcRow = rows - 1 - row
+			}
+			rowValues := values[srcRow*columns : (srcRow+1)*columns]
+			if err := binary.Write(output, ExtractByteOrder, rowValues); err != nil {
+				writeErr = err
+				break
+			}
+		}
+		if writeErr != nil {
+			break
+		}
+	}
+
+	// Drain any remaining output so grib_get_data can exit
+	for scanner.Scan() {
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return err
+	}
+
+	return writeErr
+}
+
+// GridShapes uses grib_get to find the shape of each record in inv from
+// sourceFn.
+func (EccodesTool) GridShapes(inv Inventory, sourceFn string) ([]GridShape, error) {
+	tmpFn, err := recordsToTempFile(inv, sourceFn)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFn)
+
+	// A record with more than one field, e.g. UGRD and VGRD, has one line
+	// per field. All fields of a message share its grid.
+	messages, err := eccodesGetMessages(tmpFn, "offset,Ni,Nj")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(messages) != len(inv) {
+		return nil, fmt.Errorf("expected %d shapes from grib_get, got %d", len(inv), len(messages))
+	}
+
+	shapes := []GridShape{}
+	for _, message := range messages {
+		fields := message[0]
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("expected 3 fields from grib_get, got %d", len(fields))
+		}
+		columns, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		rows, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		shapes = append(shapes, GridShape{Columns: columns, Rows: rows})
+	}
+	return shapes, nil
+}
+
+// LatLonGrid uses grib_get to find the geometry of the record item from
+// sourceFn.
+func (EccodesTool) LatLonGrid(item *InventoryItem, sourceFn string) (LatLonGrid, error) {
+	tmpFn, err := recordsToTempFile(Inventory{item}, sourceFn)
+	if err != nil {
+		return LatLonGrid{}, err
+	}
+	defer os.Remove(tmpFn)
+
+	cmd := execCommand(EccodesGetCommand, "-p", "gridType,"+
+		"latitudeOfFirstGridPointInDegrees,latitudeOfLastGridPointInDegrees,"+
+		"longitudeOfFirstGridPointInDegrees,longitudeOfLastGridPointInDegrees,"+
+		"jDirectionIncrementInDegrees,iDirectionIncrementInDegrees", tmpFn)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return LatLonGrid{}, err
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 7 {
+		return LatLonGrid{}, fmt.Errorf("expected 7 fields from grib_get, got %d", len(fields))
+	}
+	if fields[0] != "regular_ll" {
+		return LatLonGrid{}, ErrNotLatLonGrid
+	}
+
+	values := make([]float64, 6)
+	for idx, f := range fields[1:] {
+		if values[idx], err = strconv.ParseFloat(f, 64); err != nil {
+			return LatLonGrid{}, err
+		}
+	}
+	return newLatLonGrid(values[0], values[1], values[2], values[4], values[5]), nil
+}
+
+// eccodesGetMessages uses grib_get to get keys, which must start with
+// "offset", from each field of the GRIB2 file fn. grib_get prints one line per
+// field and fields of the same message share an offset. The whitespace
+// separated values of each line are returned grouped by message.
+func eccodesGetMessages(fn string, keys string) ([][][]string, error) {
+	cmd := execCommand(EccodesGetCommand, "-p", keys, fn)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var messages [][][]string
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if n := len(messages); n > 0 && fields[0] == messages[n-1][0][0] {
+			messages[n-1] = append(messages[n-1], fields)
+		} else {
+			messages = append(messages, [][]string{fields})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// eccodesGetInts uses grib_get to read the comma-separated integer keys from
+// each field in fn. Returns one slice of values per field.
+func eccodesGetInts(fn string, keys string) ([][]int, error) {
+	nKeys := len(strings.Split(keys, ","))
+
+	cmd := execCommand(EccodesGetCommand, "-p", keys, fn)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	values := [][]int{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != nKeys {
+			return nil, fmt.Errorf("expected %d fields from grib_get, got %d", nKeys, len(fields))
+		}
+
+		msgValues := make([]int, nKeys)
+		for idx, f := range fields {
+			if msgValues[idx], err = strconv.Atoi(f); err != nil {
+				return nil, err
+			}
+		}
+		values = append(values, msgValues)
+	}
+
+	return values, nil
+}
+
+// recordsToTempFile copies the records in inv from sourceFn to a new
+// temporary file and returns its name. The caller should remove the file when
+// finished.
+func recordsToTempFile(inv Inventory, sourceFn string) (string, error) {
+	tmpFile, err := ioutil.TempFile("", "aonui-records-")
+	if err != nil {
+		return "", err
+	}
+
+	err = copyRecords(tmpFile, inv, sourceFn)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+
+	return tmpFile.Name(), nil
+}
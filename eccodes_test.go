@@ -0,0 +1,85 @@
+package aonui
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEccodesInventory(t *testing.T) {
+	// A single field message followed by a wind message with two fields
+	fakeTool(t, ""+
+		"0 20140601 0 gh isobaricInhPa 500 0 instant\n"+
+		"100 20140601 0 u isobaricInhPa 500 0 instant\n"+
+		"100 20140601 0 v isobaricInhPa 500 0 instant\n")
+
+	gribFn := filepath.Join(t.TempDir(), "input.grib2")
+	if err := ioutil.WriteFile(gribFn, make([]byte, 250), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	inv, err := EccodesTool{}.Inventory(gribFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inv) != 2 {
+		t.Fatalf("got %d records, want 2", len(inv))
+	}
+
+	if got := inv[0].Parameters; !reflect.DeepEqual(got, []string{"HGT"}) {
+		t.Errorf("first record has parameters %v", got)
+	}
+	if inv[0].Offset != 0 || inv[0].Extent != 100 {
+		t.Errorf("first record at %d with extent %d", inv[0].Offset, inv[0].Extent)
+	}
+
+	if got := inv[1].Parameters; !reflect.DeepEqual(got, []string{"UGRD", "VGRD"}) {
+		t.Errorf("wind record has parameters %v", got)
+	}
+	if inv[1].RecordNumber != 2 || inv[1].Offset != 100 || inv[1].Extent != 150 {
+		t.Errorf("wind record %d at %d with extent %d",
+			inv[1].RecordNumber, inv[1].Offset, inv[1].Extent)
+	}
+}
+
+func TestEccodesGridShapesMultiField(t *testing.T) {
+	// The wind record has one line for each of its two fields
+	fakeTool(t, ""+
+		"0 720 361\n"+
+		"100 720 361\n"+
+		"100 720 361\n")
+
+	gribFn := filepath.Join(t.TempDir(), "input.grib2")
+	if err := ioutil.WriteFile(gribFn, make([]byte, 150), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	shapes, err := EccodesTool{}.GridShapes(windInventory, gribFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []GridShape{{Columns: 720, Rows: 361}, {Columns: 720, Rows: 361}}
+	if !reflect.DeepEqual(shapes, want) {
+		t.Errorf("got shapes %+v, want %+v", shapes, want)
+	}
+}
+
+func TestEccodesToWgrib2(t *testing.T) {
+	fields := []string{"100", "20140601", "600", "u", "isobaricInhPa", "500", "3", "instant"}
+	for _, test := range []struct {
+		Record string
+		Want   string
+	}{
+		{"2", "2:100:d=2014060106:UGRD:500 mb:3 hour fcst:"},
+		{"2.1", "2.1:100:d=2014060106:UGRD:500 mb:3 hour fcst:"},
+	} {
+		got, err := eccodesToWgrib2(test.Record, fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.Want {
+			t.Errorf("got %q, want %q", got, test.Want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Forecast hour schedules
+
+package aonui
+
+import "sort"
+
+// A ScheduleStep describes forecast hours being published every Step hours up
+// to and including UntilHour.
+type ScheduleStep struct {
+	UntilHour int
+	Step      int
+}
+
+// A ForecastSchedule describes the forecast hours published for a run as a
+// sequence of steps. The first step starts at forecast hour 0 and each
+// subsequent step starts where the previous one finished. For example, a run
+// with 3-hourly forecasts to 240 hours followed by 12-hourly forecasts to 384
+// hours is described by
+//
+//	ForecastSchedule{{UntilHour: 240, Step: 3}, {UntilHour: 384, Step: 12}}
+type ForecastSchedule []ScheduleStep
+
+// Hours returns the forecast hours in the schedule up to and including
+// maxHour in increasing order.
+func (s ForecastSchedule) Hours(maxHour int) []int {
+	hours := []int{}
+	hour := 0
+	for _, step := range s {
+		if step.Step < 1 {
+			continue
+		}
+		for ; hour <= step.UntilHour && hour <= maxHour; hour += step.Step {
+			if len(hours) == 0 || hours[len(hours)-1] != hour {
+				hours = append(hours, hour)
+			}
+		}
+		// The next step starts from the end of this one
+		hour = step.UntilHour
+	}
+	return hours
+}
+
+// LastHour returns the final forecast hour of the schedule or 0 if the
+// schedule is empty.
+func (s ForecastSchedule) LastHour() int {
+	if len(s) == 0 {
+		return 0
+	}
+	return s[len(s)-1].UntilHour
+}
+
+// MissingHours returns the forecast hours expected by the schedule which are
+// absent from hours. Only forecast hours up to the largest in hours are
+// considered so that a run which is still being uploaded is not reported as
+// having gaps. The result is in increasing order.
+func (s ForecastSchedule) MissingHours(hours []int) []int {
+	if len(hours) == 0 {
+		return []int{}
+	}
+
+	maxHour := hours[0]
+	for _, h := range hours {
+		if h > maxHour {
+			maxHour = h
+		}
+	}
+	return s.MissingHoursUntil(hours, maxHour)
+}
+
+// MissingHoursUntil is like MissingHours except that all forecast hours up
+// to and including maxHour are considered.
+func (s ForecastSchedule) MissingHoursUntil(hours []int, maxHour int) []int {
+	present := make(map[int]bool)
+	for _, h := range hours {
+		present[h] = true
+	}
+
+	missing := []int{}
+	for _, h := range s.Hours(maxHour) {
+		if !present[h] {
+			missing = append(missing, h)
+		}
+	}
+	sort.Ints(missing)
+	return missing
+}
@@ -0,0 +1,270 @@
+// Abstraction over external tools which process GRIB2 files
+
+package aonui
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// A GribTool is an external tool which can inspect and decode GRIB2 files.
+type GribTool interface {
+	// Inventory parses the inventory of the GRIB2 file fn.
+	Inventory(fn string) (Inventory, error)
+
+	// Extract writes the records in inv from sourceFn to destFn as packed
+	// 32-bit floats in ExtractByteOrder in West-to-East, South-to-North,
+	// record-by-record order.
+	Extract(inv Inventory, sourceFn string, destFn string) error
+
+	// GridShapes returns the shapes of the records in inv from sourceFn
+	// with one shape per item of inv.
+	GridShapes(inv Inventory, sourceFn string) ([]GridShape, error)
+
+	// LatLonGrid returns the geometry of the record item from sourceFn. If
+	// the record is not on a regular latitude-longitude grid,
+	// ErrNotLatLonGrid is returned.
+	LatLonGrid(item *InventoryItem, sourceFn string) (LatLonGrid, error)
+
+	// Check returns an error if the tool is not installed or unusable.
+	Check() error
+}
+
+// ExtractByteOrder is the byte order of the values written by GribTool.Extract.
+// It defaults to the byte order of the host. Setting it explicitly makes
+// extracted data portable between hosts with differing byte orders.
+var ExtractByteOrder binary.ByteOrder = binary.NativeEndian
+
+// isBigEndian returns true if order is big-endian.
+func isBigEndian(order binary.ByteOrder) bool {
+	return order.Uint16([]byte{0, 1}) == 1
+}
+
+// swapFloat32s reverses the byte order of each 32-bit value in the file fn in
+// place.
+func swapFloat32s(fn string) error {
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 1<<20) // NB: multiple of 4
+	var offset int64
+	for {
+		n, err := f.ReadAt(buf, offset)
+		if n%4 != 0 {
+			return fmt.Errorf("%v is not a whole number of 32-bit values", fn)
+		}
+		for i := 0; i < n; i += 4 {
+			buf[i], buf[i+1], buf[i+2], buf[i+3] = buf[i+3], buf[i+2], buf[i+1], buf[i]
+		}
+		if _, err := f.WriteAt(buf[:n], offset); err != nil {
+			return err
+		}
+		offset += int64(n)
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+// A LatLonGrid describes the geometry of a regular latitude-longitude grid in
+// the West-to-East, South-to-North order data is extracted in. Lat0 and Lon0
+// are the latitude and longitude in degrees of the South-West grid point and
+// DLat and DLon the positive spacing in degrees between rows and columns.
+type LatLonGrid struct {
+	Lat0, Lon0 float64
+	DLat, DLon float64
+}
+
+// ErrNotLatLonGrid is returned by GribTool.LatLonGrid if a record is not on a
+// regular latitude-longitude grid.
+var ErrNotLatLonGrid = errors.New("record is not on a latitude-longitude grid")
+
+// newLatLonGrid returns the LatLonGrid whose first and last rows have
+// latitudes lat1 and lat2 and whose Western-most column has longitude lon0.
+// The rows may be given in either scanning direction.
+func newLatLonGrid(lat1, lat2, lon0, dLat, dLon float64) LatLonGrid {
+	return LatLonGrid{
+		Lat0: math.Min(lat1, lat2), Lon0: lon0,
+		DLat: math.Abs(dLat), DLon: math.Abs(dLon),
+	}
+}
+
+// Wgrib2Tool is a GribTool which uses wgrib2. See Wgrib2Command.
+type Wgrib2Tool struct{}
+
+// Inventory calls Wgrib2Inventory.
+func (Wgrib2Tool) Inventory(fn string) (Inventory, error) {
+	return Wgrib2Inventory(fn)
+}
+
+// Extract calls Wgrib2Extract.
+func (Wgrib2Tool) Extract(inv Inventory, sourceFn string, destFn string) error {
+	return Wgrib2Extract(inv, sourceFn, destFn)
+}
+
+// GridShapes calls Wgrib2GridShapes.
+func (Wgrib2Tool) GridShapes(inv Inventory, sourceFn string) ([]GridShape, error) {
+	return Wgrib2GridShapes(inv, sourceFn)
+}
+
+// LatLonGrid calls Wgrib2LatLonGrid.
+func (Wgrib2Tool) LatLonGrid(item *InventoryItem, sourceFn string) (LatLonGrid, error) {
+	return Wgrib2LatLonGrid(item, sourceFn)
+}
+
+// Check calls CheckWgrib2.
+func (Wgrib2Tool) Check() error {
+	return CheckWgrib2()
+}
+
+// GribBackend is the GribTool used to process GRIB2 files. It defaults to
+// Wgrib2Tool unless the AONUI_GRIB_BACKEND environment variable is set to
+// "eccodes" in which case EccodesTool is used.
+var GribBackend GribTool = Wgrib2Tool{}
+
+func init() {
+	switch os.Getenv("AONUI_GRIB_BACKEND") {
+	case "eccodes":
+		GribBackend = EccodesTool{}
+	}
+}
+
+// copyRecords copies the bytes of each record in inv from the GRIB2 file
+// sourceFn to output in the order they appear in inv.
+func copyRecords(output io.Writer, inv Inventory, sourceFn string) error {
+	in, err := os.Open(sourceFn)
+	if err != nil {
+		return errors.New(fmt.Sprint("error opening input: ", err))
+	}
+	defer in.Close()
+
+	for _, invItem := range inv {
+		// Seek in input
+		if _, err := in.Seek(invItem.Offset, 0); err != nil {
+			return err
+		}
+
+		// Copy to output
+		if _, err := io.CopyN(output, in, invItem.Extent); err != nil {
+			return errors.New(fmt.Sprint("error copying records: ", err))
+		}
+	}
+
+	return nil
+}
+
+// A RecordCopy describes where one record is copied from and to when records
+// are written to a new file.
+type RecordCopy struct {
+	Item         *InventoryItem
+	SourceOffset int64 // Offset of the record in the source file
+	DestOffset   int64 // Offset of the record in the output file
+	Length       int64 // Length of the record in bytes
+}
+
+// A ReorderPlan lists the copies which write the records of an inventory to a
+// new file one after another in inventory order.
+type ReorderPlan []RecordCopy
+
+// NewReorderPlan returns the plan for writing the records in inv one after
+// another. The output offset of each record is the total extent of the records
+// before it.
+func NewReorderPlan(inv Inventory) ReorderPlan {
+	plan := make(ReorderPlan, len(inv))
+	var offset int64
+	for idx, item := range inv {
+		plan[idx] = RecordCopy{
+			Item: item, SourceOffset: item.Offset, DestOffset: offset, Length: item.Extent,
+		}
+		offset += item.Extent
+	}
+	return plan
+}
+
+// TotalLength returns the length of the output written by the plan.
+func (plan ReorderPlan) TotalLength() int64 {
+	if len(plan) == 0 {
+		return 0
+	}
+	last := plan[len(plan)-1]
+	return last.DestOffset + last.Length
+}
+
+// copyRecordsParallel is like copyRecords except that the copies in plan are
+// made by workers goroutines at once, each with its own handle on sourceFn.
+// Each record is written at its DestOffset and so output must support WriteAt.
+// Use copyRecords for outputs which can only be written sequentially. Returns
+// the total number of bytes written.
+func copyRecordsParallel(output io.WriterAt, plan ReorderPlan, sourceFn string, workers int) (int64, error) {
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+		written  int64
+	)
+	setErr := func(err error) {
+		errMu.Lock()
+		defer errMu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	failed := func() bool {
+		errMu.Lock()
+		defer errMu.Unlock()
+		return firstErr != nil
+	}
+
+	// Each worker copies records until there are none left. After a failure,
+	// remaining records are skipped.
+	jobs := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			in, err := os.Open(sourceFn)
+			if err != nil {
+				setErr(errors.New(fmt.Sprint("error opening input: ", err)))
+			} else {
+				defer in.Close()
+			}
+
+			for idx := range jobs {
+				if in == nil || failed() {
+					continue
+				}
+				c := plan[idx]
+				r := io.NewSectionReader(in, c.SourceOffset, c.Length)
+				dst := io.NewOffsetWriter(output, c.DestOffset)
+				n, err := io.CopyN(dst, r, c.Length)
+				atomic.AddInt64(&written, n)
+				if err != nil {
+					setErr(errors.New(fmt.Sprint("error copying records: ", err)))
+				}
+			}
+		}()
+	}
+
+	for idx := range plan {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	return written, firstErr
+}
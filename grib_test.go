@@ -0,0 +1,158 @@
+package aonui
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewReorderPlan(t *testing.T) {
+	inv := Inventory{
+		{RecordNumber: 3, Offset: 300, Extent: 50},
+		{RecordNumber: 1, Offset: 0, Extent: 100},
+		{RecordNumber: 2, Offset: 100, Extent: 200},
+	}
+
+	plan := NewReorderPlan(inv)
+	want := ReorderPlan{
+		{Item: inv[0], SourceOffset: 300, DestOffset: 0, Length: 50},
+		{Item: inv[1], SourceOffset: 0, DestOffset: 50, Length: 100},
+		{Item: inv[2], SourceOffset: 100, DestOffset: 150, Length: 200},
+	}
+	if !reflect.DeepEqual(plan, want) {
+		t.Errorf("got plan %+v, want %+v", plan, want)
+	}
+	if got := plan.TotalLength(); got != 350 {
+		t.Errorf("got total length %d, want 350", got)
+	}
+
+	if got := NewReorderPlan(Inventory{}).TotalLength(); got != 0 {
+		t.Errorf("got total length %d for an empty plan, want 0", got)
+	}
+}
+
+// writeRecordsFile writes n records of length recordLength to a temporary
+// file, each filled with its own byte value, and returns the file's name and
+// an inventory of its records.
+func writeRecordsFile(tb testing.TB, n int, recordLength int64) (string, Inventory) {
+	var (
+		contents []byte
+		inv      Inventory
+	)
+	for idx := 0; idx < n; idx++ {
+		inv = append(inv, &InventoryItem{
+			RecordNumber: idx + 1, Offset: int64(idx) * recordLength, Extent: recordLength,
+		})
+		contents = append(contents, bytes.Repeat([]byte{byte(idx)}, int(recordLength))...)
+	}
+
+	fn := filepath.Join(tb.TempDir(), "records.grib2")
+	if err := ioutil.WriteFile(fn, contents, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	return fn, inv
+}
+
+// reversed returns inv in reverse order.
+func reversed(inv Inventory) Inventory {
+	out := Inventory{}
+	for idx := len(inv) - 1; idx >= 0; idx-- {
+		out = append(out, inv[idx])
+	}
+	return out
+}
+
+func TestCopyRecordsParallel(t *testing.T) {
+	sourceFn, inv := writeRecordsFile(t, 10, 1000)
+	inv = reversed(inv)
+	plan := NewReorderPlan(inv)
+
+	// Serial copy for comparison
+	var serial bytes.Buffer
+	if err := copyRecords(&serial, inv, sourceFn); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.grib2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	written, err := copyRecordsParallel(out, plan, sourceFn, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != plan.TotalLength() {
+		t.Errorf("wrote %d bytes, want %d", written, plan.TotalLength())
+	}
+
+	parallel, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parallel, serial.Bytes()) {
+		t.Error("parallel and serial copies differ")
+	}
+}
+
+func TestCopyRecordsParallelShortSource(t *testing.T) {
+	sourceFn, inv := writeRecordsFile(t, 4, 1000)
+
+	// Claim the last record is longer than the file
+	inv[len(inv)-1].Extent = 2000
+	plan := NewReorderPlan(inv)
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.grib2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	written, err := copyRecordsParallel(out, plan, sourceFn, 2)
+	if err == nil {
+		t.Error("expected an error copying beyond the end of the source")
+	}
+	if written >= plan.TotalLength() {
+		t.Errorf("wrote %d bytes of %d from a short source", written, plan.TotalLength())
+	}
+}
+
+// benchmarkReorder copies 64 records of 256KiB in reverse order with the
+// given number of workers, or serially if workers is zero.
+func benchmarkReorder(b *testing.B, workers int) {
+	const (
+		nRecords     = 64
+		recordLength = 256 << 10
+	)
+	sourceFn, inv := writeRecordsFile(b, nRecords, recordLength)
+	inv = reversed(inv)
+	plan := NewReorderPlan(inv)
+	destFn := filepath.Join(b.TempDir(), "out.grib2")
+
+	b.SetBytes(plan.TotalLength())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out, err := os.Create(destFn)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if workers > 0 {
+			_, err = copyRecordsParallel(out, plan, sourceFn, workers)
+		} else {
+			err = copyRecords(out, inv, sourceFn)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		out.Close()
+	}
+}
+
+func BenchmarkReorderSerial(b *testing.B)    { benchmarkReorder(b, 0) }
+func BenchmarkReorderParallel2(b *testing.B) { benchmarkReorder(b, 2) }
+func BenchmarkReorderParallel4(b *testing.B) { benchmarkReorder(b, 4) }
+func BenchmarkReorderParallel8(b *testing.B) { benchmarkReorder(b, 8) }
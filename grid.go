@@ -0,0 +1,204 @@
+// Parsing grid descriptions
+
+package aonui
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A GridGeometry is a complete description of the grid a record is on.
+type GridGeometry struct {
+	Template   int    `json:"template"`             // GRIB2 grid definition template number
+	Projection string `json:"projection"`           // "latlon", "gaussian", "lambert" or wgrib2's description of the grid
+	NX         int    `json:"nx"`                   // Number of columns
+	NY         int    `json:"ny"`                   // Number of rows
+	InputScan  string `json:"inputScan,omitempty"`  // Scanning order of the record, e.g. "WE:NS"
+	OutputScan string `json:"outputScan,omitempty"` // Scanning order data is extracted in, e.g. "WE:SN"
+	Global     bool   `json:"global"`               // Whether the grid wraps around the globe in longitude
+
+	// Details of the projection (or nil if the grid is of another
+	// projection)
+	LatLon  *LatLonGeometry  `json:"latLon,omitempty"`
+	Lambert *LambertGeometry `json:"lambert,omitempty"`
+}
+
+// A LatLonGeometry describes a latitude-longitude or Gaussian grid. All values
+// are in degrees.
+type LatLonGeometry struct {
+	Lat1      float64 `json:"lat1"`                // Latitude of the first row
+	Lat2      float64 `json:"lat2"`                // Latitude of the last row
+	Lon1      float64 `json:"lon1"`                // Longitude of the first column
+	Lon2      float64 `json:"lon2"`                // Longitude of the last column
+	DLat      float64 `json:"dLat,omitempty"`      // Spacing between rows (or 0 for a Gaussian grid)
+	DLon      float64 `json:"dLon"`                // Spacing between columns
+	NGaussian int     `json:"nGaussian,omitempty"` // Number of rows between a pole and the equator of a Gaussian grid
+}
+
+// A LambertGeometry describes a Lambert Conformal grid. Angles are in degrees
+// and distances in metres.
+type LambertGeometry struct {
+	Lat1   float64 `json:"lat1"`   // Latitude of the first grid point
+	Lon1   float64 `json:"lon1"`   // Longitude of the first grid point
+	LoV    float64 `json:"loV"`    // Longitude parallel to the y-axis
+	LatD   float64 `json:"latD"`   // Latitude at which Dx and Dy are specified
+	Latin1 float64 `json:"latin1"` // First latitude at which the cone cuts the sphere
+	Latin2 float64 `json:"latin2"` // Second latitude at which the cone cuts the sphere
+	LatSP  float64 `json:"latSP"`  // Latitude of the southern pole of projection
+	LonSP  float64 `json:"lonSP"`  // Longitude of the southern pole of projection
+	Dx     float64 `json:"dx"`     // Spacing between columns
+	Dy     float64 `json:"dy"`     // Spacing between rows
+	Pole   string  `json:"pole"`   // Pole in the projection plane, "north" or "south"
+}
+
+// Regular expressions matching parts of the output from "wgrib2 -grid". The
+// output varies by projection. For example, a latitude-longitude grid:
+//
+//	1:0:grid_template=0:winds(N/S):
+//		lat-lon grid:(720 x 361) units 1e-06 input WE:NS output WE:SN res 48
+//		lat 90.000000 to -90.000000 by 0.500000
+//		lon 0.000000 to 359.500000 by 0.500000 #points=259920
+//
+// a Gaussian grid:
+//
+//	1:0:grid_template=40:winds(N/S):
+//		Gaussian grid:(3072 x 1536) units 1e-06 input WE:NS output WE:SN
+//		number of latitudes between pole-equator=768 #points=4718592
+//		lat 89.910324 to -89.910324
+//		lon 0.000000 to 359.882812 by 0.117188
+//
+// and a Lambert Conformal grid:
+//
+//	1:0:grid_template=30:winds(grid):
+//		Lambert Conformal: (1799 x 1059) input WE:SN output WE:SN res 8
+//		Lat1 21.138123 Lon1 237.280472 LoV 262.500000
+//		LatD 38.500000 Latin1 38.500000 Latin2 38.500000
+//		LatSP 0.000000 LonSP 0.000000
+//		North Pole (1799 x 1059) Dx 3000.000000 m Dy 3000.000000 m mode 8
+var (
+	gridTemplateRegex = regexp.MustCompile(`grid_template=([0-9]+)`)
+	gridSizeRegex     = regexp.MustCompile(`(?m)^\s*([A-Za-z][^:\n]*):\s*\(([0-9]+)\s*x\s*([0-9]+)\)`)
+	gridScanRegex     = regexp.MustCompile(`input\s+(\S+)\s+output\s+(\S+)`)
+	gridLatRangeRegex = regexp.MustCompile(`lat\s+(-?[0-9.]+)\s+to\s+(-?[0-9.]+)(?:\s+by\s+(-?[0-9.]+))?`)
+	gridGaussianRegex = regexp.MustCompile(`pole-equator=([0-9]+)`)
+	gridPoleRegex     = regexp.MustCompile(`(North|South) Pole`)
+)
+
+// Names of the projections of GRIB2 grid definition templates
+var gridProjections = map[int]string{
+	0:  "latlon",
+	30: "lambert",
+	40: "gaussian",
+}
+
+// parseWgrib2Grid parses the output of "wgrib2 -grid" for a single record.
+// Grids of projections other than those in gridProjections are described only
+// by their template, size and scanning order.
+func parseWgrib2Grid(out string) (GridGeometry, error) {
+	var geom GridGeometry
+
+	submatches := gridTemplateRegex.FindStringSubmatch(out)
+	if submatches == nil {
+		return geom, errors.New("no grid template in wgrib2 output")
+	}
+	geom.Template, _ = strconv.Atoi(submatches[1])
+
+	submatches = gridSizeRegex.FindStringSubmatch(out)
+	if submatches == nil {
+		return geom, errors.New("no grid size in wgrib2 output")
+	}
+	geom.NX, _ = strconv.Atoi(submatches[2])
+	geom.NY, _ = strconv.Atoi(submatches[3])
+
+	var ok bool
+	if geom.Projection, ok = gridProjections[geom.Template]; !ok {
+		geom.Projection = strings.TrimSpace(submatches[1])
+	}
+
+	if submatches = gridScanRegex.FindStringSubmatch(out); submatches != nil {
+		geom.InputScan, geom.OutputScan = submatches[1], submatches[2]
+	}
+
+	var err error
+	switch geom.Projection {
+	case "latlon", "gaussian":
+		geom.LatLon, err = parseWgrib2LatLonGrid(out)
+		if err == nil {
+			// The grid wraps if one more column would bring us back
+			// to the first.
+			ll := geom.LatLon
+			geom.Global = ll.DLon > 0 &&
+				math.Abs(float64(geom.NX)*ll.DLon-360) < ll.DLon/2
+		}
+	case "lambert":
+		geom.Lambert, err = parseWgrib2LambertGrid(out)
+	}
+
+	return geom, err
+}
+
+// parseWgrib2LatLonGrid parses the output of "wgrib2 -grid" for a
+// latitude-longitude or Gaussian grid.
+func parseWgrib2LatLonGrid(out string) (*LatLonGeometry, error) {
+	var ll LatLonGeometry
+
+	submatches := gridLatRangeRegex.FindStringSubmatch(out)
+	if submatches == nil {
+		return nil, errors.New("no latitudes in wgrib2 output")
+	}
+	ll.Lat1, _ = strconv.ParseFloat(submatches[1], 64)
+	ll.Lat2, _ = strconv.ParseFloat(submatches[2], 64)
+	if submatches[3] != "" {
+		dLat, _ := strconv.ParseFloat(submatches[3], 64)
+		ll.DLat = math.Abs(dLat)
+	}
+
+	submatches = gridLonRegex.FindStringSubmatch(out)
+	if submatches == nil {
+		return nil, errors.New("no longitudes in wgrib2 output")
+	}
+	ll.Lon1, _ = strconv.ParseFloat(submatches[1], 64)
+	ll.Lon2, _ = strconv.ParseFloat(submatches[2], 64)
+	dLon, _ := strconv.ParseFloat(submatches[3], 64)
+	ll.DLon = math.Abs(dLon)
+
+	if submatches = gridGaussianRegex.FindStringSubmatch(out); submatches != nil {
+		ll.NGaussian, _ = strconv.Atoi(submatches[1])
+	}
+
+	return &ll, nil
+}
+
+// parseWgrib2LambertGrid parses the output of "wgrib2 -grid" for a Lambert
+// Conformal grid.
+func parseWgrib2LambertGrid(out string) (*LambertGeometry, error) {
+	var lc LambertGeometry
+
+	fields := []struct {
+		Key   string
+		Value *float64
+	}{
+		{"Lat1", &lc.Lat1}, {"Lon1", &lc.Lon1}, {"LoV", &lc.LoV},
+		{"LatD", &lc.LatD}, {"Latin1", &lc.Latin1}, {"Latin2", &lc.Latin2},
+		{"LatSP", &lc.LatSP}, {"LonSP", &lc.LonSP},
+		{"Dx", &lc.Dx}, {"Dy", &lc.Dy},
+	}
+	for _, f := range fields {
+		re := regexp.MustCompile(`\b` + f.Key + `\s+(-?[0-9.]+)`)
+		submatches := re.FindStringSubmatch(out)
+		if submatches == nil {
+			return nil, fmt.Errorf("no %v in wgrib2 output", f.Key)
+		}
+		*f.Value, _ = strconv.ParseFloat(submatches[1], 64)
+	}
+
+	if submatches := gridPoleRegex.FindStringSubmatch(out); submatches != nil {
+		lc.Pole = strings.ToLower(submatches[1])
+	}
+
+	return &lc, nil
+}
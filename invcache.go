@@ -0,0 +1,89 @@
+// On-disk cache of dataset inventories
+
+package aonui
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Directory in which inventories are cached. If empty, inventories are not
+// cached.
+var inventoryCacheDir string
+
+// SetInventoryCacheDir sets the directory in which FetchInventory caches
+// inventories. Cached inventories are keyed by the dataset URL and length and
+// so a dataset which has been replaced on the server with one of a different
+// length is fetched again. The directory is created if it does not exist. An
+// empty path disables the cache, which is the default. SetInventoryCacheDir
+// should not be called while inventories are being fetched.
+func SetInventoryCacheDir(path string) {
+	inventoryCacheDir = path
+}
+
+// inventoryCacheFilename returns the name of the cache file for the inventory
+// of the dataset at datasetURL whose length is datasetLength.
+func inventoryCacheFilename(datasetURL string, datasetLength int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v\n%d", datasetURL, datasetLength)))
+	return filepath.Join(inventoryCacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// loadCachedInventory returns the cached inventory for the dataset at
+// datasetURL whose length is datasetLength. If the cache is disabled or has no
+// such inventory, nil is returned.
+func loadCachedInventory(datasetURL string, datasetLength int64) Inventory {
+	if inventoryCacheDir == "" {
+		return nil
+	}
+
+	contents, err := ioutil.ReadFile(inventoryCacheFilename(datasetURL, datasetLength))
+	if err != nil {
+		return nil
+	}
+
+	var inv Inventory
+	if err := json.Unmarshal(contents, &inv); err != nil {
+		return nil
+	}
+	return inv
+}
+
+// saveCachedInventory stores inv in the cache as the inventory for the dataset
+// at datasetURL whose length is datasetLength. It does nothing if the cache is
+// disabled.
+func saveCachedInventory(datasetURL string, datasetLength int64, inv Inventory) error {
+	if inventoryCacheDir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(inventoryCacheDir, 0777); err != nil {
+		return err
+	}
+
+	contents, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename so that concurrent readers never
+	// see a partially written inventory
+	tmpFile, err := ioutil.TempFile(inventoryCacheDir, "inventory-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmpFile.Write(contents); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), inventoryCacheFilename(datasetURL, datasetLength))
+}
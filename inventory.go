@@ -9,6 +9,7 @@ import (
 	"io"
 	"log"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -26,11 +27,139 @@ type InventoryItem struct {
 	LayerName         string
 	TypeName          string
 	FieldAverageCount int
+
+	// If true, the size of the record is not known and Extent is zero.
+	// This is only the case for the last record of an inventory parsed
+	// with a total length of UnknownLength. Such a record cannot be
+	// fetched by Dataset.FetchAndWriteRecords.
+	ExtentUnknown bool `json:",omitempty"`
+
+	// The dataset the record was fetched from (or nil if unknown). This is
+	// set by Dataset.FetchInventory so that records from the inventories
+	// of several datasets may be merged. See FetchMergedInventory.
+	Dataset *Dataset `json:"-"`
 }
 
+// UnknownLength may be passed as the total length to ParseInventory if the
+// length of the GRIB2 message is not known.
+const UnknownLength = -1
+
 // An Inventory is composed of zero or more InventoryItems.
 type Inventory []*InventoryItem
 
+// EndOffset returns the offset of the byte immediately after the record.
+func (item *InventoryItem) EndOffset() int64 {
+	return item.Offset + item.Extent
+}
+
+// Key returns a string identifying the parameters, layer and type of the
+// record. Records with the same key in the primary and secondary datasets of a
+// forecast hour are duplicates.
+func (item *InventoryItem) Key() string {
+	return strings.Join(item.Parameters, ",") + ":" + item.LayerName + ":" + item.TypeName
+}
+
+// Filter returns those items in the inventory for which predicate returns
+// true. The order of items is preserved.
+func (inv Inventory) Filter(predicate func(*InventoryItem) bool) Inventory {
+	out := Inventory{}
+	for _, item := range inv {
+		if predicate(item) {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// WithParameters returns those items in the inventory with any of params as
+// a parameter.
+func (inv Inventory) WithParameters(params ...string) Inventory {
+	want := make(map[string]bool)
+	for _, p := range params {
+		want[p] = true
+	}
+	return inv.Filter(func(item *InventoryItem) bool {
+		for _, p := range item.Parameters {
+			if want[p] {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// TotalExtent returns the total size in bytes of the records in the
+// inventory.
+func (inv Inventory) TotalExtent() int64 {
+	var total int64
+	for _, item := range inv {
+		total += item.Extent
+	}
+	return total
+}
+
+// ExtentByParameter returns the number of bytes in the inventory for each
+// parameter. The extent of a record with more than one parameter (e.g. wind
+// vectors) is split evenly between its parameters with any remainder going to
+// the first. The values therefore sum to TotalExtent.
+func (inv Inventory) ExtentByParameter() map[string]int64 {
+	extents := make(map[string]int64)
+	for _, item := range inv {
+		nParams := int64(len(item.Parameters))
+		if nParams == 0 {
+			continue
+		}
+		share := item.Extent / nParams
+		for _, p := range item.Parameters {
+			extents[p] += share
+		}
+		extents[item.Parameters[0]] += item.Extent - share*nParams
+	}
+	return extents
+}
+
+// An InventoryVariable is a distinct combination of parameter, layer and type
+// found in an inventory along with the number of records it appears in.
+type InventoryVariable struct {
+	Parameter string `json:"parameter"`
+	LayerName string `json:"layer"`
+	TypeName  string `json:"type"`
+	Count     int    `json:"count"`
+}
+
+// Variables returns the distinct combinations of parameter, layer and type in
+// the inventory without any interpretation of their meaning. A record with more
+// than one parameter counts towards each. The result is sorted by parameter,
+// layer and type.
+func (inv Inventory) Variables() []InventoryVariable {
+	type key struct{ Parameter, LayerName, TypeName string }
+	counts := make(map[key]int)
+	for _, item := range inv {
+		for _, p := range item.Parameters {
+			counts[key{p, item.LayerName, item.TypeName}]++
+		}
+	}
+
+	vars := []InventoryVariable{}
+	for k, count := range counts {
+		vars = append(vars, InventoryVariable{
+			Parameter: k.Parameter, LayerName: k.LayerName, TypeName: k.TypeName,
+			Count: count,
+		})
+	}
+	sort.Slice(vars, func(i, j int) bool {
+		a, b := vars[i], vars[j]
+		if a.Parameter != b.Parameter {
+			return a.Parameter < b.Parameter
+		}
+		if a.LayerName != b.LayerName {
+			return a.LayerName < b.LayerName
+		}
+		return a.TypeName < b.TypeName
+	})
+	return vars
+}
+
 // Wgrib2Strings will format an inventory item as a slice of wgrib2-format
 // index records. Specify which record within the file this item is via the
 // 0-based idx argument.
@@ -47,7 +176,12 @@ func (item *InventoryItem) Wgrib2Strings() []string {
 			fac = fmt.Sprint(item.FieldAverageCount)
 		}
 
+		// Only include minutes if necessary for compatibility with
+		// tools expecting YYYYMMDDHH
 		when := item.When.Format("2006010215")
+		if item.When.Minute() != 0 {
+			when = item.When.Format("200601021504")
+		}
 
 		line := fmt.Sprintf("%v%v:%d:d=%v:%v:%v:%v:%v",
 			item.RecordNumber, subParam, item.Offset, when, param,
@@ -60,8 +194,28 @@ func (item *InventoryItem) Wgrib2Strings() []string {
 
 // ParseInventory parses a wgrib2-style "short" inventory. The inventory is
 // read from stream. The total length of the GRIB2 message should be passed as
-// totalLength.
+// totalLength. An error is returned if the record offsets are not strictly
+// increasing or if the final record would extend beyond totalLength.
+//
+// If totalLength is UnknownLength, as when inspecting an inventory without its
+// GRIB2 message, the final record has a zero Extent and ExtentUnknown set.
 func ParseInventory(stream io.Reader, totalLength int64) (Inventory, error) {
+	return parseInventory(stream, totalLength, false)
+}
+
+// StrictParseInventory is like ParseInventory except that it also returns an
+// error if a sub-record (e.g. "3.2") does not match the record it is part of
+// in record number, offset, date, layer or type.
+func StrictParseInventory(stream io.Reader, totalLength int64) (Inventory, error) {
+	return parseInventory(stream, totalLength, true)
+}
+
+// Maximum length of a line in an inventory. Real inventory lines are around a
+// hundred bytes long so anything longer is almost certainly not an inventory.
+const maxInventoryLineLength = 64 << 10
+
+// parseInventory implements ParseInventory and StrictParseInventory.
+func parseInventory(stream io.Reader, totalLength int64, strict bool) (Inventory, error) {
 	var (
 		inventory Inventory
 		lastItem  *InventoryItem
@@ -70,11 +224,8 @@ func ParseInventory(stream io.Reader, totalLength int64) (Inventory, error) {
 	// Process each line of the index. We postpone appending the next item
 	// from the inventory until we can calculate the extent.
 	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 0, 4096), maxInventoryLineLength)
 	for scanner.Scan() {
-		if err := scanner.Err(); err != nil {
-			return nil, err
-		}
-
 		line := scanner.Text()
 		fields := strings.Split(line, ":")
 		if len(fields) < 7 {
@@ -139,6 +290,10 @@ func ParseInventory(stream io.Reader, totalLength int64) (Inventory, error) {
 			}
 
 			if lastItem != nil {
+				if item.Offset <= lastItem.Offset {
+					return nil, fmt.Errorf("record %d offset %d does not follow record %d offset %d",
+						item.RecordNumber, item.Offset, lastItem.RecordNumber, lastItem.Offset)
+				}
 				lastItem.Extent = item.Offset - lastItem.Offset
 				inventory = append(inventory, lastItem)
 			}
@@ -150,24 +305,58 @@ func ParseInventory(stream io.Reader, totalLength int64) (Inventory, error) {
 				return nil, errors.New("unexpected sub-record number >1")
 			}
 
-			lastItem.Parameters = append(lastItem.Parameters, fields[3])
+			// Check that the last item matches in all other fields
+			if strict {
+				switch {
+				case record != lastItem.RecordNumber:
+					return nil, fmt.Errorf("sub-record %v does not follow record %d",
+						fields[0], lastItem.RecordNumber)
+				case offset != lastItem.Offset:
+					return nil, fmt.Errorf("sub-record %v offset %d does not match %d",
+						fields[0], offset, lastItem.Offset)
+				case !date.Equal(lastItem.When):
+					return nil, fmt.Errorf("sub-record %v date %v does not match %v",
+						fields[0], date, lastItem.When)
+				case fields[4] != lastItem.LayerName:
+					return nil, fmt.Errorf("sub-record %v layer %q does not match %q",
+						fields[0], fields[4], lastItem.LayerName)
+				case fields[5] != lastItem.TypeName:
+					return nil, fmt.Errorf("sub-record %v type %q does not match %q",
+						fields[0], fields[5], lastItem.TypeName)
+				}
+			}
 
-			// TODO: Check that the last item matches in all other fields
+			lastItem.Parameters = append(lastItem.Parameters, fields[3])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return nil, fmt.Errorf("inventory line longer than %d bytes; is this an inventory?",
+				maxInventoryLineLength)
 		}
+		return nil, err
 	}
 
 	// Append the final item
-	if lastItem != nil {
+	if lastItem != nil && totalLength == UnknownLength {
+		lastItem.ExtentUnknown = true
+		inventory = append(inventory, lastItem)
+	} else if lastItem != nil {
 		lastItem.Extent = totalLength - lastItem.Offset
+		if lastItem.Extent < 0 {
+			return nil, fmt.Errorf("record %d offset %d is beyond total length %d",
+				lastItem.RecordNumber, lastItem.Offset, totalLength)
+		}
 		inventory = append(inventory, lastItem)
 	}
 
 	return inventory, nil
 }
 
-// Parse a string of the form d=YYYYMMDDHH and return a time.Time struct.
+// Parse a string of the form d=YYYYMMDDHH or d=YYYYMMDDHHmm and return a
+// time.Time struct.
 func parseDateField(s string) (time.Time, error) {
-	re, err := regexp.Compile(`^d=(\d{4})(\d{2})(\d{2})(\d{2})$`)
+	re, err := regexp.Compile(`^d=(\d{4})(\d{2})(\d{2})(\d{2})(\d{2})?$`)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -181,6 +370,7 @@ func parseDateField(s string) (time.Time, error) {
 	month, _ := strconv.Atoi(submatches[2])
 	day, _ := strconv.Atoi(submatches[3])
 	hour, _ := strconv.Atoi(submatches[4])
+	minute, _ := strconv.Atoi(submatches[5]) // zero if absent
 
-	return time.Date(year, time.Month(month), day, hour, 0, 0, 0, time.UTC), nil
+	return time.Date(year, time.Month(month), day, hour, minute, 0, 0, time.UTC), nil
 }
@@ -0,0 +1,134 @@
+package aonui
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseInventoryOffsets(t *testing.T) {
+	for _, test := range []struct {
+		Name    string
+		Index   string
+		WantErr bool
+	}{
+		{
+			Name: "sub-records share an offset",
+			Index: "1:0:d=2014060100:HGT:500 mb:anl:\n" +
+				"2.1:100:d=2014060100:UGRD:500 mb:anl:\n" +
+				"2.2:100:d=2014060100:VGRD:500 mb:anl:\n",
+		},
+		{
+			Name: "records share an offset",
+			Index: "1:0:d=2014060100:HGT:500 mb:anl:\n" +
+				"2:100:d=2014060100:UGRD:500 mb:anl:\n" +
+				"3:100:d=2014060100:VGRD:500 mb:anl:\n",
+			WantErr: true,
+		},
+		{
+			Name: "offsets decrease",
+			Index: "1:100:d=2014060100:HGT:500 mb:anl:\n" +
+				"2:0:d=2014060100:UGRD:500 mb:anl:\n",
+			WantErr: true,
+		},
+		{
+			Name:    "beyond total length",
+			Index:   "1:300:d=2014060100:HGT:500 mb:anl:\n",
+			WantErr: true,
+		},
+	} {
+		_, err := ParseInventory(strings.NewReader(test.Index), 250)
+		if test.WantErr && err == nil {
+			t.Errorf("%v: expected an error", test.Name)
+		} else if !test.WantErr && err != nil {
+			t.Errorf("%v: %v", test.Name, err)
+		}
+	}
+}
+
+func TestParseInventorySubRecords(t *testing.T) {
+	index := "1:0:d=2014060100:HGT:500 mb:anl:\n" +
+		"2.1:100:d=2014060100:UGRD:500 mb:anl:\n" +
+		"2.2:100:d=2014060100:VGRD:500 mb:anl:\n"
+
+	inv, err := ParseInventory(strings.NewReader(index), 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inv) != 2 {
+		t.Fatalf("got %d records, want 2", len(inv))
+	}
+	if got := inv[1].Parameters; !reflect.DeepEqual(got, []string{"UGRD", "VGRD"}) {
+		t.Errorf("wind record has parameters %v", got)
+	}
+	if inv[0].Extent != 100 || inv[1].Extent != 150 {
+		t.Errorf("got extents %d and %d, want 100 and 150", inv[0].Extent, inv[1].Extent)
+	}
+}
+
+func TestParseDateFieldMinutes(t *testing.T) {
+	for _, test := range []struct {
+		Field string
+		Want  time.Time
+	}{
+		{"d=2014060100", time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"d=201406011215", time.Date(2014, 6, 1, 12, 15, 0, 0, time.UTC)},
+	} {
+		got, err := parseDateField(test.Field)
+		if err != nil {
+			t.Errorf("%v: %v", test.Field, err)
+		} else if !got.Equal(test.Want) {
+			t.Errorf("%v: got %v, want %v", test.Field, got, test.Want)
+		}
+	}
+
+	for _, field := range []string{"d=20140601", "d=20140601121", "d=2014060112150"} {
+		if _, err := parseDateField(field); err == nil {
+			t.Errorf("%v: expected an error", field)
+		}
+	}
+}
+
+func TestWgrib2StringsRoundTripMinutes(t *testing.T) {
+	for _, test := range []struct {
+		When time.Time
+		Date string
+	}{
+		// Whole hours keep the 10 digit form for compatibility
+		{time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC), "d=2014060112"},
+		{time.Date(2014, 6, 1, 12, 15, 0, 0, time.UTC), "d=201406011215"},
+	} {
+		item := &InventoryItem{
+			RecordNumber: 1, Offset: 0, When: test.When,
+			Parameters: []string{"HGT"}, LayerName: "500 mb", TypeName: "anl",
+		}
+		lines := item.Wgrib2Strings()
+		if len(lines) != 1 || strings.Split(lines[0], ":")[2] != test.Date {
+			t.Errorf("formatted %v as %q, want date %v", test.When, lines, test.Date)
+			continue
+		}
+
+		inv, err := ParseInventory(strings.NewReader(lines[0]+"\n"), 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(inv) != 1 || !inv[0].When.Equal(test.When) {
+			t.Errorf("%q parsed as %+v, want time %v", lines[0], inv, test.When)
+		}
+	}
+}
+
+func TestParseInventoryLongLine(t *testing.T) {
+	// A valid record followed by a megabyte-long line, as from a file which
+	// is not an inventory
+	index := "1:0:d=2014060100:HGT:500 mb:anl:\n" + strings.Repeat("x", 1<<20) + "\n"
+
+	_, err := ParseInventory(strings.NewReader(index), 250)
+	if err == nil {
+		t.Fatal("expected an error for an overlong line")
+	}
+	if !strings.Contains(err.Error(), "longer than") {
+		t.Errorf("unclear error for an overlong line: %v", err)
+	}
+}
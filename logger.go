@@ -0,0 +1,60 @@
+// Logging
+
+package aonui
+
+import (
+	"log"
+	"sync"
+)
+
+// A Logger receives the messages logged by this package. Embedders may use
+// SetLogger to redirect, filter or structure them.
+type Logger interface {
+	Debugf(format string, args ...interface{}) // Detail only useful when debugging
+	Infof(format string, args ...interface{})  // Progress of normal operation
+	Warnf(format string, args ...interface{})  // Problems which are recovered from, e.g. by retrying
+	Errorf(format string, args ...interface{}) // Problems which cause an operation to fail
+}
+
+// stdLogger is a Logger which writes every message to the standard library's
+// log package whatever its level.
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...interface{}) { log.Printf(format, args...) }
+func (stdLogger) Infof(format string, args ...interface{})  { log.Printf(format, args...) }
+func (stdLogger) Warnf(format string, args ...interface{})  { log.Printf(format, args...) }
+func (stdLogger) Errorf(format string, args ...interface{}) { log.Printf(format, args...) }
+
+// nopLogger is a Logger which discards every message.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+// The Logger used by the package
+var (
+	pkgLogger   Logger = stdLogger{}
+	pkgLoggerMu sync.RWMutex
+)
+
+// SetLogger sets the Logger messages from this package are sent to. By
+// default, messages are written to the standard library's log package. If l
+// is nil, messages are discarded.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+
+	pkgLoggerMu.Lock()
+	defer pkgLoggerMu.Unlock()
+	pkgLogger = l
+}
+
+// logger returns the Logger set by SetLogger.
+func logger() Logger {
+	pkgLoggerMu.RLock()
+	defer pkgLoggerMu.RUnlock()
+	return pkgLogger
+}
@@ -3,9 +3,18 @@
 package aonui
 
 import (
+	"bytes"
+	"context"
 	"errors"
-	"log"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
 	"code.google.com/p/go.net/html"
@@ -16,54 +25,505 @@ import (
 type FetchStrategy struct {
 	MaximumRetries int           // Maximum retry count when fetching URLs
 	RetrySleep     time.Duration // Time to sleep between tries
-	FetchTimeout   time.Duration // Timeout when fetching individual datasets
+	FetchTimeout   time.Duration // Time without receiving data after which fetching a dataset is abandoned (or 0 for no limit)
+	IndexTimeout   time.Duration // Timeout when fetching index pages and inventories (or 0 to use FetchTimeout)
+	MaxIndexSize   int64         // Maximum size in bytes of HTML index pages (or 0 for default)
+	ProxyURL       string        // URL of HTTP proxy (or "" to use the environment)
+	BackoffFactor  float64       // Factor the sleep grows by after each try (or 0 for a constant RetrySleep)
+	MaxBackoff     time.Duration // Maximum sleep between tries when backing off (or 0 for no limit)
+	RateLimit      int64         // Maximum download rate in bytes per second (or 0 for no limit)
+
+	// Maximum number of idle connections kept open to each host for
+	// re-use by later requests (or 0 for default)
+	MaxIdleConnsPerHost int
+
+	// Maximum number of record fetches from any one host at once across
+	// all datasets using the same limit (or 0 for no limit)
+	MaxFetchesPerHost int
+
+	// Maximum time fetching records from a dataset may take however
+	// quickly data is being received (or 0 for no limit)
+	MaxFetchDuration time.Duration
+
+	// Whether to check that the data for each range of records fetched
+	// starts with the GRIB magic bytes. This catches servers which reply
+	// with an error page in place of the records.
+	CheckGribMagic bool
+
+	// Number of datasets of a run in a row which may fail every try before
+	// fetches from the rest of the run are abandoned (or 0 for no limit).
+	// See Run.CircuitBreaker.
+	MaxConsecutiveFailures int
+
+	// Credentials for HTTP basic authentication (or "" for none)
+	Username, Password string
+
+	// Additional headers sent with each request, e.g. an "Authorization"
+	// header with a bearer token (or nil for none)
+	Headers map[string]string
+}
+
+// RetryDelay returns how long to sleep after the given failed try, numbered
+// from zero. If BackoffFactor is zero, this is always RetrySleep. Otherwise
+// the delay is RetrySleep multiplied by BackoffFactor raised to the power try,
+// capped at MaxBackoff, and randomly reduced by up to half so that clients
+// retrying together spread out.
+func (strategy FetchStrategy) RetryDelay(try int) time.Duration {
+	if strategy.BackoffFactor <= 0 {
+		return strategy.RetrySleep
+	}
+
+	delay := float64(strategy.RetrySleep) * math.Pow(strategy.BackoffFactor, float64(try))
+	if strategy.MaxBackoff > 0 && delay > float64(strategy.MaxBackoff) {
+		delay = float64(strategy.MaxBackoff)
+	}
+
+	return time.Duration(delay/2 + rand.Float64()*delay/2)
+}
+
+// Number of idle connections kept open to each host if the FetchStrategy does
+// not specify one. A sync makes many small range requests to the same server
+// from several goroutines at once so this is far larger than net/http's
+// default of two.
+const defaultMaxIdleConnsPerHost = 16
+
+// A transportKey identifies the settings a shared transport was created with.
+type transportKey struct {
+	ProxyURL            string
+	MaxIdleConnsPerHost int
+}
+
+// Transports used for each combination of proxy URL and connection pool size.
+// Sharing transports allows connections to be re-used across requests and
+// datasets.
+var (
+	sharedTransports   = make(map[transportKey]*http.Transport)
+	sharedTransportsMu sync.Mutex
+)
+
+// client returns an http.Client which fetches via the proxy specified by the
+// strategy with the given timeout (or 0 for no timeout). If the strategy does
+// not specify a proxy, the HTTP_PROXY family of environment variables is
+// honoured. Clients for the same strategy share a transport and so a pool of
+// keep-alive connections.
+func (strategy FetchStrategy) client(timeout time.Duration) (*http.Client, error) {
+	key := transportKey{
+		ProxyURL:            strategy.ProxyURL,
+		MaxIdleConnsPerHost: strategy.MaxIdleConnsPerHost,
+	}
+	if key.MaxIdleConnsPerHost <= 0 {
+		key.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+
+	sharedTransportsMu.Lock()
+	defer sharedTransportsMu.Unlock()
+
+	transport, ok := sharedTransports[key]
+	if !ok {
+		proxy := http.ProxyFromEnvironment
+		if key.ProxyURL != "" {
+			proxyURL, err := url.Parse(key.ProxyURL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy URL: %v", err)
+			}
+			proxy = http.ProxyURL(proxyURL)
+		}
+		transport = newTransport(proxy, key.MaxIdleConnsPerHost)
+		sharedTransports[key] = transport
+	}
+
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+// newTransport returns a transport with the same settings as
+// http.DefaultTransport except for the proxy and the number of idle
+// connections kept open to each host.
+func newTransport(proxy func(*http.Request) (*url.URL, error), maxIdleConnsPerHost int) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	if transport.MaxIdleConns < maxIdleConnsPerHost {
+		transport.MaxIdleConns = maxIdleConnsPerHost
+	}
+	return transport
+}
+
+// A hostSemaphoreKey identifies the semaphore for a host and limit.
+type hostSemaphoreKey struct {
+	Host  string
+	Limit int
+}
+
+// Semaphores limiting the number of simultaneous fetches from each host.
+// Sharing semaphores means that the limit applies to all datasets on a host
+// however many goroutines are fetching them.
+var (
+	hostSemaphores   = make(map[hostSemaphoreKey]chan int)
+	hostSemaphoresMu sync.Mutex
+)
+
+// hostSemaphore returns the semaphore limiting fetches from host or nil if the
+// strategy does not limit fetches per host.
+func (strategy FetchStrategy) hostSemaphore(host string) chan int {
+	if strategy.MaxFetchesPerHost <= 0 {
+		return nil
+	}
+
+	hostSemaphoresMu.Lock()
+	defer hostSemaphoresMu.Unlock()
+
+	key := hostSemaphoreKey{Host: host, Limit: strategy.MaxFetchesPerHost}
+	sem, ok := hostSemaphores[key]
+	if !ok {
+		sem = make(chan int, strategy.MaxFetchesPerHost)
+		hostSemaphores[key] = sem
+	}
+	return sem
+}
+
+// ErrTooManyFailures is returned for fetches abandoned because too many
+// datasets of the run failed in a row. The server is most likely down and
+// retrying each remaining dataset would only delay giving up.
+var ErrTooManyFailures = errors.New("too many consecutive datasets failed")
+
+// A CircuitBreaker counts the datasets of a run which fail every try. Once
+// the count reaches the FetchStrategy's MaxConsecutiveFailures, the breaker
+// trips and further fetches from the run are abandoned. A success resets the
+// count if the breaker has not already tripped. The methods of a nil
+// *CircuitBreaker do nothing and the breaker never trips.
+type CircuitBreaker struct {
+	limit    int
+	mu       sync.Mutex
+	failures int
+	tripped  chan struct{}
+}
+
+// Record records the result of fetching a dataset after all tries have been
+// made. err is nil if the fetch succeeded.
+func (cb *CircuitBreaker) Record(err error) {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	select {
+	case <-cb.tripped:
+		return
+	default:
+	}
+
+	if err == nil {
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.failures >= cb.limit {
+		logger().Errorf("%d datasets failed in a row, abandoning the run", cb.failures)
+		close(cb.tripped)
+	}
+}
+
+// Err returns ErrTooManyFailures if the breaker has tripped and nil
+// otherwise.
+func (cb *CircuitBreaker) Err() error {
+	if cb == nil {
+		return nil
+	}
+
+	select {
+	case <-cb.tripped:
+		return ErrTooManyFailures
+	default:
+		return nil
+	}
+}
+
+// Done returns a channel which is closed when the breaker trips. It may be
+// used to cut short the sleep before a retry.
+func (cb *CircuitBreaker) Done() <-chan struct{} {
+	if cb == nil {
+		return nil
+	}
+	return cb.tripped
+}
+
+// A circuitBreakerKey identifies the circuit breaker for a run and limit.
+type circuitBreakerKey struct {
+	Run   string
+	Limit int
+}
+
+// Circuit breakers for each run. Sharing breakers means that failures are
+// counted across all datasets of a run however many goroutines are fetching
+// them. Breakers are removed by Run.ResetCircuitBreaker.
+var (
+	circuitBreakers   = make(map[circuitBreakerKey]*CircuitBreaker)
+	circuitBreakersMu sync.Mutex
+)
+
+// circuitBreaker returns the breaker for the run with the given URL or nil if
+// the strategy does not limit consecutive failures.
+func (strategy FetchStrategy) circuitBreaker(runURL string) *CircuitBreaker {
+	if strategy.MaxConsecutiveFailures <= 0 {
+		return nil
+	}
+
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+
+	key := circuitBreakerKey{Run: runURL, Limit: strategy.MaxConsecutiveFailures}
+	cb, ok := circuitBreakers[key]
+	if !ok {
+		cb = &CircuitBreaker{limit: strategy.MaxConsecutiveFailures, tripped: make(chan struct{})}
+		circuitBreakers[key] = cb
+	}
+	return cb
+}
+
+// resetCircuitBreakers removes the breakers, whatever their limit, for the run
+// with the given URL.
+func resetCircuitBreakers(runURL string) {
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+
+	for key := range circuitBreakers {
+		if key.Run == runURL {
+			delete(circuitBreakers, key)
+		}
+	}
+}
+
+// Limiters used for each rate limit. Sharing limiters means that the limit
+// applies to the total rate of all downloads using the same limit rather than
+// to each download separately.
+var (
+	rateLimiters   = make(map[int64]*rateLimiter)
+	rateLimitersMu sync.Mutex
+)
+
+// limiter returns the rateLimiter for the strategy or nil if the strategy
+// does not limit the download rate.
+func (strategy FetchStrategy) limiter() *rateLimiter {
+	if strategy.RateLimit <= 0 {
+		return nil
+	}
+
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+
+	limiter, ok := rateLimiters[strategy.RateLimit]
+	if !ok {
+		limiter = &rateLimiter{rate: float64(strategy.RateLimit), last: time.Now()}
+		rateLimiters[strategy.RateLimit] = limiter
+	}
+	return limiter
+}
+
+// A rateLimiter is a token bucket limiting the rate at which bytes are
+// transferred. It is safe to use from multiple goroutines. At most one
+// second's worth of bytes may be transferred in a burst.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64   // Bytes per second
+	tokens float64   // Bytes which may be transferred now (negative if in debt)
+	last   time.Time // Time tokens was last updated
 }
 
+// Wait records that n bytes have been transferred and sleeps until the
+// transfer rate is back within the limit.
+func (l *rateLimiter) Wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// Maximum number of bytes read at once by a rateLimitedBody. Small reads keep
+// the transfer rate smooth.
+const rateLimitedReadSize = 32 << 10
+
+// A rateLimitedBody wraps a response body so that reading from it is limited
+// by Limiter.
+type rateLimitedBody struct {
+	io.ReadCloser
+	Limiter *rateLimiter
+}
+
+func (b *rateLimitedBody) Read(p []byte) (int, error) {
+	if len(p) > rateLimitedReadSize {
+		p = p[:rateLimitedReadSize]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.Limiter.Wait(n)
+	return n, err
+}
+
+// newRequest returns a request for url with the strategy's credentials and
+// additional headers. Note that when following a redirect to another host,
+// Go's HTTP client drops the Authorization header but not other headers.
+func (strategy FetchStrategy) newRequest(ctx context.Context, method, url string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range strategy.Headers {
+		req.Header.Set(k, v)
+	}
+	if strategy.Username != "" {
+		req.SetBasicAuth(strategy.Username, strategy.Password)
+	}
+	return req.WithContext(ctx), nil
+}
+
+// get is like client.Get but the request is made by newRequest.
+func (strategy FetchStrategy) get(client *http.Client, url string) (*http.Response, error) {
+	req, err := strategy.newRequest(context.Background(), "GET", url)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+// indexTimeout returns the timeout used when fetching index pages and
+// inventories.
+func (strategy FetchStrategy) indexTimeout() time.Duration {
+	if strategy.IndexTimeout > 0 {
+		return strategy.IndexTimeout
+	}
+	return strategy.FetchTimeout
+}
+
+// Maximum size of an HTML index page if the FetchStrategy does not specify
+// one. Directory listings are far smaller than this.
+const defaultMaxIndexSize = 4 << 20
+
 // Fetch data via HTTP with retries and sleep times. Returns http.Response and
-// error as per http.Get().
-func getURLWithStrategy(url string, strategy FetchStrategy) (*http.Response, error) {
-	sleepDuration := strategy.RetrySleep
+// error as per http.Get(). Fetching is abandoned if ctx is cancelled. Each try,
+// including reading the response body, times out after the strategy's index
+// timeout.
+func getURLWithStrategy(ctx context.Context, url string, strategy FetchStrategy) (*http.Response, error) {
 	nTries := strategy.MaximumRetries
 	if nTries < 1 {
 		nTries = 1
 	}
 
+	// Use a client with a timeout so that a stalled server does not block
+	// forever.
+	client, err := strategy.client(strategy.indexTimeout())
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := strategy.newRequest(ctx, "GET", url)
+	if err != nil {
+		return nil, err
+	}
+
 	// Keep trying
 	for try := 0; try < nTries; try++ {
-		resp, err := http.Get(url)
+		delay := strategy.RetryDelay(try)
+
+		resp, err := client.Do(req)
 		if err == nil && resp.StatusCode == http.StatusOK {
 			// Everything was fine
 			return resp, nil
 		} else if err == nil {
-			// Some non-OK status was returned
-			log.Print("HTTP GET returned status ", resp.StatusCode, ", retrying.")
+			// Some non-OK status was returned. Wait as long as the
+			// server asks us to if it tells us.
+			logger().Warnf("HTTP GET returned status %d, retrying.", resp.StatusCode)
+			if d, ok := retryAfter(resp, time.Now()); ok {
+				delay = d
+			}
+			resp.Body.Close()
 		} else {
 			// Some network error happened
-			log.Print("HTTP GET returned error: ", err, ". Retrying.")
+			logger().Warnf("HTTP GET returned error: %v. Retrying.", err)
 		}
 
-		time.Sleep(sleepDuration)
+		// Sleep before retrying unless we are cancelled
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 
 	// If we get here, give up.
 	return nil, errors.New("maximum number of retries exceeded")
 }
 
+// Longest delay requested by a Retry-After header which will be honoured.
+// Longer delays are assumed to be mistakes.
+const maxRetryAfter = 30 * time.Minute
+
+// retryAfter parses the Retry-After header of resp which may either be a
+// number of seconds or an HTTP date. Returns false if there is no header or it
+// is invalid or unreasonably far into the future compared to now.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if when, err := http.ParseTime(header); err == nil {
+		delay = when.Sub(now)
+	} else {
+		return 0, false
+	}
+
+	if delay < 0 || delay > maxRetryAfter {
+		return 0, false
+	}
+	return delay, true
+}
+
 // Fetch data from a URL interpreting the result as HTML and return the root of
-// the HTML parse tree. Returns an error if the fetch failed.
-func getAndParse(url string, strategy FetchStrategy) (*html.Node, error) {
+// the HTML parse tree. Returns an error if the fetch failed or ctx was
+// cancelled.
+func getAndParse(ctx context.Context, url string, strategy FetchStrategy) (*html.Node, error) {
 	// Attempt to fetch URL
-	log.Print("Fetching ", url)
-	resp, err := getURLWithStrategy(url, strategy)
+	logger().Debugf("Fetching %v", url)
+	resp, err := getURLWithStrategy(ctx, url, strategy)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	// Read the index, refusing to buffer more than the maximum size.
+	maxSize := strategy.MaxIndexSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxIndexSize
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, fmt.Errorf("index at %v exceeds maximum size of %d bytes", url, maxSize)
+	}
+
 	// Parse index as HTML
-	doc, err := html.Parse(resp.Body)
+	doc, err := html.Parse(bytes.NewReader(body))
 	if err != nil {
-		log.Print("error parsing ", url, ": ", err)
+		logger().Errorf("error parsing %v: %v", url, err)
 		return nil, err
 	}
 
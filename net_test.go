@@ -0,0 +1,47 @@
+package aonui
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	u, _ := url.Parse("http://example.com/gfs.2014060100/")
+	run := &Run{
+		Source: &DataSource{FetchStrategy: FetchStrategy{MaxConsecutiveFailures: 2}},
+		URL:    u,
+	}
+	failure := errors.New("failed")
+
+	// A success resets the count
+	cb := run.CircuitBreaker()
+	cb.Record(failure)
+	cb.Record(nil)
+	cb.Record(failure)
+	if err := cb.Err(); err != nil {
+		t.Fatalf("breaker tripped early: %v", err)
+	}
+
+	cb.Record(failure)
+	if err := run.CircuitBreaker().Err(); err != ErrTooManyFailures {
+		t.Fatalf("got %v, want ErrTooManyFailures", err)
+	}
+	select {
+	case <-cb.Done():
+	default:
+		t.Error("Done not closed after tripping")
+	}
+
+	// Resetting gives a fresh breaker
+	run.ResetCircuitBreaker()
+	if err := run.CircuitBreaker().Err(); err != nil {
+		t.Errorf("breaker still tripped after reset: %v", err)
+	}
+
+	// Without a limit there is no breaker
+	run.Source.FetchStrategy.MaxConsecutiveFailures = 0
+	if cb := run.CircuitBreaker(); cb != nil || cb.Err() != nil {
+		t.Error("expected a nil breaker without a limit")
+	}
+}
@@ -2,17 +2,128 @@
 
 package aonui
 
-import "code.google.com/p/go.net/html"
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.net/html"
+)
 
 type nodeFunc func(node *html.Node)
 
 // Walk a HTML parse tree in a depth first manner calling nodeFn for each node.
+// The walk uses an explicit stack rather than recursion so that deeply nested
+// documents cannot exhaust the goroutine stack.
 func walkNodeTree(root *html.Node, nodeFn nodeFunc) {
-	// Process root
-	nodeFn(root)
+	stack := []*html.Node{root}
+	for len(stack) > 0 {
+		// Pop and process next node
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		nodeFn(node)
+
+		// Push children in reverse so that the first child is next
+		for c := node.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+}
 
-	// Walk children concurrently
-	for c := root.FirstChild; c != nil; c = c.NextSibling {
-		walkNodeTree(c, nodeFn)
+// Resolve href relative to base and return the resolved URL along with an
+// identifier formed from the last segment of its path. This copes with hrefs
+// of the form "name/", "./name/", "/path/to/name/", "//host/path/to/name/"
+// and absolute URLs all of which give the identifier "name". Returns false if
+// href is invalid, has a query (e.g. the column sorting links in directory
+// listings) or has no final path segment.
+func resolveHref(base *url.URL, href string) (*url.URL, string, bool) {
+	relURL, err := url.Parse(href)
+	if err != nil || relURL.RawQuery != "" {
+		return nil, "", false
 	}
+	resolved := base.ResolveReference(relURL)
+
+	identifier := path.Base(strings.TrimRight(resolved.Path, "/"))
+	if identifier == "." || identifier == "/" || identifier == "" {
+		return nil, "", false
+	}
+
+	return resolved, identifier, true
+}
+
+// Layouts used by web servers for modification times in directory listings.
+var listingTimeLayouts = []string{"02-Jan-2006 15:04", "2006-01-02 15:04"}
+
+// Pattern matching any of listingTimeLayouts.
+var listingTimeRegexp = regexp.MustCompile(
+	`\d{2}-[A-Za-z]{3}-\d{4} \d{2}:\d{2}|\d{4}-\d{2}-\d{2} \d{2}:\d{2}`)
+
+// Find the modification time associated with an anchor in a directory
+// listing. Listings place the time after the anchor either in the same
+// pre-formatted block or in a subsequent table cell. Returns the zero time if
+// no modification time could be found.
+func listingModTime(anchor *html.Node) time.Time {
+	match := listingTimeRegexp.FindString(listingText(anchor))
+	for _, layout := range listingTimeLayouts {
+		if t, err := time.Parse(layout, match); err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// Find the size in bytes associated with an anchor in a directory listing.
+// Listings which give exact sizes place them straight after the modification
+// time. Returns 0 if no exact size could be found, e.g. if the listing rounds
+// sizes to "54M".
+func listingSize(anchor *html.Node) int64 {
+	line := listingText(anchor)
+	loc := listingTimeRegexp.FindStringIndex(line)
+	if loc == nil {
+		return 0
+	}
+	fields := strings.Fields(line[loc[1]:])
+	if len(fields) == 0 {
+		return 0
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size
+}
+
+// Collect the text following an anchor on its row of a directory listing. This
+// is the text up to the end of the line within the anchor's parent and, if the
+// anchor is within a table cell, the text of subsequent cells. A row without a
+// modification time must not pick up the time of the row after it.
+func listingText(anchor *html.Node) string {
+	var text []string
+	collect := func(first *html.Node) {
+		for n := first; n != nil; n = n.NextSibling {
+			walkNodeTree(n, func(node *html.Node) {
+				if node.Type == html.TextNode {
+					text = append(text, node.Data)
+				}
+			})
+		}
+	}
+	collect(anchor.NextSibling)
+	line := strings.Join(text, " ")
+	if idx := strings.IndexByte(line, '\n'); idx >= 0 {
+		line = line[:idx]
+	}
+
+	// Cells of a table row may be separated by newlines
+	if p := anchor.Parent; p != nil && (p.Data == "td" || p.Data == "th") {
+		text = nil
+		collect(p.NextSibling)
+		line += " " + strings.Join(strings.Fields(strings.Join(text, " ")), " ")
+	}
+
+	return line
 }
@@ -0,0 +1,148 @@
+package aonui
+
+import (
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.net/html"
+)
+
+// element returns a new element node with the given tag name and children.
+func element(tag string, children ...*html.Node) *html.Node {
+	n := &html.Node{Type: html.ElementNode, Data: tag}
+	for _, c := range children {
+		c.Parent = n
+		if n.LastChild == nil {
+			n.FirstChild = c
+		} else {
+			n.LastChild.NextSibling = c
+			c.PrevSibling = n.LastChild
+		}
+		n.LastChild = c
+	}
+	return n
+}
+
+// text returns a new text node.
+func text(data string) *html.Node {
+	return &html.Node{Type: html.TextNode, Data: data}
+}
+
+// anchor returns a new anchor with the given href and text.
+func anchor(href string) *html.Node {
+	a := element("a", text(href))
+	a.Attr = []html.Attribute{{Key: "href", Val: href}}
+	return a
+}
+
+func TestListingSize(t *testing.T) {
+	exact, rounded, noTime, dir := anchor("exact"), anchor("rounded"), anchor("notime"), anchor("dir/")
+	element("pre",
+		text("\n"), dir, text("\n"),
+		exact, text("     2014-06-01 03:28 54528000\n"),
+		rounded, text("   01-Jun-2014 03:28   54M\n"),
+		noTime, text("    1234\n"),
+	)
+
+	cell := anchor("cell")
+	element("tr", element("td", cell), element("td", text("01-Jun-2014 03:28")), element("td", text("4096")))
+
+	// Cells separated by newlines as in an indented table
+	spaced := anchor("spaced")
+	element("tr", element("td", spaced), text("\n  "), element("td", text("01-Jun-2014 03:28")),
+		text("\n  "), element("td", text("8192")))
+
+	for _, tc := range []struct {
+		anchor *html.Node
+		want   int64
+	}{
+		{exact, 54528000}, {rounded, 0}, {noTime, 0}, {dir, 0}, {cell, 4096}, {spaced, 8192},
+	} {
+		if got := listingSize(tc.anchor); got != tc.want {
+			t.Errorf("size of %v is %d, want %d", tc.anchor.Attr[0].Val, got, tc.want)
+		}
+	}
+}
+
+func TestWalkNodeTreeOrder(t *testing.T) {
+	root := element("html",
+		element("body",
+			element("pre", text("a"), text("b")),
+			element("p", text("c")),
+		),
+		text("d"),
+	)
+
+	var visited []string
+	walkNodeTree(root, func(node *html.Node) {
+		visited = append(visited, node.Data)
+	})
+
+	want := []string{"html", "body", "pre", "a", "b", "p", "c", "d"}
+	if strings.Join(visited, ",") != strings.Join(want, ",") {
+		t.Errorf("visited %v, want %v", visited, want)
+	}
+}
+
+func TestWalkNodeTreeDeep(t *testing.T) {
+	// Deep enough that a recursive walk would overflow a limited stack
+	defer debug.SetMaxStack(debug.SetMaxStack(4 << 20))
+	const depth = 1000000
+	leaf := anchor("gfs.2014060100/")
+	root := leaf
+	for idx := 0; idx < depth; idx++ {
+		root = element("div", root)
+	}
+
+	nodes, found := 0, false
+	walkNodeTree(root, func(node *html.Node) {
+		nodes++
+		found = found || node == leaf
+	})
+
+	// Each level plus the anchor and its text
+	if want := depth + 2; nodes != want {
+		t.Errorf("visited %d nodes, want %d", nodes, want)
+	}
+	if !found {
+		t.Error("the innermost anchor was not visited")
+	}
+}
+
+func TestResolveHref(t *testing.T) {
+	base, err := url.Parse("http://example.com/data/gfs/prod/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		href, url, identifier string
+	}{
+		{"gfs.2024010100/", "http://example.com/data/gfs/prod/gfs.2024010100/", "gfs.2024010100"},
+		{"./gfs.2024010100/", "http://example.com/data/gfs/prod/gfs.2024010100/", "gfs.2024010100"},
+		{"gfs.2024010100", "http://example.com/data/gfs/prod/gfs.2024010100", "gfs.2024010100"},
+		{"/data/gfs/prod/gfs.2024010100/", "http://example.com/data/gfs/prod/gfs.2024010100/", "gfs.2024010100"},
+		{"//mirror.example.com/gfs/gfs.2024010100/", "http://mirror.example.com/gfs/gfs.2024010100/", "gfs.2024010100"},
+		{"https://example.org/gfs/gfs.2024010100/", "https://example.org/gfs/gfs.2024010100/", "gfs.2024010100"},
+		{"../other/gfs.t00z.pgrb2.0p50.f000", "http://example.com/data/gfs/other/gfs.t00z.pgrb2.0p50.f000", "gfs.t00z.pgrb2.0p50.f000"},
+	} {
+		resolved, identifier, ok := resolveHref(base, tc.href)
+		if !ok {
+			t.Errorf("%q was rejected", tc.href)
+			continue
+		}
+		if resolved.String() != tc.url || identifier != tc.identifier {
+			t.Errorf("%q resolved to %v with identifier %q, want %v with identifier %q",
+				tc.href, resolved, identifier, tc.url, tc.identifier)
+		}
+	}
+
+	// Sorting links, parent directories and invalid references are skipped
+	for _, href := range []string{"?C=M;O=A", "gfs.2024010100/?C=N", "/", "%zz"} {
+		if resolved, identifier, ok := resolveHref(base, href); ok {
+			t.Errorf("%q was accepted as %v with identifier %q", href, resolved, identifier)
+		}
+	}
+}
@@ -3,11 +3,11 @@
 package aonui
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"net/url"
 	"regexp"
 	"strconv"
-	"strings"
 	"time"
 
 	"code.google.com/p/go.net/html"
@@ -15,21 +15,89 @@ import (
 
 // A Run is a description of an individual run of the GFS.
 type Run struct {
-	Source     *DataSource
-	Identifier string
-	URL        *url.URL
-	When       time.Time
+	Source       *DataSource
+	Identifier   string
+	URL          *url.URL
+	When         time.Time
+	LastModified time.Time // Modification time reported by the server (or zero if unknown)
+}
+
+// An ErrIncompleteRun is returned when a run has fewer datasets than its
+// source's MinDatasets. The run may still be being uploaded in which case an
+// older run could be used instead.
+type ErrIncompleteRun struct {
+	Run  *Run
+	Got  int // Number of datasets in the run
+	Want int // Minimum number of datasets expected
+}
+
+func (e *ErrIncompleteRun) Error() string {
+	return fmt.Sprintf("run %v has %d dataset(s), expecting at least %d",
+		e.Run.Identifier, e.Got, e.Want)
+}
+
+// IsComplete fetches the run's datasets and reports whether there are at least
+// as many as the source's MinDatasets.
+func (run *Run) IsComplete() (bool, error) {
+	datasets, err := run.FetchDatasets()
+	if err != nil {
+		return false, err
+	}
+	return run.CheckComplete(datasets) == nil, nil
+}
+
+// CheckComplete returns an *ErrIncompleteRun if datasets, the datasets of
+// the run, are fewer than the source's MinDatasets. It is useful in place of
+// IsComplete if the datasets have already been fetched.
+func (run *Run) CheckComplete(datasets []*Dataset) error {
+	if len(datasets) < run.Source.MinDatasets {
+		return &ErrIncompleteRun{Run: run, Got: len(datasets), Want: run.Source.MinDatasets}
+	}
+	return nil
+}
+
+// CircuitBreaker returns the breaker counting the datasets of the run which
+// fail every try. All callers fetching from the same run share a breaker.
+// Returns nil if the source's FetchStrategy does not set
+// MaxConsecutiveFailures.
+func (run *Run) CircuitBreaker() *CircuitBreaker {
+	return run.Source.FetchStrategy.circuitBreaker(run.URL.String())
+}
+
+// ResetCircuitBreaker discards the run's breaker so that later fetches from
+// the run start afresh with a new one. Call it once finished with the run so
+// that a tripped breaker does not stop the run being fetched again later.
+func (run *Run) ResetCircuitBreaker() {
+	resetCircuitBreakers(run.URL.String())
+}
+
+// Schedule returns the expected forecast hours of the run. See
+// DataSource.ScheduleFor.
+func (run *Run) Schedule() ForecastSchedule {
+	return run.Source.ScheduleFor(run.When.Hour())
+}
+
+// ExpectedForecastHours is like DataSource.ExpectedForecastHours but takes
+// into account the hour of the run.
+func (run *Run) ExpectedForecastHours() []int {
+	return run.Source.expectedForecastHours(run.Schedule())
 }
 
 // FetchDatasets fetches a list of individual datasets from a run.
 func (run *Run) FetchDatasets() ([]*Dataset, error) {
+	return run.FetchDatasetsContext(context.Background())
+}
+
+// FetchDatasetsContext is like FetchDatasets but the fetch is abandoned if ctx
+// is cancelled.
+func (run *Run) FetchDatasetsContext(ctx context.Context) ([]*Dataset, error) {
 	// Compile regexp for matching dataset name
 	datasetRegexp, err := regexp.Compile(run.Source.DatasetPattern)
 	if err != nil {
 		return nil, err
 	}
 
-	doc, err := getAndParse(run.URL.String(), run.Source.FetchStrategy)
+	doc, err := run.Source.fetchListing(ctx, run.URL)
 	if err != nil {
 		return nil, err
 	}
@@ -38,13 +106,13 @@ func (run *Run) FetchDatasets() ([]*Dataset, error) {
 	datasetChan := make(chan *Dataset)
 
 	// Walk parse tree...
-	ctx := &parseDatasetsContext{Run: run, DatasetRegexp: datasetRegexp}
-	go func(c chan *Dataset, ctx *parseDatasetsContext) {
+	parseCtx := &parseDatasetsContext{Run: run, DatasetRegexp: datasetRegexp}
+	go func(c chan *Dataset, parseCtx *parseDatasetsContext) {
 		defer close(c)
 		walkNodeTree(doc, func(node *html.Node) {
-			ctx.matchDatasetNode(node, c)
+			parseCtx.matchDatasetNode(ctx, node, c)
 		})
-	}(datasetChan, ctx)
+	}(datasetChan, parseCtx)
 
 	// Return datasets
 	datasets := []*Dataset{}
@@ -52,15 +120,41 @@ func (run *Run) FetchDatasets() ([]*Dataset, error) {
 		datasets = append(datasets, ds)
 	}
 
+	// The walk stops sending datasets if ctx is cancelled
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	return datasets, nil
 }
 
+// DatasetsByForecastHour fetches the datasets of a run and groups them by
+// forecast hour. There may be more than one dataset for each forecast hour,
+// e.g. the primary and secondary datasets of the GFS.
+func (run *Run) DatasetsByForecastHour() (map[int][]*Dataset, error) {
+	datasets, err := run.FetchDatasets()
+	if err != nil {
+		return nil, err
+	}
+	return GroupByForecastHour(datasets), nil
+}
+
+// GroupByForecastHour groups datasets by forecast hour. Within each group,
+// datasets are in the order they appear in datasets.
+func GroupByForecastHour(datasets []*Dataset) map[int][]*Dataset {
+	groups := make(map[int][]*Dataset)
+	for _, ds := range datasets {
+		groups[ds.ForecastHour] = append(groups[ds.ForecastHour], ds)
+	}
+	return groups
+}
+
 type parseDatasetsContext struct {
 	Run           *Run
 	DatasetRegexp *regexp.Regexp
 }
 
-func (ctx *parseDatasetsContext) matchDatasetNode(node *html.Node, out chan *Dataset) {
+func (ctx *parseDatasetsContext) matchDatasetNode(cancelCtx context.Context, node *html.Node, out chan *Dataset) {
 	// Is this node an anchor tag?
 	if node.Type != html.ElementNode || node.Data != "a" {
 		return
@@ -72,8 +166,11 @@ func (ctx *parseDatasetsContext) matchDatasetNode(node *html.Node, out chan *Dat
 			continue
 		}
 
-		// Trim any trailing slash
-		identifier := strings.TrimRight(a.Val, "/")
+		// Resolve the reference. Skip invalid references
+		url, identifier, ok := resolveHref(ctx.Run.URL, a.Val)
+		if !ok {
+			continue
+		}
 
 		// Does this match our pattern for datasets?
 		submatches := ctx.DatasetRegexp.FindStringSubmatch(identifier)
@@ -81,16 +178,9 @@ func (ctx *parseDatasetsContext) matchDatasetNode(node *html.Node, out chan *Dat
 			continue
 		}
 
-		// Parse as a relative URL. Skip invalid references
-		relURL, err := url.Parse(a.Val)
-		if err != nil {
-			continue
-		}
-		url := ctx.Run.URL.ResolveReference(relURL)
-
 		var (
-			runHour, forecastHour int
-			typeIdentifier        string
+			runHour, forecastHour  int
+			typeIdentifier, member string
 		)
 
 		for idx, subexpName := range ctx.DatasetRegexp.SubexpNames() {
@@ -106,19 +196,33 @@ func (ctx *parseDatasetsContext) matchDatasetNode(node *html.Node, out chan *Dat
 				forecastHour = submatchIntVal
 			case "typeId":
 				typeIdentifier = submatchVal
+			case "member":
+				member = submatchVal
 			}
 		}
 
 		if runHour != ctx.Run.When.Hour() {
-			log.Print("Dataset run hour, ", runHour, "does not match run's hour, ",
-				ctx.Run.When.Hour())
+			// The datasets of every run of the day share a directory
+			// if the source has RunHours and so this is expected.
+			if len(ctx.Run.Source.RunHours) > 0 {
+				continue
+			}
+			logger().Warnf("Dataset run hour, %d, does not match run's hour, %d",
+				runHour, ctx.Run.When.Hour())
 			continue
 		}
 
-		out <- &Dataset{
+		ds := &Dataset{
 			Identifier: identifier, URL: url,
 			Run: ctx.Run, ForecastHour: forecastHour,
-			TypeIdentifier: typeIdentifier,
+			TypeIdentifier: typeIdentifier, Member: member,
+			Length: listingSize(node),
+		}
+
+		select {
+		case out <- ds:
+		case <-cancelCtx.Done():
+			return
 		}
 	}
 
@@ -0,0 +1,118 @@
+// Listing data sources stored in Amazon S3 buckets
+
+package aonui
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"code.google.com/p/go.net/html"
+)
+
+// An s3ListBucketResult is the response to an S3 ListObjectsV2 request.
+type s3ListBucketResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// getAndParseS3 is like getAndParse except that dirURL is a "directory" within
+// an S3 bucket whose root is rootURL. The objects and sub-directories within
+// it are listed via the ListObjectsV2 API and returned as a HTML directory
+// listing. Runs and datasets can then be matched exactly as they would be
+// for a listing from a web server.
+func getAndParseS3(ctx context.Context, rootURL, dirURL *url.URL, strategy FetchStrategy) (*html.Node, error) {
+	prefix := strings.TrimPrefix(dirURL.Path, rootURL.Path)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	// Build listing. Modification times are formatted in one of the
+	// layouts understood by listingModTime and followed by the exact size
+	// of each object for listingSize.
+	var listing bytes.Buffer
+	listing.WriteString("<html><body><pre>\n")
+	writeEntry := func(key string, modTime time.Time, size int64) {
+		href := template.HTMLEscapeString(rootURL.ResolveReference(&url.URL{Path: key}).String())
+		name := template.HTMLEscapeString(path.Base(key))
+		fmt.Fprintf(&listing, "<a href=\"%v\">%v</a>", href, name)
+		if !modTime.IsZero() {
+			fmt.Fprintf(&listing, " %v", modTime.UTC().Format("2006-01-02 15:04"))
+			if size > 0 {
+				fmt.Fprintf(&listing, " %d", size)
+			}
+		}
+		listing.WriteString("\n")
+	}
+
+	// Fetch each page of the listing
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("delimiter", "/")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		listURL := *rootURL // NB: Copy of rootURL
+		listURL.RawQuery = query.Encode()
+
+		result, err := fetchS3ListBucketResult(ctx, listURL.String(), strategy)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range result.CommonPrefixes {
+			writeEntry(p.Prefix, time.Time{}, 0)
+		}
+		for _, c := range result.Contents {
+			writeEntry(c.Key, c.LastModified, c.Size)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	listing.WriteString("</pre></body></html>\n")
+
+	return html.Parse(&listing)
+}
+
+// fetchS3ListBucketResult fetches and parses one page of an S3 bucket
+// listing.
+func fetchS3ListBucketResult(ctx context.Context, listURL string, strategy FetchStrategy) (*s3ListBucketResult, error) {
+	resp, err := getURLWithStrategy(ctx, listURL, strategy)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Read the listing, refusing to buffer more than the maximum size.
+	maxSize := strategy.MaxIndexSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxIndexSize
+	}
+
+	var result s3ListBucketResult
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxSize)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error parsing bucket listing %v: %v", listURL, err)
+	}
+	return &result, nil
+}
@@ -0,0 +1,226 @@
+// Scanning GRIB2 files without external tools
+
+package aonui
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Length of the GRIB2 indicator section (section 0) and the start of the
+// identification section (section 1) which we need to read the reference
+// time.
+const (
+	grib2IndicatorLength = 16
+	grib2HeaderLength    = grib2IndicatorLength + 19
+)
+
+// ScanGrib2Messages walks the GRIB2 messages in r using the total length
+// recorded in each message's indicator section. The returned items have their
+// RecordNumber, Offset, Extent and When fields set. Parameters, layers and
+// forecast times are decoded from each product definition section for the
+// common parameters on isobaric, height above ground and surface layers and
+// left empty otherwise. A message with several fields gives one item listing
+// the parameter of each. An error is returned if r contains anything other
+// than a sequence of complete GRIB2 messages.
+func ScanGrib2Messages(r io.ReaderAt) (Inventory, error) {
+	items := Inventory{}
+
+	var offset int64
+	header := make([]byte, grib2HeaderLength)
+	for {
+		n, err := r.ReadAt(header, offset)
+		if n == 0 && err == io.EOF {
+			return items, nil
+		} else if n < grib2HeaderLength {
+			return nil, fmt.Errorf("truncated GRIB message at offset %d", offset)
+		}
+
+		// Check indicator section
+		if !bytes.Equal(header[:4], []byte("GRIB")) {
+			return nil, fmt.Errorf("no GRIB message at offset %d", offset)
+		}
+		if edition := header[7]; edition != 2 {
+			return nil, fmt.Errorf("GRIB message at offset %d is edition %d, not 2",
+				offset, edition)
+		}
+		length := int64(binary.BigEndian.Uint64(header[8:16]))
+		if length < grib2HeaderLength {
+			return nil, fmt.Errorf("invalid GRIB message length %d at offset %d",
+				length, offset)
+		}
+
+		// Check the message ends where its length says it does
+		trailer := make([]byte, 4)
+		if _, err := r.ReadAt(trailer, offset+length-4); err != nil {
+			return nil, fmt.Errorf("truncated GRIB message at offset %d", offset)
+		}
+		if !bytes.Equal(trailer, []byte("7777")) {
+			return nil, fmt.Errorf("GRIB message at offset %d has no end marker", offset)
+		}
+
+		// Reference time from the identification section
+		var when time.Time
+		if section := header[grib2IndicatorLength:]; section[4] == 1 {
+			when = time.Date(int(binary.BigEndian.Uint16(section[12:14])),
+				time.Month(section[14]), int(section[15]), int(section[16]),
+				int(section[17]), int(section[18]), 0, time.UTC)
+		}
+
+		item := &InventoryItem{
+			RecordNumber: len(items) + 1,
+			Offset:       offset,
+			Extent:       length,
+			When:         when,
+		}
+		if err := scanGrib2Products(r, offset, length, header[6], item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		offset += length
+	}
+}
+
+// ScanGrib2Inventory returns the inventory of the GRIB2 file fn as found by
+// ScanGrib2Messages. Unlike GribBackend.Inventory, no external tool is needed.
+func ScanGrib2Inventory(fn string) (Inventory, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ScanGrib2Messages(f)
+}
+
+// grib2ParameterNames maps the discipline, category and number of common
+// parameters to the names wgrib2 gives them.
+var grib2ParameterNames = map[[3]byte]string{
+	{0, 0, 0}: "TMP",
+	{0, 1, 1}: "RH",
+	{0, 2, 2}: "UGRD",
+	{0, 2, 3}: "VGRD",
+	{0, 2, 8}: "VVEL",
+	{0, 3, 0}: "PRES",
+	{0, 3, 1}: "PRMSL",
+	{0, 3, 5}: "HGT",
+}
+
+// scanGrib2Products walks the sections of the GRIB2 message of the given
+// length at offset in r and fills in the parameters, layer and forecast time
+// of item from each product definition section. The message's discipline is
+// given as it is recorded in the indicator section.
+func scanGrib2Products(r io.ReaderAt, offset, length int64, discipline byte, item *InventoryItem) error {
+	pos := offset + grib2IndicatorLength
+	end := offset + length - 4 // Start of the end marker
+	header := make([]byte, 5)
+	for pos < end {
+		if _, err := r.ReadAt(header, pos); err != nil {
+			return fmt.Errorf("truncated GRIB message at offset %d", offset)
+		}
+		sectionLength := int64(binary.BigEndian.Uint32(header[:4]))
+		if sectionLength < 5 || pos+sectionLength > end {
+			return fmt.Errorf("invalid section length %d in GRIB message at offset %d",
+				sectionLength, offset)
+		}
+
+		if header[4] == 4 {
+			section := make([]byte, sectionLength)
+			if _, err := r.ReadAt(section, pos); err != nil {
+				return fmt.Errorf("truncated GRIB message at offset %d", offset)
+			}
+			decodeGrib2Product(section, discipline, item)
+		}
+		pos += sectionLength
+	}
+	return nil
+}
+
+// decodeGrib2Product fills in item from the product definition section
+// section. Only templates 4.0 and 4.1, which cover instantaneous analyses and
+// forecasts, are understood. Other products leave item unchanged.
+func decodeGrib2Product(section []byte, discipline byte, item *InventoryItem) {
+	if len(section) < 28 {
+		return
+	}
+	if template := binary.BigEndian.Uint16(section[7:9]); template != 0 && template != 1 {
+		return
+	}
+
+	param, ok := grib2ParameterNames[[3]byte{discipline, section[9], section[10]}]
+	if !ok {
+		param = fmt.Sprintf("var%d_%d_%d", discipline, section[9], section[10])
+	}
+	item.Parameters = append(item.Parameters, param)
+
+	// Layer and forecast time are taken from the first field
+	if len(item.Parameters) > 1 {
+		return
+	}
+
+	if section[17] == 1 { // Forecast time in hours
+		if fcstHour := binary.BigEndian.Uint32(section[18:22]); fcstHour == 0 {
+			item.TypeName = "anl"
+		} else {
+			item.TypeName = fmt.Sprintf("%d hour fcst", fcstHour)
+		}
+	}
+
+	value := float64(signMagnitude(section[24:28])) *
+		math.Pow10(-int(signMagnitude(section[23:24])))
+	switch section[22] {
+	case 1:
+		item.LayerName = "surface"
+	case 100: // Pressure in Pa
+		item.LayerName = strconv.FormatFloat(value/100, 'g', -1, 64) + " mb"
+	case 103:
+		item.LayerName = strconv.FormatFloat(value, 'g', -1, 64) + " m above ground"
+	}
+}
+
+// signMagnitude decodes the big-endian sign and magnitude integer in b as used
+// by GRIB2 for signed values.
+func signMagnitude(b []byte) int64 {
+	var v int64
+	for _, c := range b {
+		v = v<<8 | int64(c)
+	}
+	signBit := int64(1) << (8*uint(len(b)) - 1)
+	if v&signBit != 0 {
+		return -(v &^ signBit)
+	}
+	return v
+}
+
+// VerifyGrib2 checks that the GRIB2 file fn consists of exactly the records in
+// inv. Each message in fn must be a complete GRIB2 message and the number of
+// messages and the length of each must match inv.
+func VerifyGrib2(fn string, inv Inventory) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	messages, err := ScanGrib2Messages(f)
+	if err != nil {
+		return err
+	}
+	if len(messages) != len(inv) {
+		return fmt.Errorf("%v has %d messages, expected %d", fn, len(messages), len(inv))
+	}
+	for idx, msg := range messages {
+		if msg.Extent != inv[idx].Extent {
+			return fmt.Errorf("message %d of %v has length %d, expected %d",
+				msg.RecordNumber, fn, msg.Extent, inv[idx].Extent)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package aonui
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A testField is one field of a synthetic GRIB2 message.
+type testField struct {
+	Category, Number byte
+	ForecastHour     uint32
+	Pressure         uint32 // Pressure in Pa
+}
+
+// grib2Message returns a minimal GRIB2 message with a reference time of 00Z on
+// 1 June 2014 and one product definition section (template 4.0) for each of
+// fields. The grid and data sections are omitted.
+func grib2Message(fields ...testField) []byte {
+	msg := make([]byte, grib2IndicatorLength)
+	copy(msg, "GRIB")
+	msg[7] = 2 // Edition
+
+	// Identification section
+	section1 := make([]byte, 21)
+	binary.BigEndian.PutUint32(section1, 21)
+	section1[4] = 1
+	binary.BigEndian.PutUint16(section1[12:], 2014)
+	section1[14], section1[15] = 6, 1
+	msg = append(msg, section1...)
+
+	for _, f := range fields {
+		section4 := make([]byte, 34)
+		binary.BigEndian.PutUint32(section4, 34)
+		section4[4] = 4
+		section4[9], section4[10] = f.Category, f.Number
+		section4[17] = 1 // Hours
+		binary.BigEndian.PutUint32(section4[18:], f.ForecastHour)
+		section4[22] = 100 // Isobaric surface
+		binary.BigEndian.PutUint32(section4[24:], f.Pressure)
+		msg = append(msg, section4...)
+	}
+
+	msg = append(msg, "7777"...)
+	binary.BigEndian.PutUint64(msg[8:], uint64(len(msg)))
+	return msg
+}
+
+var (
+	testHGT  = testField{Category: 3, Number: 5}
+	testUGRD = testField{Category: 2, Number: 2}
+	testVGRD = testField{Category: 2, Number: 3}
+)
+
+// at returns f at forecast hour fcstHour and pressure mb.
+func (f testField) at(fcstHour, mb uint32) testField {
+	f.ForecastHour, f.Pressure = fcstHour, mb*100
+	return f
+}
+
+// writeGrib2File writes msgs one after another to a temporary file and returns
+// its name.
+func writeGrib2File(t *testing.T, msgs ...[]byte) string {
+	var contents []byte
+	for _, msg := range msgs {
+		contents = append(contents, msg...)
+	}
+	fn := filepath.Join(t.TempDir(), "input.grib2")
+	if err := ioutil.WriteFile(fn, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestScanGrib2Inventory(t *testing.T) {
+	wind := grib2Message(testUGRD.at(6, 500), testVGRD.at(6, 500))
+	hgt := grib2Message(testHGT.at(0, 850))
+	fn := writeGrib2File(t, wind, hgt)
+
+	inv, err := ScanGrib2Inventory(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	when := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+	want := Inventory{
+		{
+			RecordNumber: 1, Offset: 0, Extent: int64(len(wind)), When: when,
+			Parameters: []string{"UGRD", "VGRD"}, LayerName: "500 mb", TypeName: "6 hour fcst",
+		},
+		{
+			RecordNumber: 2, Offset: int64(len(wind)), Extent: int64(len(hgt)), When: when,
+			Parameters: []string{"HGT"}, LayerName: "850 mb", TypeName: "anl",
+		},
+	}
+	if !reflect.DeepEqual(inv, want) {
+		t.Errorf("unexpected inventory:")
+		for _, item := range inv {
+			t.Errorf("\t%+v", item)
+		}
+	}
+}
+
+func TestScanGrib2MessagesTruncated(t *testing.T) {
+	msg := grib2Message(testHGT.at(0, 500))
+	fn := writeGrib2File(t, msg, msg[:len(msg)-10])
+
+	if _, err := ScanGrib2Inventory(fn); err == nil {
+		t.Error("truncated message was not reported")
+	}
+}
+
+func TestReorderGrib2Scan(t *testing.T) {
+	// No external tool should be run
+	old := execCommand
+	defer func() { execCommand = old }()
+	execCommand = nil
+
+	ugrd850 := grib2Message(testUGRD.at(0, 850))
+	hgt500 := grib2Message(testHGT.at(0, 500))
+	hgt850 := grib2Message(testHGT.at(0, 850))
+	sourceFn := writeGrib2File(t, ugrd850, hgt500, hgt850)
+
+	opts := TawhiriReorderOptions
+	opts.ScanInventory = true
+	opts.Verify = true
+	destFn := filepath.Join(t.TempDir(), "output.grib2")
+	if err := ReorderGrib2With(sourceFn, destFn, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(destFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := string(hgt850) + string(ugrd850) + string(hgt500)
+	if string(got) != want {
+		t.Error("records were not written in Tawhiri order")
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -19,33 +21,93 @@ import (
 type TawhiriItem struct {
 	Item         *InventoryItem
 	ForecastHour int
-	Pressure     int
-	ParamIdx     int  // HGT = 0, UGRD = 1, VGRD = 2, Other = 3
-	IsValid      bool // Only true if ForecastHour and Pressure were parsed without error
+	Pressure     int       // Pressure in mb if LayerType is PressureLayer
+	Height       int       // Height in m if LayerType is HeightAboveGroundLayer
+	LayerType    LayerType // Type of layer parsed from the item's LayerName
+	ParamIdx     int       // Index into ReorderOptions.Parameters (e.g. HGT = 0, UGRD = 1, VGRD = 2, Other = 3)
+	IsValid      bool      // Only true if ForecastHour and layer were parsed without error
+}
+
+// A LayerType is the kind of layer a record is on. Within a forecast hour,
+// records are sorted by ascending LayerType.
+type LayerType int
+
+const (
+	UnknownLayer           LayerType = iota // Layer could not be parsed
+	PressureLayer                           // Isobaric layer, e.g. "500 mb"
+	HeightAboveGroundLayer                  // Height above ground, e.g. "10 m above ground"
+	SurfaceLayer                            // The surface
+)
+
+// ReorderOptions specifies the order records are sorted into. The zero value
+// sorts by ascending forecast hour and then descending pressure and treats all
+// parameters as equal.
+type ReorderOptions struct {
+	Parameters             []string // Order of parameters. Other parameters sort after these.
+	PressureAscending      bool     // Sort by ascending rather than descending pressure
+	ForecastHourDescending bool     // Sort by descending rather than ascending forecast hour
+
+	// If true, records on height above ground and surface layers are
+	// valid. Otherwise only records on pressure layers are.
+	NonPressureLayers bool
+
+	// If true, invalid records are kept by ReorderGrib2With and
+	// OrderedInventory and appended in their original order after the
+	// sorted valid records.
+	KeepUnused bool
+
+	// If true, ReorderGrib2With checks the output with VerifyGrib2.
+	Verify bool
+
+	// Number of records ReorderGrib2With copies at once, each with its own
+	// handle on the source file. Copying several records at once can be
+	// faster on solid state disks. (Or 0 or 1 to copy one at a time.)
+	Workers int
+
+	// If true, only the first of several valid records with the same
+	// forecast hour, layer and parameters is kept by ReorderGrib2With,
+	// MergeGrib2With and OrderedInventory. Duplicates arise when, for
+	// example, primary and secondary files overlap.
+	Dedup bool
+
+	// If true, ReorderGrib2With and OrderedInventory find the inventory of
+	// the source file with ScanGrib2Inventory rather than GribBackend and so
+	// need no external tool. Only common parameters are recognised.
+	ScanInventory bool
+}
+
+// TawhiriReorderOptions are the ReorderOptions which give Tawhiri order.
+var TawhiriReorderOptions = ReorderOptions{
+	Parameters: []string{"HGT", "UGRD", "VGRD"},
 }
 
 // ToTawhiri parses tawhiri-specific fields from an InventoryItem and wrap it
 // in an TawhiriItem.
 func ToTawhiri(item *InventoryItem) *TawhiriItem {
+	return ToTawhiriWith(item, TawhiriReorderOptions)
+}
+
+// ToTawhiriWith is like ToTawhiri but ParamIdx is the index of the item's
+// first parameter in opts.Parameters. Items on height above ground and surface
+// layers are only valid if opts.NonPressureLayers is set.
+func ToTawhiriWith(item *InventoryItem, opts ReorderOptions) *TawhiriItem {
 	const (
 		fcstSuffix     = " hour fcst"
 		pressureSuffix = " mb"
+		heightSuffix   = " m above ground"
 	)
 
 	transItem := &TawhiriItem{Item: item, IsValid: true}
 
-	// Is this a geopotential height record?
+	// Find position of parameter in ordering
+	transItem.ParamIdx = len(opts.Parameters)
 	if len(item.Parameters) > 0 {
-		switch item.Parameters[0] {
-		case "HGT":
-			transItem.ParamIdx = 0
-		case "UGRD":
-			transItem.ParamIdx = 1
-		case "VGRD":
-			transItem.ParamIdx = 2
+		for idx, p := range opts.Parameters {
+			if item.Parameters[0] == p {
+				transItem.ParamIdx = idx
+				break
+			}
 		}
-	} else {
-		transItem.ParamIdx = 3
 	}
 
 	// Parse forecast hour
@@ -64,15 +126,34 @@ func ToTawhiri(item *InventoryItem) *TawhiriItem {
 		transItem.IsValid = false
 	}
 
-	// Parse pressure
-	if strings.HasSuffix(item.LayerName, pressureSuffix) {
+	// Parse layer
+	switch {
+	case strings.HasSuffix(item.LayerName, pressureSuffix):
 		valStr := strings.TrimSuffix(item.LayerName, pressureSuffix)
 		var err error
 		if transItem.Pressure, err = strconv.Atoi(valStr); err != nil {
 			// error parsing
 			transItem.IsValid = false
+		} else {
+			transItem.LayerType = PressureLayer
 		}
-	} else {
+	case strings.HasSuffix(item.LayerName, heightSuffix):
+		valStr := strings.TrimSuffix(item.LayerName, heightSuffix)
+		var err error
+		if transItem.Height, err = strconv.Atoi(valStr); err != nil {
+			// error parsing
+			transItem.IsValid = false
+		} else {
+			transItem.LayerType = HeightAboveGroundLayer
+		}
+	case item.LayerName == "surface":
+		transItem.LayerType = SurfaceLayer
+	default:
+		transItem.IsValid = false
+	}
+
+	// Only pressure layers are valid unless asked otherwise
+	if transItem.LayerType != PressureLayer && !opts.NonPressureLayers {
 		transItem.IsValid = false
 	}
 
@@ -84,9 +165,15 @@ func FromTawhiri(item *TawhiriItem) *InventoryItem { return item.Item }
 
 // ToTawhiris wraps items in an Inventory as TawhiriItems.
 func ToTawhiris(items Inventory) []*TawhiriItem {
+	return ToTawhirisWith(items, TawhiriReorderOptions)
+}
+
+// ToTawhirisWith wraps items in an Inventory as TawhiriItems using
+// ToTawhiriWith.
+func ToTawhirisWith(items Inventory, opts ReorderOptions) []*TawhiriItem {
 	out := []*TawhiriItem{}
 	for _, i := range items {
-		out = append(out, ToTawhiri(i))
+		out = append(out, ToTawhiriWith(i, opts))
 	}
 	return out
 }
@@ -100,14 +187,47 @@ func FromTawhiris(items []*TawhiriItem) Inventory {
 	return out
 }
 
+// DedupTawhiris returns items with all but the first of each set of valid
+// items with the same forecast hour, layer and parameters removed. Invalid
+// items are always kept. The order of items is preserved.
+func DedupTawhiris(items []*TawhiriItem) []*TawhiriItem {
+	type key struct {
+		ForecastHour int
+		LayerName    string
+		Parameters   string
+	}
+	seen := make(map[key]bool)
+
+	out := []*TawhiriItem{}
+	for _, tw := range items {
+		if tw.IsValid {
+			k := key{tw.ForecastHour, tw.Item.LayerName, strings.Join(tw.Item.Parameters, ",")}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+		}
+		out = append(out, tw)
+	}
+	return out
+}
+
 // ByTawhiri is a type used to sort slices of TawhiriItems in "tawhiri"-order.
 type ByTawhiri []*TawhiriItem
 
-func (a ByTawhiri) Len() int      { return len(a) }
-func (a ByTawhiri) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a ByTawhiri) Less(i, j int) bool {
-	i1, i2 := a[i], a[j]
+func (a ByTawhiri) Len() int           { return len(a) }
+func (a ByTawhiri) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByTawhiri) Less(i, j int) bool { return lessWith(a[i], a[j], TawhiriReorderOptions) }
 
+// SortTawhiris sorts items into the order specified by opts. The items should
+// have been created by ToTawhiriWith with the same options. Invalid items are
+// sorted after valid ones in their original order.
+func SortTawhiris(items []*TawhiriItem, opts ReorderOptions) {
+	sort.SliceStable(items, func(i, j int) bool { return lessWith(items[i], items[j], opts) })
+}
+
+// lessWith reports whether i1 sorts before i2 in the order specified by opts.
+func lessWith(i1, i2 *TawhiriItem, opts ReorderOptions) bool {
 	if i1.IsValid {
 		// Invalid items sort after valid ones always
 		if !i2.IsValid {
@@ -122,19 +242,23 @@ func (a ByTawhiri) Less(i, j int) bool {
 	}
 
 	// Sort initially by forecast hour
-	if i1.ForecastHour < i2.ForecastHour {
-		return true
+	if i1.ForecastHour != i2.ForecastHour {
+		return (i1.ForecastHour < i2.ForecastHour) != opts.ForecastHourDescending
 	}
-	if i1.ForecastHour > i2.ForecastHour {
-		return false
+
+	// Then by layer type
+	if i1.LayerType != i2.LayerType {
+		return i1.LayerType < i2.LayerType
 	}
 
-	// Then by *descending* pressure
-	if i1.Pressure > i2.Pressure {
-		return true
+	// Then by pressure, *descending* unless asked otherwise
+	if i1.Pressure != i2.Pressure {
+		return (i1.Pressure > i2.Pressure) != opts.PressureAscending
 	}
-	if i1.Pressure < i2.Pressure {
-		return false
+
+	// Then by ascending height
+	if i1.Height != i2.Height {
+		return i1.Height < i2.Height
 	}
 
 	// Then by parameters
@@ -152,18 +276,108 @@ func (a ByTawhiri) Less(i, j int) bool {
 // TawhiriReorderGrib2 re-orders an on-disk GRIB2 file into Tawhiri order
 // filtering unused records in the process.
 func TawhiriReorderGrib2(sourceFn string, destFn string) error {
+	return ReorderGrib2With(sourceFn, destFn, TawhiriReorderOptions)
+}
+
+// ReorderGrib2With re-orders an on-disk GRIB2 file into the order specified by
+// opts filtering invalid records in the process unless opts.KeepUnused is set.
+func ReorderGrib2With(sourceFn string, destFn string, opts ReorderOptions) error {
 	// Load, parse and re-order inventory
-	inv, err := TawhiriOrderedInventory(sourceFn)
+	inv, err := OrderedInventory(sourceFn, opts)
 	if err != nil {
 		return err
 	}
 
-	// Open input
-	in, err := os.Open(sourceFn)
+	// Open output
+	out, err := os.Create(destFn)
 	if err != nil {
-		return errors.New(fmt.Sprint("error opening input: ", err))
+		return errors.New(fmt.Sprint("error opening output: ", err))
+	}
+	defer out.Close()
+
+	// The layout of the output is known in advance so allocate it all at
+	// once to reduce fragmentation
+	plan := NewReorderPlan(inv)
+	if err := out.Truncate(plan.TotalLength()); err != nil {
+		return errors.New(fmt.Sprint("error allocating output: ", err))
+	}
+
+	// Perform copy counting the bytes written
+	var written int64
+	if opts.Workers > 1 {
+		written, err = copyRecordsParallel(out, plan, sourceFn, opts.Workers)
+	} else {
+		pw := &progressWriter{W: out}
+		err = copyRecords(pw, inv, sourceFn)
+		written = pw.Written
+	}
+	if err != nil {
+		return errors.New(fmt.Sprint("error re-ordering: ", err))
+	}
+
+	// Make sure nothing was missed. The output was allocated in advance so
+	// its size says nothing about what was written.
+	if written != plan.TotalLength() {
+		return fmt.Errorf("wrote %d bytes of records, expected %d", written, plan.TotalLength())
+	}
+	if err := out.Close(); err != nil {
+		return errors.New(fmt.Sprint("error closing output: ", err))
+	}
+
+	// Check output if asked
+	if opts.Verify {
+		if err := VerifyGrib2(destFn, inv); err != nil {
+			return errors.New(fmt.Sprint("error verifying output: ", err))
+		}
+	}
+
+	// success!
+	return nil
+}
+
+// MergeGrib2With writes the records of each of the on-disk GRIB2 files in
+// sourceFns to destFn sorted together into the order specified by opts. It is
+// like ReorderGrib2With except that records may come from more than one
+// file. Records with equal sort keys are written in the order of sourceFns.
+func MergeGrib2With(sourceFns []string, destFn string, opts ReorderOptions) error {
+	// Load and parse the inventory of each file remembering which file
+	// each record came from
+	var tws []*TawhiriItem
+	sources := make(map[*InventoryItem]string)
+	for _, sourceFn := range sourceFns {
+		inv, err := GribBackend.Inventory(sourceFn)
+		if err != nil {
+			return errors.New(fmt.Sprint("error loading grib: ", err))
+		}
+		for _, tw := range ToTawhirisWith(inv, opts) {
+			if !tw.IsValid && !opts.KeepUnused {
+				continue
+			}
+			sources[tw.Item] = sourceFn
+			tws = append(tws, tw)
+		}
+	}
+
+	// Sort the union of the inventories
+	SortTawhiris(tws, opts)
+	if opts.Dedup {
+		tws = DedupTawhiris(tws)
+	}
+	inv := FromTawhiris(tws)
+
+	// Open inputs
+	inputs := make(map[string]*os.File)
+	for _, sourceFn := range sourceFns {
+		if _, ok := inputs[sourceFn]; ok {
+			continue
+		}
+		in, err := os.Open(sourceFn)
+		if err != nil {
+			return errors.New(fmt.Sprint("error opening input: ", err))
+		}
+		defer in.Close()
+		inputs[sourceFn] = in
 	}
-	defer in.Close()
 
 	// Open output
 	out, err := os.Create(destFn)
@@ -172,46 +386,130 @@ func TawhiriReorderGrib2(sourceFn string, destFn string) error {
 	}
 	defer out.Close()
 
-	// Perform copy
-	for _, invItem := range inv {
-		// Seek in input
-		in.Seek(invItem.Offset, 0)
+	// Copy each record from its source
+	for _, item := range inv {
+		r := io.NewSectionReader(inputs[sources[item]], item.Offset, item.Extent)
+		if _, err := io.CopyN(out, r, item.Extent); err != nil {
+			return errors.New(fmt.Sprint("error copying records: ", err))
+		}
+	}
+	if err := out.Close(); err != nil {
+		return errors.New(fmt.Sprint("error closing output: ", err))
+	}
 
-		// Copy to output
-		_, err := io.CopyN(out, in, invItem.Extent)
-		if err != nil {
-			return errors.New(fmt.Sprint("error re-ordering: ", err))
+	// Check output if asked
+	if opts.Verify {
+		if err := VerifyGrib2(destFn, inv); err != nil {
+			return errors.New(fmt.Sprint("error verifying output: ", err))
 		}
 	}
 
-	// success!
 	return nil
 }
 
+// ExtractReordered writes the Tawhiri records of the GRIB2 file sourceFn to
+// destFn in Tawhiri order as packed floats in ExtractByteOrder. (See
+// Wgrib2Extract.) If GribBackend is a Wgrib2Tool, the records are streamed to
+// wgrib2 in Tawhiri order so that no re-ordered GRIB2 file need be written to
+// disk. Otherwise, or if wgrib2 fails to read the stream, sourceFn is
+// re-ordered into a temporary file alongside destFn which is then extracted
+// with GribBackend.
+func ExtractReordered(sourceFn string, destFn string) error {
+	inv, err := TawhiriOrderedInventory(sourceFn)
+	if err != nil {
+		return err
+	}
+	return ExtractReorderedInventory(inv, sourceFn, destFn)
+}
+
+// ExtractReorderedInventory is like ExtractReordered except that the records
+// of sourceFn to extract, and their order, are given by inv.
+func ExtractReorderedInventory(inv Inventory, sourceFn string, destFn string) error {
+	if _, ok := GribBackend.(Wgrib2Tool); ok {
+		err := Wgrib2ExtractStream(inv, sourceFn, destFn)
+		if err == nil {
+			return nil
+		}
+
+		// Only an error from wgrib2 itself suggests that it cannot read
+		// the stream. Anything else would fail again below.
+		var wErr *Wgrib2Error
+		if !errors.As(err, &wErr) || wErr.ExitCode < 0 {
+			return err
+		}
+		logger().Warnf("Error streaming records to wgrib2: %v. Re-ordering into a temporary file.", err)
+	}
+
+	// Fall back to re-ordering into a temporary file
+	tmpFile, err := ioutil.TempFile(filepath.Dir(destFn), "aonui-reorder-")
+	if err != nil {
+		return err
+	}
+	tmpFn := tmpFile.Name()
+	defer os.Remove(tmpFn)
+
+	if err := copyRecords(tmpFile, inv, sourceFn); err != nil {
+		tmpFile.Close()
+		return errors.New(fmt.Sprint("error re-ordering: ", err))
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	// The temporary file is already in the correct order and so its own
+	// inventory gives the order to extract in.
+	tmpInv, err := GribBackend.Inventory(tmpFn)
+	if err != nil {
+		return err
+	}
+	return GribBackend.Extract(tmpInv, tmpFn, destFn)
+}
+
 // TawhiriOrderedInventory returns the inventory of the GRIB2 file at sourceFn
 // sorted and filtered into Tawhiri order.
 func TawhiriOrderedInventory(sourceFn string) (Inventory, error) {
+	return OrderedInventory(sourceFn, TawhiriReorderOptions)
+}
+
+// OrderedInventory returns the inventory of the GRIB2 file at sourceFn sorted
+// into the order specified by opts. Invalid records are removed unless
+// opts.KeepUnused is set and duplicate records are removed if opts.Dedup is
+// set. See ToTawhiriWith.
+func OrderedInventory(sourceFn string, opts ReorderOptions) (Inventory, error) {
 	// Load and parse inventory
-	inv, err := Wgrib2Inventory(sourceFn)
+	var (
+		inv Inventory
+		err error
+	)
+	if opts.ScanInventory {
+		inv, err = ScanGrib2Inventory(sourceFn)
+	} else {
+		inv, err = GribBackend.Inventory(sourceFn)
+	}
 	if err != nil {
 		return inv, errors.New(fmt.Sprint("error loading grib: ", err))
 	}
 
 	// Parse items
-	tws := ToTawhiris(inv)
+	tws := ToTawhirisWith(inv, opts)
 
-	// Filter invalid records
-	filteredTws := []*TawhiriItem{}
-	for _, tw := range tws {
-		if tw.IsValid {
-			filteredTws = append(filteredTws, tw)
+	// Filter invalid records if asked
+	if !opts.KeepUnused {
+		filteredTws := []*TawhiriItem{}
+		for _, tw := range tws {
+			if tw.IsValid {
+				filteredTws = append(filteredTws, tw)
+			}
 		}
+		tws = filteredTws
 	}
-	tws = filteredTws
 
 	// Sort. Note that sorting in this manner is effectively a Swartzian
 	// transform.
-	sort.Sort(ByTawhiri(tws))
+	SortTawhiris(tws, opts)
+	if opts.Dedup {
+		tws = DedupTawhiris(tws)
+	}
 
 	// De-parse
 	inv = FromTawhiris(tws)
@@ -219,3 +517,112 @@ func TawhiriOrderedInventory(sourceFn string) (Inventory, error) {
 	// success!
 	return inv, nil
 }
+
+// TawhiriDownloadOptions specifies which records are fetched by
+// Run.DownloadTawhiri.
+type TawhiriDownloadOptions struct {
+	Parameters []string // Parameters to fetch (or nil to fetch all)
+}
+
+// DownloadTawhiri fetches the Tawhiri records of each dataset in run and
+// writes them to w. Records are fetched in Tawhiri order so that the output
+// requires no subsequent re-ordering. Datasets are processed one forecast hour
+// at a time with the records for datasets sharing a forecast hour being
+// merged. An *ErrIncompleteRun is returned without writing anything if the run
+// has fewer than Source.MinDatasets datasets. Returns the number of bytes written.
+func (run *Run) DownloadTawhiri(w io.Writer, opts TawhiriDownloadOptions) (int64, error) {
+	datasets, err := run.FetchDatasets()
+	if err != nil {
+		return 0, err
+	}
+	if err := run.CheckComplete(datasets); err != nil {
+		return 0, err
+	}
+
+	// Group datasets by forecast hour. If we have a max forecast hour,
+	// later hours are skipped.
+	hourDatasets := GroupByForecastHour(datasets)
+	hours := []int{}
+	for hour := range hourDatasets {
+		if run.Source.MaxForecastHour > 0 && hour > run.Source.MaxForecastHour {
+			continue
+		}
+		hours = append(hours, hour)
+	}
+	sort.Ints(hours)
+
+	var nWritten int64
+	for _, hour := range hours {
+		n, err := downloadTawhiriHour(w, hourDatasets[hour], opts)
+		nWritten += n
+		if err != nil {
+			return nWritten, err
+		}
+	}
+
+	return nWritten, nil
+}
+
+// Fetch the Tawhiri records from datasets, which should share a forecast hour,
+// writing them to w in Tawhiri order.
+func downloadTawhiriHour(w io.Writer, datasets []*Dataset, opts TawhiriDownloadOptions) (int64, error) {
+	// Collect the wanted records from each dataset remembering which
+	// dataset each came from.
+	var tws []*TawhiriItem
+	sources := make(map[*TawhiriItem]*Dataset)
+	for _, ds := range datasets {
+		inv, err := ds.FetchInventory()
+		if err != nil {
+			return 0, err
+		}
+
+		for _, item := range inv {
+			tw := ToTawhiri(item)
+			if !tw.IsValid || !hasAnyParameter(item, opts.Parameters) {
+				continue
+			}
+			tws = append(tws, tw)
+			sources[tw] = ds
+		}
+	}
+
+	// Sort into Tawhiri order. A stable sort keeps the result deterministic
+	// for records which compare equal.
+	sort.Stable(ByTawhiri(tws))
+
+	// Fetch consecutive records from the same dataset in one request
+	var nWritten int64
+	for start := 0; start < len(tws); {
+		ds := sources[tws[start]]
+		end := start + 1
+		for end < len(tws) && sources[tws[end]] == ds {
+			end++
+		}
+
+		n, err := ds.FetchAndWriteRecords(w, FromTawhiris(tws[start:end]))
+		nWritten += n
+		if err != nil {
+			return nWritten, err
+		}
+
+		start = end
+	}
+
+	return nWritten, nil
+}
+
+// hasAnyParameter returns true if params is empty or if any of item's
+// parameters is in params.
+func hasAnyParameter(item *InventoryItem, params []string) bool {
+	if len(params) == 0 {
+		return true
+	}
+	for _, want := range params {
+		for _, p := range item.Parameters {
+			if p == want {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package aonui
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// recordNumbers returns the record number of each item of inv.
+func recordNumbers(inv Inventory) []int {
+	numbers := []int{}
+	for _, item := range inv {
+		numbers = append(numbers, item.RecordNumber)
+	}
+	return numbers
+}
+
+func TestDedupTawhiris(t *testing.T) {
+	// Records 4 and 5 duplicate records 1 and 2 as when primary and
+	// secondary files overlap. The surface records are not valid and so are
+	// never dropped.
+	inv := Inventory{
+		{RecordNumber: 1, Parameters: []string{"HGT"}, LayerName: "500 mb", TypeName: "3 hour fcst"},
+		{RecordNumber: 2, Parameters: []string{"UGRD"}, LayerName: "500 mb", TypeName: "3 hour fcst"},
+		{RecordNumber: 3, Parameters: []string{"PRES"}, LayerName: "surface", TypeName: "3 hour fcst"},
+		{RecordNumber: 4, Parameters: []string{"HGT"}, LayerName: "500 mb", TypeName: "3 hour fcst"},
+		{RecordNumber: 5, Parameters: []string{"UGRD"}, LayerName: "500 mb", TypeName: "3 hour fcst"},
+		{RecordNumber: 6, Parameters: []string{"PRES"}, LayerName: "surface", TypeName: "3 hour fcst"},
+		{RecordNumber: 7, Parameters: []string{"HGT"}, LayerName: "500 mb", TypeName: "6 hour fcst"},
+	}
+
+	tws := ToTawhiris(inv)
+	SortTawhiris(tws, TawhiriReorderOptions)
+	got := recordNumbers(FromTawhiris(DedupTawhiris(tws)))
+	if want := []int{1, 2, 7, 3, 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got records %v, want %v", got, want)
+	}
+}
+
+func TestReorderGrib2Dedup(t *testing.T) {
+	hgt := grib2Message(testHGT.at(0, 500))
+	ugrd := grib2Message(testUGRD.at(0, 500))
+	sourceFn := writeGrib2File(t, ugrd, hgt, hgt, ugrd)
+
+	for _, test := range []struct {
+		Dedup bool
+		Want  string
+	}{
+		{false, string(hgt) + string(hgt) + string(ugrd) + string(ugrd)},
+		{true, string(hgt) + string(ugrd)},
+	} {
+		opts := TawhiriReorderOptions
+		opts.ScanInventory = true
+		opts.Dedup = test.Dedup
+		destFn := filepath.Join(t.TempDir(), "output.grib2")
+		if err := ReorderGrib2With(sourceFn, destFn, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ioutil.ReadFile(destFn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.Want {
+			t.Errorf("dedup %v: wrote %d bytes, want %d", test.Dedup, len(got), len(test.Want))
+		}
+	}
+}
+
+func TestExtractReorderedInventoryBackend(t *testing.T) {
+	old := GribBackend
+	defer func() { GribBackend = old }()
+	GribBackend = EccodesTool{}
+
+	// Record which tools are run
+	fakeTool(t, "")
+	var commands []string
+	fake := execCommand
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		commands = append(commands, name)
+		return fake(name, args...)
+	}
+
+	sourceFn := filepath.Join(t.TempDir(), "input.grib2")
+	if err := ioutil.WriteFile(sourceFn, make([]byte, 150), 0644); err != nil {
+		t.Fatal(err)
+	}
+	destFn := filepath.Join(t.TempDir(), "output.bin")
+	ExtractReorderedInventory(windInventory, sourceFn, destFn)
+
+	// Without wgrib2 as the backend, the records are not streamed to it
+	if len(commands) == 0 {
+		t.Fatal("no tools were run")
+	}
+	for _, name := range commands {
+		if name == Wgrib2Command {
+			t.Errorf("%v was run with the ecCodes backend", name)
+		}
+	}
+}
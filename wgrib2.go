@@ -4,9 +4,12 @@ package aonui
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"regexp"
@@ -19,18 +22,153 @@ type GridShape struct {
 	Columns, Rows int
 }
 
+// AllSameShape returns true if every shape in shapes is the same. It returns
+// true if shapes is empty.
+func AllSameShape(shapes []GridShape) bool {
+	for _, shape := range shapes {
+		if shape != shapes[0] {
+			return false
+		}
+	}
+	return true
+}
+
 // Command used for launching wgrib2. On each invocation, this command is
 // looked up in the system path.
 var Wgrib2Command = "wgrib2"
 
+// Function used to create commands for running external tools. It may be
+// replaced to run a fake tool in place of the real one.
+var execCommand = exec.Command
+
+// A Wgrib2Error is returned when wgrib2 could not be run or exited with a
+// non-zero status.
+type Wgrib2Error struct {
+	ExitCode int    // Exit status of wgrib2 or -1 if it could not be run
+	Stderr   string // Standard error output from wgrib2
+	Err      error  // Underlying error from os/exec
+}
+
+func (e *Wgrib2Error) Error() string {
+	if e.ExitCode < 0 {
+		return fmt.Sprintf("could not run wgrib2: %v", e.Err)
+	}
+	msg := fmt.Sprintf("wgrib2 exited with status %d", e.ExitCode)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+// Minimum version of wgrib2 supported
+var Wgrib2MinimumVersion = []int{0, 1, 9}
+
+// URL from which wgrib2 may be obtained
+const wgrib2URL = "http://www.cpc.ncep.noaa.gov/products/wesley/wgrib2/"
+
+// Pattern matching the version in the output of wgrib2 -version
+var wgrib2VersionRegex = regexp.MustCompile(`v(\d+(?:\.\d+)*)`)
+
+// CheckWgrib2 runs "wgrib2 -version" and returns an error if wgrib2 could not
+// be found or is older than Wgrib2MinimumVersion.
+func CheckWgrib2() error {
+	if _, err := exec.LookPath(Wgrib2Command); err != nil {
+		return fmt.Errorf("%v not found; install from %v", Wgrib2Command, wgrib2URL)
+	}
+
+	// Some versions of wgrib2 exit with a non-zero status after printing
+	// the version and so we only look at the output.
+	out, _ := execCommand(Wgrib2Command, "-version").CombinedOutput()
+	submatches := wgrib2VersionRegex.FindStringSubmatch(string(out))
+	if submatches == nil {
+		return fmt.Errorf("could not determine version of %v; is it wgrib2?", Wgrib2Command)
+	}
+
+	// Compare version components
+	for idx, component := range strings.Split(submatches[1], ".") {
+		if idx >= len(Wgrib2MinimumVersion) {
+			break
+		}
+		v, _ := strconv.Atoi(component)
+		if v > Wgrib2MinimumVersion[idx] {
+			break
+		}
+		if v < Wgrib2MinimumVersion[idx] {
+			return fmt.Errorf("wgrib2 version %v is too old; install a newer version from %v",
+				submatches[1], wgrib2URL)
+		}
+	}
+
+	return nil
+}
+
+// newWgrib2Error wraps an error from running wgrib2 in a Wgrib2Error along
+// with wgrib2's standard error output.
+func newWgrib2Error(err error, stderr *bytes.Buffer) error {
+	wErr := &Wgrib2Error{ExitCode: -1, Stderr: stderr.String(), Err: err}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		wErr.ExitCode = exitErr.ExitCode()
+	}
+	return wErr
+}
+
 // Wgrib2Extract uses Wgrib2 to extract a GRIB2 into a direct binary formatted
 // file. No headers or other information are added to the file which consists
-// of packed native float types in West-to-East, South-to-North,
+// of packed float types in ExtractByteOrder in West-to-East, South-to-North,
 // record-by-record ordering. Input and output are specified as filenames.
 // Which records to extract and their order is specified by inv.
 func Wgrib2Extract(inv Inventory, sourceFn string, destFn string) error {
+	args, swap := wgrib2BinaryArgs(destFn)
+	if err := wgrib2ExtractInventory(inv, sourceFn, args...); err != nil {
+		return err
+	}
+	if swap {
+		return swapFloat32s(destFn)
+	}
+	return nil
+}
+
+// wgrib2BinaryArgs returns the wgrib2 output options which write headerless
+// values to destFn in ExtractByteOrder. Wgrib2 writes either native ("-bin")
+// or big-endian ("-ieee") values and so, if little-endian values are wanted on
+// a big-endian host, swap is true and the values must be swapped afterwards.
+func wgrib2BinaryArgs(destFn string) (args []string, swap bool) {
+	if isBigEndian(ExtractByteOrder) {
+		return []string{"-no_header", "-ieee", destFn}, false
+	}
+	return []string{"-no_header", "-bin", destFn}, isBigEndian(binary.NativeEndian)
+}
+
+// Wgrib2ExtractNetCDF is like Wgrib2Extract except that destFn is written as
+// a NetCDF file which includes the coordinates of each grid point.
+func Wgrib2ExtractNetCDF(inv Inventory, sourceFn string, destFn string) error {
+	return wgrib2ExtractInventory(inv, sourceFn, "-netcdf", destFn)
+}
+
+// A BoundingBox is a region of the globe bounded by lines of latitude and
+// longitude in degrees. Longitudes are degrees East.
+type BoundingBox struct {
+	LatMin, LatMax float64
+	LonMin, LonMax float64
+}
+
+// Wgrib2SmallGrid uses wgrib2 to write the records in inv from sourceFn to the
+// GRIB2 file destFn cropped to the grid points within bbox. Records are written
+// in the order they appear in inv. Only latitude-longitude grids can be
+// cropped.
+func Wgrib2SmallGrid(inv Inventory, sourceFn string, destFn string, bbox BoundingBox) error {
+	return wgrib2ExtractInventory(inv, sourceFn, "-small_grid",
+		fmt.Sprintf("%v:%v", bbox.LonMin, bbox.LonMax),
+		fmt.Sprintf("%v:%v", bbox.LatMin, bbox.LatMax),
+		destFn)
+}
+
+// wgrib2ExtractInventory runs wgrib2 on the records in inv from sourceFn with
+// the output options given by outputArgs.
+func wgrib2ExtractInventory(inv Inventory, sourceFn string, outputArgs ...string) error {
 	// Build wgrib2 command
-	cmd := exec.Command(Wgrib2Command, "-i", "-no_header", "-bin", destFn, sourceFn)
+	args := append([]string{"-i"}, outputArgs...)
+	cmd := execCommand(Wgrib2Command, append(args, sourceFn)...)
 
 	// Get stdin pipe
 	wg2Stdin, err := cmd.StdinPipe()
@@ -38,15 +176,13 @@ func Wgrib2Extract(inv Inventory, sourceFn string, destFn string) error {
 		return err
 	}
 
-	// Get error pipe
-	wg2Stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return err
-	}
+	// Capture standard error from wgrib2 while still passing it on
+	var wg2Stderr bytes.Buffer
+	cmd.Stderr = io.MultiWriter(os.Stderr, &wg2Stderr)
 
 	// Start command
 	if err := cmd.Start(); err != nil {
-		return err
+		return newWgrib2Error(err, &wg2Stderr)
 	}
 
 	// Write inventory into wgrib2
@@ -59,13 +195,58 @@ func Wgrib2Extract(inv Inventory, sourceFn string, destFn string) error {
 		wg2Stdin.Close()
 	}()
 
-	// Copy standard error from wgrib2
-	go io.Copy(os.Stderr, wg2Stderr)
-
 	// Wait for command completion
 	if err := cmd.Wait(); err != nil {
+		return newWgrib2Error(err, &wg2Stderr)
+	}
+
+	// Return success
+	return nil
+}
+
+// Wgrib2ExtractStream is like Wgrib2Extract except that wgrib2 does not read
+// sourceFn itself. Instead the bytes of each record in inv are copied from
+// sourceFn to wgrib2's standard input in the order they appear in inv. The
+// records are therefore written to destFn in the order specified by inv
+// without an intermediate re-ordered GRIB2 file being written.
+func Wgrib2ExtractStream(inv Inventory, sourceFn string, destFn string) error {
+	// Build wgrib2 command reading GRIB2 data from standard input
+	args, swap := wgrib2BinaryArgs(destFn)
+	cmd := execCommand(Wgrib2Command, append([]string{"-"}, args...)...)
+
+	// Get stdin pipe
+	wg2Stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	// Capture standard error from wgrib2 while still passing it on
+	var wg2Stderr bytes.Buffer
+	cmd.Stderr = io.MultiWriter(os.Stderr, &wg2Stderr)
+
+	// Start command
+	if err := cmd.Start(); err != nil {
+		return newWgrib2Error(err, &wg2Stderr)
+	}
+
+	// Write records into wgrib2
+	copyErrChan := make(chan error, 1)
+	go func() {
+		copyErrChan <- copyRecords(wg2Stdin, inv, sourceFn)
+		wg2Stdin.Close()
+	}()
+
+	// Wait for command completion. If wgrib2 fails, the error copying
+	// records is most likely a broken pipe and so is not interesting.
+	if err := cmd.Wait(); err != nil {
+		return newWgrib2Error(err, &wg2Stderr)
+	}
+	if err := <-copyErrChan; err != nil {
 		return err
 	}
+	if swap {
+		return swapFloat32s(destFn)
+	}
 
 	// Return success
 	return nil
@@ -83,21 +264,21 @@ func Wgrib2Inventory(fn string) (Inventory, error) {
 	totalLength := fi.Size()
 
 	// Build wgrib2 command
-	cmd := exec.Command(Wgrib2Command, "-s", fn)
+	cmd := execCommand(Wgrib2Command, "-s", fn)
 
 	// Get pipes
 	wg2Stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, err
 	}
-	wg2Stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return nil, err
-	}
+
+	// Capture standard error from wgrib2 while still passing it on
+	var wg2Stderr bytes.Buffer
+	cmd.Stderr = io.MultiWriter(os.Stderr, &wg2Stderr)
 
 	// Start command
 	if err := cmd.Start(); err != nil {
-		return nil, err
+		return nil, newWgrib2Error(err, &wg2Stderr)
 	}
 
 	// Concurrently parse inventory
@@ -110,9 +291,6 @@ func Wgrib2Inventory(fn string) (Inventory, error) {
 		}
 	}()
 
-	// Copy standard error from wgrib2
-	go io.Copy(os.Stderr, wg2Stderr)
-
 	// Wait for inventory or parse error
 	var (
 		inv    Inventory
@@ -127,7 +305,7 @@ func Wgrib2Inventory(fn string) (Inventory, error) {
 
 	// Wait for command completion
 	if err := cmd.Wait(); err != nil {
-		return nil, err
+		return nil, newWgrib2Error(err, &wg2Stderr)
 	}
 
 	return inv, invErr
@@ -176,17 +354,97 @@ func parseShapes(r io.Reader, shapeChan chan GridShape, errChan chan error) {
 		rows, err := strconv.Atoi(submatches[2])
 		if err != nil {
 			errChan <- err
+			return
 		}
 
 		shapeChan <- GridShape{Rows: rows, Columns: columns}
 	}
 }
 
+// Regular expressions matching the latitude and longitude lines of the output
+// from "wgrib2 -grid" for a latitude-longitude grid. For example:
+//
+//	lat 90.000000 to -90.000000 by 0.500000
+//	lon 0.000000 to 359.500000 by 0.500000 #points=259920
+var (
+	gridLatRegex = regexp.MustCompile(`lat\s+(-?[0-9.]+)\s+to\s+(-?[0-9.]+)\s+by\s+(-?[0-9.]+)`)
+	gridLonRegex = regexp.MustCompile(`lon\s+(-?[0-9.]+)\s+to\s+(-?[0-9.]+)\s+by\s+(-?[0-9.]+)`)
+)
+
+// Wgrib2LatLonGrid uses the output of "wgrib2 -grid" to find the geometry of
+// the record item in sourceFn. An error is returned if the record is not on a
+// latitude-longitude grid.
+func Wgrib2LatLonGrid(item *InventoryItem, sourceFn string) (LatLonGrid, error) {
+	out, err := wgrib2Grid(item, sourceFn)
+	if err != nil {
+		return LatLonGrid{}, err
+	}
+
+	// Parse first point, last point and increment from each line
+	parse := func(re *regexp.Regexp) ([]float64, error) {
+		submatches := re.FindStringSubmatch(out)
+		if submatches == nil {
+			return nil, ErrNotLatLonGrid
+		}
+		values := []float64{}
+		for _, s := range submatches[1:] {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	lat, err := parse(gridLatRegex)
+	if err != nil {
+		return LatLonGrid{}, err
+	}
+	lon, err := parse(gridLonRegex)
+	if err != nil {
+		return LatLonGrid{}, err
+	}
+
+	return newLatLonGrid(lat[0], lat[1], lon[0], lat[2], lon[2]), nil
+}
+
+// Wgrib2GridGeometry uses the output of "wgrib2 -grid" to find the complete
+// geometry of the record item in sourceFn.
+func Wgrib2GridGeometry(item *InventoryItem, sourceFn string) (GridGeometry, error) {
+	out, err := wgrib2Grid(item, sourceFn)
+	if err != nil {
+		return GridGeometry{}, err
+	}
+	return parseWgrib2Grid(out)
+}
+
+// wgrib2Grid returns the output of "wgrib2 -grid" for the record item in
+// sourceFn.
+func wgrib2Grid(item *InventoryItem, sourceFn string) (string, error) {
+	// Only consider the first parameter of item
+	single := *item // NB: Copy of item
+	if len(single.Parameters) > 1 {
+		single.Parameters = single.Parameters[:1]
+	}
+
+	cmd := execCommand(Wgrib2Command, "-i", "-grid", sourceFn)
+	cmd.Stdin = strings.NewReader(strings.Join(single.Wgrib2Strings(), "\n") + "\n")
+	var wg2Stderr bytes.Buffer
+	cmd.Stderr = io.MultiWriter(os.Stderr, &wg2Stderr)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", newWgrib2Error(err, &wg2Stderr)
+	}
+	return string(out), nil
+}
+
 // Wgrib2GridShapes uses wgrib2 to parse dump the shapes of records
-// in sourceFn corresponding to each inventory item in inv.
+// in sourceFn corresponding to each inventory item in inv. One shape is
+// returned per item. Items with more than one parameter (e.g. wind vectors)
+// share a single grid and so only the first parameter is passed to wgrib2.
 func Wgrib2GridShapes(inv Inventory, sourceFn string) ([]GridShape, error) {
 	// Build wgrib2 command
-	cmd := exec.Command(Wgrib2Command, "-i", "-nxny", sourceFn)
+	cmd := execCommand(Wgrib2Command, "-i", "-nxny", sourceFn)
 
 	// Get stdin pipe
 	wg2Stdin, err := cmd.StdinPipe()
@@ -200,33 +458,28 @@ func Wgrib2GridShapes(inv Inventory, sourceFn string) ([]GridShape, error) {
 		return nil, err
 	}
 
-	// Get error pipe
-	wg2Stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return nil, err
-	}
+	// Capture standard error from wgrib2 while still passing it on
+	var wg2Stderr bytes.Buffer
+	cmd.Stderr = io.MultiWriter(os.Stderr, &wg2Stderr)
 
 	// Create error and shape channels
 	errChan, shapeChan := make(chan error), make(chan GridShape)
 
 	// Start command
 	if err := cmd.Start(); err != nil {
-		return nil, err
+		return nil, newWgrib2Error(err, &wg2Stderr)
 	}
 
 	// Write inventory into wgrib2
 	go func() {
 		for _, item := range inv {
-			for _, ln := range item.Wgrib2Strings() {
-				fmt.Fprintln(wg2Stdin, ln)
+			if lns := item.Wgrib2Strings(); len(lns) > 0 {
+				fmt.Fprintln(wg2Stdin, lns[0])
 			}
 		}
 		wg2Stdin.Close()
 	}()
 
-	// Copy standard error from wgrib2
-	go io.Copy(os.Stderr, wg2Stderr)
-
 	// Parse shapes from wgrib2
 	go parseShapes(wg2Stdout, shapeChan, errChan)
 
@@ -256,9 +509,83 @@ func Wgrib2GridShapes(inv Inventory, sourceFn string) ([]GridShape, error) {
 
 	// Wait for command completion
 	if err := cmd.Wait(); err != nil {
-		return nil, err
+		return nil, newWgrib2Error(err, &wg2Stderr)
+	}
+
+	// Callers index shapes by inventory position
+	if len(shapes) != len(inv) {
+		return nil, fmt.Errorf("expected %d shapes from wgrib2, got %d", len(inv), len(shapes))
 	}
 
 	// Return success
 	return shapes, nil
 }
+
+// A Grid is a single record from a GRIB2 file decoded into floating point
+// values. Values are stored in West-to-East, South-to-North order so that the
+// value at column x and row y is Values[x + y*Shape.Columns].
+type Grid struct {
+	Shape  GridShape
+	Values []float32
+}
+
+// At returns the value of the grid at column x and row y.
+func (g *Grid) At(x, y int) float32 {
+	return g.Values[x+y*g.Shape.Columns]
+}
+
+// Wgrib2ReadGrid uses wgrib2 to decode the record corresponding to item from
+// the GRIB2 file sourceFn. If item has more than one parameter, only the first
+// is decoded.
+func Wgrib2ReadGrid(item *InventoryItem, sourceFn string) (*Grid, error) {
+	// Only consider the first parameter of item
+	single := *item // NB: Copy of item
+	if len(single.Parameters) > 1 {
+		single.Parameters = single.Parameters[:1]
+	}
+	inv := Inventory{&single}
+
+	// Get the shape of the record
+	shapes, err := Wgrib2GridShapes(inv, sourceFn)
+	if err != nil {
+		return nil, err
+	}
+	if len(shapes) != 1 {
+		return nil, fmt.Errorf("expected one grid shape, got %d", len(shapes))
+	}
+
+	// Create a temporary file to receive the decoded data
+	tmpFile, err := ioutil.TempFile("", "aonui-grid-")
+	if err != nil {
+		return nil, err
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	// Extract the record as big-endian IEEE floats so that the result does
+	// not depend on the host byte order.
+	cmd := execCommand(Wgrib2Command, "-i", "-no_header", "-ieee", tmpFile.Name(), sourceFn)
+	cmd.Stdin = strings.NewReader(strings.Join(single.Wgrib2Strings(), "\n") + "\n")
+	var wg2Stderr bytes.Buffer
+	cmd.Stderr = io.MultiWriter(os.Stderr, &wg2Stderr)
+	if err := cmd.Run(); err != nil {
+		return nil, newWgrib2Error(err, &wg2Stderr)
+	}
+
+	// Read the decoded values back
+	in, err := os.Open(tmpFile.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	grid := &Grid{
+		Shape:  shapes[0],
+		Values: make([]float32, shapes[0].Columns*shapes[0].Rows),
+	}
+	if err := binary.Read(in, binary.BigEndian, grid.Values); err != nil {
+		return nil, fmt.Errorf("error reading decoded grid: %v", err)
+	}
+
+	return grid, nil
+}
@@ -0,0 +1,162 @@
+package aonui
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTool replaces execCommand for the duration of a test so that external
+// tools are run as TestHelperProcess in a sub-process of the test binary.
+// Standard input given to the tool is recorded in the returned file and
+// output is the tool's standard output. If output is "-nxny", one shape line
+// is written for each line of standard input as "wgrib2 -i -nxny" would.
+func fakeTool(t *testing.T, output string) (stdinFn string) {
+	stdinFn = filepath.Join(t.TempDir(), "stdin")
+
+	old := execCommand
+	t.Cleanup(func() { execCommand = old })
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		cs := append([]string{"-test.run=TestHelperProcess", "--", name}, args...)
+		cmd := exec.Command(os.Args[0], cs...)
+		cmd.Env = append(os.Environ(),
+			"AONUI_HELPER_PROCESS=1",
+			"AONUI_HELPER_STDIN="+stdinFn,
+			"AONUI_HELPER_OUTPUT="+output,
+		)
+		return cmd
+	}
+	return stdinFn
+}
+
+// TestHelperProcess is not a real test. It is run by fakeTool in place of an
+// external tool.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("AONUI_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	output := os.Getenv("AONUI_HELPER_OUTPUT")
+	stdin, err := os.Create(os.Getenv("AONUI_HELPER_STDIN"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintln(stdin, line)
+		if output == "-nxny" {
+			fields := strings.Split(line, ":")
+			fmt.Printf("%v:%v:(720 x 361)\n", fields[0], fields[1])
+		}
+	}
+	stdin.Close()
+
+	if output != "-nxny" {
+		fmt.Print(output)
+	}
+	os.Exit(0)
+}
+
+// A wind record with two fields and a single field record
+var windInventory = Inventory{
+	{
+		RecordNumber: 1, Offset: 0, Extent: 100,
+		When:       time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC),
+		Parameters: []string{"UGRD", "VGRD"}, LayerName: "500 mb", TypeName: "anl",
+	},
+	{
+		RecordNumber: 2, Offset: 100, Extent: 50,
+		When:       time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC),
+		Parameters: []string{"HGT"}, LayerName: "500 mb", TypeName: "anl",
+	},
+}
+
+func readLines(t *testing.T, fn string) []string {
+	contents, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(contents)), "\n")
+}
+
+func TestWgrib2GridShapesMultiParameter(t *testing.T) {
+	stdinFn := fakeTool(t, "-nxny")
+
+	shapes, err := Wgrib2GridShapes(windInventory, "input.grib2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shapes) != len(windInventory) {
+		t.Fatalf("got %d shapes, want %d", len(shapes), len(windInventory))
+	}
+	for _, s := range shapes {
+		if s.Rows != 361 || s.Columns != 720 {
+			t.Errorf("unexpected shape %+v", s)
+		}
+	}
+
+	// Only the first field of the wind record is passed to wgrib2
+	want := []string{
+		"1.1:0:d=2014060100:UGRD:500 mb:anl:",
+		"2:100:d=2014060100:HGT:500 mb:anl:",
+	}
+	if got := readLines(t, stdinFn); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("wgrib2 was given\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestWgrib2ExtractMultiParameter(t *testing.T) {
+	stdinFn := fakeTool(t, "")
+
+	destFn := filepath.Join(t.TempDir(), "out.bin")
+	if err := Wgrib2ExtractNetCDF(windInventory, "input.grib2", destFn); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every field of the wind record is extracted
+	want := []string{
+		"1.1:0:d=2014060100:UGRD:500 mb:anl:",
+		"1.2:0:d=2014060100:VGRD:500 mb:anl:",
+		"2:100:d=2014060100:HGT:500 mb:anl:",
+	}
+	if got := readLines(t, stdinFn); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("wgrib2 was given\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestParseShapesBadRows(t *testing.T) {
+	// The row count overflows an int
+	input := "1:0:(720 x 99999999999999999999999)\n2:100:(720 x 361)\n"
+	shapeChan, errChan := make(chan GridShape, 2), make(chan error, 1)
+	parseShapes(strings.NewReader(input), shapeChan, errChan)
+
+	select {
+	case err := <-errChan:
+		if err == nil {
+			t.Error("nil error sent for bad row count")
+		}
+	default:
+		t.Error("no error sent for bad row count")
+	}
+	for shape := range shapeChan {
+		t.Errorf("unexpected shape %+v", shape)
+	}
+}
+
+func TestWgrib2GridShapesMalformed(t *testing.T) {
+	fakeTool(t, "1:0:(720 x 99999999999999999999999)\n2:100:(720 x 361)\n")
+
+	shapes, err := Wgrib2GridShapes(windInventory, "input.grib2")
+	if err == nil {
+		t.Fatalf("expected an error for malformed output, got shapes %+v", shapes)
+	}
+}